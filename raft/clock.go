@@ -0,0 +1,16 @@
+package raft
+
+import "time"
+
+// Clock tells the current time, implementations must be safe for concurrent use
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+var _ Clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -19,7 +19,11 @@ import (
 type consumer struct {
 	raft *Raft
 	logs map[uint64]*pb.Entry
-	mu   *sync.RWMutex
+	// logIds stores log IDs in the order they are applied
+	logIds []uint64
+	// snapshot is the last snapshot installed from the leader
+	snapshot *pb.Entry
+	mu       *sync.RWMutex
 }
 
 func newConsumer(raft *Raft) *consumer {
@@ -38,8 +42,14 @@ func (c *consumer) start(ctx context.Context) {
 
 		case e := <-c.raft.ApplyCh():
 			c.mu.Lock()
-			c.logs[e.Id] = e
+			if e.GetType() == pb.EntryType_SNAPSHOT {
+				c.snapshot = e
+			} else {
+				c.logs[e.Id] = e
+				c.logIds = append(c.logIds, e.Id)
+			}
 			c.mu.Unlock()
+			c.raft.Applied(e.GetId())
 		}
 	}
 }
@@ -51,6 +61,20 @@ func (c *consumer) getLog(id uint64) *pb.Entry {
 	return c.logs[id]
 }
 
+func (c *consumer) getSnapshot() *pb.Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.snapshot
+}
+
+func (c *consumer) getLogIds() []uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return append([]uint64{}, c.logIds...)
+}
+
 // cluster is a raft cluster for testing
 type cluster struct {
 	t           *testing.T
@@ -62,12 +86,33 @@ type cluster struct {
 	cancelFuncs map[uint32]context.CancelFunc
 	consumers   map[uint32]*consumer
 	persisters  map[uint32]Persister
+	// configure modifies the config of each server before it is initialized if set
+	configure func(id uint32, config *Config)
+	// ids are IDs of the initial servers
+	ids []uint32
 }
 
 func newCluster(t *testing.T, numNodes int) *cluster {
+	return newClusterWithConfig(t, numNodes, nil)
+}
+
+// newClusterWithConfig creates a cluster whose servers' configs are modified by configure
+func newClusterWithConfig(t *testing.T, numNodes int, configure func(id uint32, config *Config)) *cluster {
+	ids := make([]uint32, numNodes)
+	for i := range ids {
+		ids[i] = uint32(i + 1)
+	}
+
+	return newClusterWithIds(t, ids, configure)
+}
+
+// newClusterWithIds creates a cluster of servers with the given IDs, whose configs are modified by configure
+func newClusterWithIds(t *testing.T, ids []uint32, configure func(id uint32, config *Config)) *cluster {
 	c := cluster{
 		t:           t,
-		numNodes:    numNodes,
+		numNodes:    len(ids),
+		ids:         ids,
+		configure:   configure,
 		rafts:       make(map[uint32]*Raft),
 		listerers:   make(map[uint32]net.Listener),
 		servers:     make(map[uint32]*grpc.Server),
@@ -83,8 +128,7 @@ func newCluster(t *testing.T, numNodes int) *cluster {
 
 	c.logger = logger
 
-	for i := 1; i <= numNodes; i++ {
-		id := uint32(i)
+	for _, id := range ids {
 		c.initialize(id)
 	}
 
@@ -101,8 +145,35 @@ func newCluster(t *testing.T, numNodes int) *cluster {
 	return &c
 }
 
+// timeoutFirst configures the given server to always time out with the minimal timeout, and the others with the
+// maximal timeout, so the given server is the first to start an election
+func timeoutFirst(serverId uint32) func(id uint32, config *Config) {
+	return func(id uint32, config *Config) {
+		config.randomTimeout = func(minVal time.Duration) <-chan time.Time {
+			if id == serverId {
+				return time.After(minVal)
+			}
+
+			return time.After(2 * minVal)
+		}
+	}
+}
+
 // initialize initializes raft and the raft RPC server
 func (c *cluster) initialize(serverId uint32) {
+	// initialized peers without connection
+	peers := make(map[uint32]Peer)
+	for _, peerId := range c.ids {
+		if serverId != peerId {
+			peers[peerId] = &peer{}
+		}
+	}
+
+	c.initializeWithPeers(serverId, peers)
+}
+
+// initializeWithPeers initializes raft with the given peers and the raft RPC server
+func (c *cluster) initializeWithPeers(serverId uint32, peers map[uint32]Peer) {
 	c.logger.Debug("initializing raft", zap.Uint32("id", serverId))
 
 	lis, err := net.Listen("tcp", ":0")
@@ -115,15 +186,6 @@ func (c *cluster) initialize(serverId uint32) {
 		zap.Uint32("id", serverId),
 		zap.String("addr", c.listerers[serverId].Addr().String()))
 
-	// initialized peers without connection
-	peers := make(map[uint32]Peer)
-	for i := 1; i <= c.numNodes; i++ {
-		peerId := uint32(i)
-		if serverId != peerId {
-			peers[peerId] = &peer{}
-		}
-	}
-
 	persister := c.persisters[serverId]
 	if persister == nil {
 		persister = newPersister()
@@ -134,6 +196,12 @@ func (c *cluster) initialize(serverId uint32) {
 		HeartbeatTimeout:  150 * time.Millisecond,
 		ElectionTimeout:   150 * time.Millisecond,
 		HeartbeatInterval: 50 * time.Millisecond,
+		StrictLogChecks:   true,
+		DebugInvariants:   true,
+		Address:           lis.Addr().String(),
+	}
+	if c.configure != nil {
+		c.configure(serverId, config)
 	}
 
 	raft := NewRaft(serverId, peers, persister, config, c.logger)
@@ -142,8 +210,7 @@ func (c *cluster) initialize(serverId uint32) {
 	consumer := newConsumer(raft)
 	c.consumers[serverId] = consumer
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterRaftServer(grpcServer, raft)
+	grpcServer := NewGRPCServer(raft)
 	c.servers[serverId] = grpcServer
 
 	go func(lis net.Listener) {
@@ -169,6 +236,39 @@ func (c *cluster) start(serverId uint32) {
 	c.cancelFuncs[serverId] = cancel
 }
 
+// join initializes a raft server without peers, joins it into the cluster through the given server, then starts it
+func (c *cluster) join(serverId, viaId uint32) {
+	c.joinCluster(serverId, viaId, (*Raft).JoinCluster)
+}
+
+// joinAsLearner is the same as join, but the server joins as a learner
+func (c *cluster) joinAsLearner(serverId, viaId uint32) {
+	c.joinCluster(serverId, viaId, (*Raft).JoinClusterAsLearner)
+}
+
+// joinAsObserver is the same as join, but the server joins as an observer
+func (c *cluster) joinAsObserver(serverId, viaId uint32) {
+	c.joinCluster(serverId, viaId, (*Raft).JoinClusterAsObserver)
+}
+
+func (c *cluster) joinCluster(serverId, viaId uint32, join func(*Raft, context.Context, Peer) error) {
+	c.initializeWithPeers(serverId, make(map[uint32]Peer))
+
+	via, err := NewGRPCPeer(c.listerers[viaId].Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		c.t.Fatal("fail to connect to peer:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := join(c.rafts[serverId], ctx, via); err != nil {
+		c.t.Fatal("fail to join cluster:", err)
+	}
+
+	c.start(serverId)
+}
+
 // stopAll stops all raft servers
 func (c *cluster) stopAll() {
 	for id := range c.rafts {
@@ -183,8 +283,10 @@ func (c *cluster) stop(serverId uint32) {
 	}
 
 	c.servers[serverId].GracefulStop()
-	cancel := c.cancelFuncs[serverId]
-	cancel()
+	// the server is not started if joining the cluster fails
+	if cancel := c.cancelFuncs[serverId]; cancel != nil {
+		cancel()
+	}
 
 	c.cancelFuncs[serverId] = nil
 	c.rafts[serverId] = nil
@@ -315,6 +417,10 @@ func (c *cluster) applyCommand(id uint32, term uint64, data []byte) uint64 {
 	return resp.Entry.GetId()
 }
 
+func (c *cluster) removeServer(id uint32, serverId uint32) (*pb.RemoveServerResponse, error) {
+	return c.rafts[id].RemoveServer(context.Background(), &pb.RemoveServerRequest{ServerId: serverId, ClusterId: c.rafts[id].config.ClusterId})
+}
+
 func (c *cluster) checkLog(serverId uint32, logId uint64, term uint64, data []byte) {
 	l := c.consumers[serverId].getLog(logId)
 
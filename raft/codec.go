@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+var errNoCodec = errors.New("codec is not configured")
+
+// Codec encodes commands of the application into the data of command logs, and decodes them back
+type Codec interface {
+	Encode(command interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// TypedEntry is a log delivered by the TypedApplyCh along with the command decoded from it,
+// the command is nil for snapshots installed from the leader
+type TypedEntry struct {
+	*pb.Entry
+
+	Command interface{}
+}
+
+// ApplyTyped encodes the command by `Codec` of the config and applies it by ApplyCommand
+func (r *Raft) ApplyTyped(ctx context.Context, command interface{}) (*pb.ApplyCommandResponse, error) {
+	if r.config.Codec == nil {
+		return nil, errNoCodec
+	}
+
+	data, err := r.config.Codec.Encode(command)
+	if err != nil {
+		return nil, fmt.Errorf("fail to encode command: %w", err)
+	}
+
+	return r.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: data})
+}
+
+// TypedApplyCh consumes the ApplyCh until the context is done, and delivers logs along with commands decoded by
+// `Codec` of the config, logs failed to decode are skipped and acknowledged, so the ApplyCh should not be consumed
+// elsewhere, the state machine still calls Applied after processing each delivered entry
+func (r *Raft) TypedApplyCh(ctx context.Context) (<-chan *TypedEntry, error) {
+	if r.config.Codec == nil {
+		return nil, errNoCodec
+	}
+
+	typedCh := make(chan *TypedEntry)
+
+	go func() {
+		defer close(typedCh)
+
+		for {
+			var log *pb.Entry
+			select {
+			case <-ctx.Done():
+				return
+			case log = <-r.applyCh:
+			}
+
+			entry := &TypedEntry{Entry: log}
+			if log.GetType() == pb.EntryType_COMMAND {
+				command, err := r.config.Codec.Decode(log.GetData())
+				if err != nil {
+					r.logger.Error("fail to decode command, skip the log", zap.Error(err), zap.Uint64("id", log.GetId()))
+					r.Applied(log.GetId())
+					continue
+				}
+
+				entry.Command = command
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case typedCh <- entry:
+			}
+		}
+	}()
+
+	return typedCh, nil
+}
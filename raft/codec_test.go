@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testCommand struct {
+	Key   string
+	Value int
+}
+
+// jsonCodec encodes testCommand as JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var command testCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return nil, err
+	}
+
+	return command, nil
+}
+
+func TestApplyTyped(t *testing.T) {
+	config := &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		Codec:             jsonCodec{},
+	}
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), config, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	typedCh, err := r.TypedApplyCh(ctx)
+	if err != nil {
+		t.Fatal("fail to get typed apply channel:", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	commands := []testCommand{{Key: "a", Value: 1}, {Key: "b", Value: 2}}
+	for _, command := range commands {
+		if _, err := r.ApplyTyped(ctx, command); err != nil {
+			t.Fatal("fail to apply typed command:", err)
+		}
+	}
+
+	for i, command := range commands {
+		select {
+		case entry := <-typedCh:
+			if entry.GetId() != uint64(i+1) || entry.Command != command {
+				t.Fatalf("expect command %v in log %d, got %v in log %d", command, i+1, entry.Command, entry.GetId())
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("command %v should be applied", command)
+		}
+	}
+}
+
+func TestApplyTypedWithoutCodec(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, nil, &Config{}, zap.NewNop())
+
+	if _, err := r.ApplyTyped(context.Background(), testCommand{}); !errors.Is(err, errNoCodec) {
+		t.Fatalf("expect error %v, got %v", errNoCodec, err)
+	}
+	if _, err := r.TypedApplyCh(context.Background()); !errors.Is(err, errNoCodec) {
+		t.Fatalf("expect error %v, got %v", errNoCodec, err)
+	}
+}
@@ -1,9 +1,170 @@
 package raft
 
-import "time"
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+)
 
 type Config struct {
 	HeartbeatTimeout  time.Duration
 	ElectionTimeout   time.Duration
 	HeartbeatInterval time.Duration
+
+	// CommitOnlyHeartbeat sends heartbeats carrying only the commit index to peers having all logs,
+	// without looking up logs to send
+	CommitOnlyHeartbeat bool
+
+	// MaxBatchSize makes the leader send new logs to a peer right after they are appended instead of waiting for the
+	// next heartbeat, logs appended while an AppendEntries RPC is in flight to the peer are coalesced into the next
+	// RPC sent once the response arrives, each RPC carries at most this many logs, zero means logs are only sent
+	// by heartbeats without a limit
+	MaxBatchSize int
+
+	// MaxInflight is the maximum number of logs appended by the leader but not committed yet, further commands are
+	// rejected by ApplyCommand with ErrTooManyRequests until replication catches up, zero means no limit
+	MaxInflight int
+
+	// MaxCommandSize is the maximum size of a command log encoded in protobuf, including the framing of its ID, term
+	// and type besides the command data, larger commands are rejected by ApplyCommand with ErrCommandTooLarge, so a
+	// single log never exceeds the gRPC message limit when replicated, zero means no limit
+	MaxCommandSize int
+
+	// Rand is the source of random timeouts, so elections are reproducible with a seeded source, defaults to a
+	// time-seeded source. A *rand.Rand is not safe for concurrent use, Raft serializes its own use of the source by a
+	// package-level lock, so the source can be shared among servers, but callers must not use the source
+	// concurrently once it is set
+	Rand *rand.Rand
+
+	// ElectionPriority makes the server notice the loss of the leader earlier and shortens its random election timeout,
+	// so servers with a higher priority are more likely to become the leader, a follower still starts an election only
+	// after the heartbeat timeout, zero means no priority
+	ElectionPriority int
+
+	// ElectionStrategy decides when the server starts elections, the timeout of the candidate, and whose votes count
+	// towards the quorum, defaults to the standard Raft strategy
+	ElectionStrategy ElectionStrategy
+
+	// AdaptiveElectionTimeout sets the heartbeat timeout and the election timeout to a multiple of the round-trip
+	// time observed by AppendEntries and RequestVote RPCs, where the configured timeouts are the lower bounds
+	AdaptiveElectionTimeout bool
+	// MaxElectionTimeout is the upper bound of adaptive timeouts, zero means no upper bound
+	MaxElectionTimeout time.Duration
+
+	// ElectionBackoff doubles the election timeout for each failed election since the server last followed a leader,
+	// bounded by MaxElectionTimeout, or 8x the election timeout if it is not set
+	ElectionBackoff bool
+
+	// RPCTimeout bounds each outgoing RPC, InstallSnapshot RPCs are bounded by 10x of it, since RPCs to a peer are
+	// sent one at a time, a bounded timeout keeps a peer that never responds from holding up later RPCs,
+	// defaults to 1s
+	RPCTimeout time.Duration
+	// RPCRetries is the number of retries of RPCs to peers failed with transient errors
+	RPCRetries int
+
+	// AsyncPersist persists the raft state by a background writer, which batches queued states into a single write,
+	// responses are still sent after the state is durable
+	AsyncPersist bool
+
+	// ApplyChannelBuffer is the buffer size of the ApplyCh, a larger buffer lets the main loop run ahead of a slow
+	// state machine, buffered logs are not applied until acknowledged by Applied, defaults to 256
+	ApplyChannelBuffer int
+
+	// DrainApplyOnShutdown applies logs committed but not applied yet before Run returns once the context is done,
+	// which blocks until the ApplyCh has room for them, otherwise Run returns immediately and logs being sent to the
+	// ApplyCh are abandoned, defaults to true
+	DrainApplyOnShutdown *bool
+
+	// ApplyFunc applies committed command logs and snapshots installed from the leader (as `SNAPSHOT` entries whose
+	// data is the snapshot data) instead of sending them to the ApplyCh, if it returns an error,
+	// the log is not marked as applied and is delivered again later, logs after it are not applied until then
+	ApplyFunc func(log *pb.Entry) error
+
+	// Codec encodes and decodes commands of the application for ApplyTyped and the TypedApplyCh
+	Codec Codec
+
+	// RestoreSnapshot is invoked on startup with the persisted snapshot before any log is applied, so the state
+	// machine is seeded from the snapshot, logs compacted into the snapshot are never applied again
+	RestoreSnapshot func(meta SnapshotMeta, data []byte) error
+
+	// TakeSnapshot writes the state machine with logs applied up to and including the given ID for SnapshotNow, it is
+	// invoked by the main loop, so no log is applied while it runs if logs are applied through `ApplyFunc`
+	TakeSnapshot func(id uint64, w io.Writer) error
+
+	// MaxConcurrentSnapshots is the maximum number of snapshots the leader sends at a time, other peers needing a
+	// snapshot wait until a transfer is done and are retried on later heartbeats, zero means no limit
+	MaxConcurrentSnapshots int
+
+	// PromotionThreshold makes the leader promote a learner once its logs stay within this many logs of the leader
+	// for an election timeout, without calling PromoteLearner, observers are never promoted, zero means learners are
+	// only promoted by PromoteLearner
+	PromotionThreshold int
+
+	// LeaderNoop appends a no-op log once the server is elected, so logs of previous terms are committed and the
+	// leader becomes Ready without waiting for a client command
+	LeaderNoop bool
+
+	// SnapshotThreshold requests the application to take a snapshot through the SnapshotRequestCh once more than
+	// this many logs are not compacted, zero means snapshots are only taken by the application itself
+	SnapshotThreshold int
+
+	// RetainLogEntries makes the leader request snapshots only up to the minimum applied index of followers, so a
+	// slightly behind follower catches up from logs instead of installing a snapshot, but at most this many logs
+	// behind the last applied log are kept for followers lagging further, zero means followers are not waited for
+	RetainLogEntries int
+
+	// OnCommit is invoked in log order exactly once for each log committed after the server starts,
+	// before the log is applied, on the leader and followers alike, logs installed by a snapshot are not included
+	OnCommit func(log *pb.Entry)
+
+	// LogSampling samples repeated logs, such as logs of heartbeats, so production logs are not flooded,
+	// nil means all logs are written
+	LogSampling *LogSampling
+
+	// Metrics receives events and measurements of raft, defaults to discarding them
+	Metrics Metrics
+	// Clock measures the time spent in each role reported to Metrics, defaults to the system clock
+	Clock Clock
+
+	// OnSafetyViolation is invoked with an error wrapping ErrSafetyViolation if the server observes a violation of
+	// raft safety, such as two leaders in the same term, e.g. to alert operators or stop the server
+	OnSafetyViolation func(err error)
+
+	// DebugInvariants checks invariants of the raft state after each state transition and commit,
+	// and panics on violation, it is meant for testing and debugging
+	DebugInvariants bool
+
+	// StrictLogChecks rejects appending logs whose IDs are not contiguous to the last log, and panics instead if
+	// `DebugInvariants` is also enabled
+	StrictLogChecks bool
+
+	// GroupId is the ID of the Raft group the server belongs to, it is set in outgoing requests so servers of
+	// multiple groups sharing a gRPC server are reached through `RegisterMultiRaft`
+	GroupId uint64
+
+	// ClusterId identifies the cluster the server belongs to, it is set in outgoing requests between servers and in
+	// requests to join, such requests and membership changes of another cluster are rejected, so clients removing
+	// servers or promoting learners set it as well, empty means no check
+	ClusterId string
+
+	// Witnesses are IDs of voters storing no logs, they vote in elections but never become the leader, and logs are
+	// committed only once stored on a majority of voters counting full servers only, see `witness.go` for the safety
+	// implications, it must be the same on all servers and witnesses are not changed through membership changes
+	Witnesses map[uint32]bool
+
+	// Address is the address other nodes use to reach this node, it is shared through membership changes
+	Address string
+	// DialPeer creates a Peer to a newly added server, defaults to an insecure gRPC connection,
+	// secured clusters should set it to dial through `NewGRPCPeer` with credentials, peers dialed to follow leader
+	// hints by JoinCluster are closed once it returns, peers not created by `NewGRPCPeer` are closed if they implement
+	// io.Closer
+	DialPeer func(addr string) (Peer, error)
+
+	// randomTimeout overrides the selection of random timeouts, used by tests to control which server times out first
+	randomTimeout func(minVal time.Duration) <-chan time.Time
+	// electionResultCh receives the term and the result of each election the server runs as candidate,
+	// used by tests to wait for elections instead of polling
+	electionResultCh chan electionResult
 }
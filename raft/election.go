@@ -0,0 +1,64 @@
+package raft
+
+import "time"
+
+// ElectionStrategy decides when the server starts elections, how long the candidate waits for votes, and whose votes
+// count towards the quorum, so alternatives such as witness servers are plugged in without forking the election
+// logic, implementations must be safe for concurrent use if shared by servers
+type ElectionStrategy interface {
+	// ShouldStartElection reports whether the server, a voter that misses heartbeats of the leader, starts an election
+	ShouldStartElection(serverId uint32) bool
+	// ComputeTimeout returns the timeout of the candidate to wait for votes, given the minimal election timeout,
+	// which is already adapted and backed off as configured
+	ComputeTimeout(minTimeout time.Duration) time.Duration
+	// CountsTowardQuorum reports whether the vote of the server counts towards the quorum of elections, voters not
+	// counted are excluded from the quorum size as well
+	CountsTowardQuorum(serverId uint32) bool
+}
+
+// standardElection is the election strategy of standard Raft, every voter starts elections and counts towards the
+// quorum, and the candidate waits for a random timeout between the minimal timeout and twice of it, which is closer
+// to the minimal timeout by a higher `ElectionPriority`
+type standardElection struct {
+	r *Raft
+}
+
+var _ ElectionStrategy = standardElection{}
+
+func (standardElection) ShouldStartElection(serverId uint32) bool {
+	return true
+}
+
+func (s standardElection) ComputeTimeout(minTimeout time.Duration) time.Duration {
+	extra := time.Duration(s.r.int63n(int64(minTimeout)))
+
+	return minTimeout + extra/time.Duration(s.r.electionPriority()+1)
+}
+
+func (standardElection) CountsTowardQuorum(serverId uint32) bool {
+	return true
+}
+
+// electionStrategy returns `ElectionStrategy` of the config, which defaults to the standard Raft strategy
+func (r *Raft) electionStrategy() ElectionStrategy {
+	if r.config.ElectionStrategy != nil {
+		return r.config.ElectionStrategy
+	}
+
+	return standardElection{r: r}
+}
+
+// numElectionVoters returns the number of voters in the configuration counting towards the quorum of elections,
+// including the server itself
+func (r *Raft) numElectionVoters() int {
+	strategy := r.electionStrategy()
+
+	voters := 0
+	for id := range r.configuration {
+		if !r.learners[id] && strategy.CountsTowardQuorum(id) {
+			voters++
+		}
+	}
+
+	return voters
+}
@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/justin0u0/raft/pb"
+	"google.golang.org/grpc"
+)
+
+// multiRaft dispatches incoming RPCs to the Raft group given by the group ID of the request
+type multiRaft struct {
+	pb.UnimplementedRaftServer
+
+	groups map[uint64]*Raft
+}
+
+var _ pb.RaftServer = (*multiRaft)(nil)
+
+// RegisterMultiRaft registers the Raft service of multiple Raft groups on the gRPC server, so the groups share the
+// server and its transport, each server of a group should set `GroupId` of its config to the group ID
+func RegisterMultiRaft(s *grpc.Server, groups map[uint64]*Raft) {
+	m := &multiRaft{groups: make(map[uint64]*Raft, len(groups))}
+	for groupId, r := range groups {
+		m.groups[groupId] = r
+	}
+
+	pb.RegisterRaftServer(s, m)
+}
+
+// group returns the Raft of the given group ID
+func (m *multiRaft) group(groupId uint64) (*Raft, error) {
+	r, ok := m.groups[groupId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errUnknownGroup, groupId)
+	}
+
+	return r, nil
+}
+
+func (m *multiRaft) ApplyCommand(ctx context.Context, req *pb.ApplyCommandRequest) (*pb.ApplyCommandResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ApplyCommand(ctx, req)
+}
+
+func (m *multiRaft) ApplyCommandStream(req *pb.ApplyCommandRequest, stream pb.Raft_ApplyCommandStreamServer) error {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return err
+	}
+
+	return r.ApplyCommandStream(req, stream)
+}
+
+func (m *multiRaft) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.AppendEntries(ctx, req)
+}
+
+func (m *multiRaft) RequestVote(ctx context.Context, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.RequestVote(ctx, req)
+}
+
+func (m *multiRaft) TimeoutNow(ctx context.Context, req *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.TimeoutNow(ctx, req)
+}
+
+func (m *multiRaft) InstallSnapshot(ctx context.Context, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.InstallSnapshot(ctx, req)
+}
+
+func (m *multiRaft) AddServer(ctx context.Context, req *pb.AddServerRequest) (*pb.AddServerResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.AddServer(ctx, req)
+}
+
+func (m *multiRaft) RemoveServer(ctx context.Context, req *pb.RemoveServerRequest) (*pb.RemoveServerResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.RemoveServer(ctx, req)
+}
+
+func (m *multiRaft) PromoteLearner(ctx context.Context, req *pb.PromoteLearnerRequest) (*pb.PromoteLearnerResponse, error) {
+	r, err := m.group(req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.PromoteLearner(ctx, req)
+}
@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+var errInvariantViolated = errors.New("invariant violated")
+
+// invariants stores the state observed by previous invariant checks
+type invariants struct {
+	// term is the greatest term observed
+	term uint64
+	// leaderId is the leader observed in the term, 0 if unknown
+	leaderId uint32
+	// commitIndex is the greatest commit index observed
+	commitIndex uint64
+	// commitTerm is the term of the log at the commit index, which must never change
+	commitTerm uint64
+}
+
+// checkInvariants panics if the raft state violates an invariant, it is a no-op unless `DebugInvariants` is enabled
+func (r *Raft) checkInvariants() {
+	if !r.config.DebugInvariants {
+		return
+	}
+
+	if err := r.verifyInvariants(); err != nil {
+		r.logger.Panic("invariant violated", zap.Error(err))
+	}
+}
+
+// reportSafetyViolation reports the violation to `OnSafetyViolation` of the config if set, then logs it at DPanic
+// level, which panics with development loggers
+func (r *Raft) reportSafetyViolation(err error) {
+	if r.config.OnSafetyViolation != nil {
+		r.config.OnSafetyViolation(err)
+	}
+
+	r.logger.DPanic("safety violation", zap.Error(err))
+}
+
+// verifyInvariants checks the raft state against the invariants and records the observed term and leader
+func (r *Raft) verifyInvariants() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if lastLogId, _ := r.getLastLog(); r.commitIndex > lastLogId {
+		return fmt.Errorf("%w: commit index %d exceeds last log id %d", errInvariantViolated, r.commitIndex, lastLogId)
+	}
+
+	if r.lastApplied > r.commitIndex {
+		return fmt.Errorf("%w: last applied %d exceeds commit index %d", errInvariantViolated, r.lastApplied, r.commitIndex)
+	}
+
+	if r.currentTerm < r.invariants.term {
+		return fmt.Errorf("%w: term decreases from %d to %d", errInvariantViolated, r.invariants.term, r.currentTerm)
+	}
+
+	if r.currentTerm > r.invariants.term {
+		r.invariants.term = r.currentTerm
+		r.invariants.leaderId = 0
+	}
+
+	if err := r.verifyLogs(); err != nil {
+		return err
+	}
+
+	leaderId := r.leaderId
+	if r.state == Leader {
+		leaderId = r.id
+	}
+
+	if leaderId != 0 {
+		if r.invariants.leaderId != 0 && r.invariants.leaderId != leaderId {
+			return fmt.Errorf("%w: both %d and %d are leader in term %d", errInvariantViolated, r.invariants.leaderId, leaderId, r.currentTerm)
+		}
+
+		r.invariants.leaderId = leaderId
+	}
+
+	return nil
+}
+
+// verifyLogs checks that logs are contiguous with non-decreasing terms, and logs once committed are never replaced
+// by other logs with the same ID, then records the observed commit index
+func (r *Raft) verifyLogs() error {
+	prevId, prevTerm := r.snapshotMeta.LastIncludedId, r.snapshotMeta.LastIncludedTerm
+	for _, log := range r.logs {
+		if log.GetId() != prevId+1 {
+			return fmt.Errorf("%w: log %d follows log %d", errInvariantViolated, log.GetId(), prevId)
+		}
+
+		if log.GetTerm() < prevTerm {
+			return fmt.Errorf("%w: term of log %d decreases from %d to %d", errInvariantViolated, log.GetId(), prevTerm, log.GetTerm())
+		}
+
+		prevId, prevTerm = log.GetId(), log.GetTerm()
+	}
+
+	if prevTerm > r.currentTerm {
+		return fmt.Errorf("%w: last log term %d exceeds current term %d", errInvariantViolated, prevTerm, r.currentTerm)
+	}
+
+	// the committed log may be compacted into the snapshot since observed
+	if id := r.invariants.commitIndex; id != 0 && id >= r.snapshotMeta.LastIncludedId {
+		if term := r.getLogTerm(id); term != r.invariants.commitTerm {
+			return fmt.Errorf("%w: term of committed log %d changes from %d to %d", errInvariantViolated, id, r.invariants.commitTerm, term)
+		}
+	}
+
+	if r.commitIndex > r.invariants.commitIndex {
+		r.invariants.commitIndex = r.commitIndex
+		r.invariants.commitTerm = r.getLogTerm(r.commitIndex)
+	}
+
+	return nil
+}
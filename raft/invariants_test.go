@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+func TestVerifyInvariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		violate func(r *Raft)
+	}{
+		{
+			name:    "commit index beyond last log",
+			violate: func(r *Raft) { r.commitIndex = 3 },
+		},
+		{
+			name:    "last applied beyond commit index",
+			violate: func(r *Raft) { r.lastApplied = 2 },
+		},
+		{
+			name:    "term decreases",
+			violate: func(r *Raft) { r.currentTerm = 0 },
+		},
+		{
+			name:    "two leaders in a term",
+			violate: func(r *Raft) { r.leaderId = 3 },
+		},
+		{
+			name:    "non-contiguous logs",
+			violate: func(r *Raft) { r.logs = append(r.logs, &pb.Entry{Id: 4, Term: 1}) },
+		},
+		{
+			name:    "log term decreases",
+			violate: func(r *Raft) { r.logs[0].Term = 2 },
+		},
+		{
+			name:    "log term beyond current term",
+			violate: func(r *Raft) { r.logs = append(r.logs, &pb.Entry{Id: 3, Term: 2}) },
+		},
+		{
+			name: "committed log replaced",
+			violate: func(r *Raft) {
+				r.currentTerm = 2
+				r.leaderId = 0
+				r.logs = []*pb.Entry{{Id: 1, Term: 2}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{}, zap.NewNop())
+			r.currentTerm = 1
+			r.leaderId = 2
+			r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+			r.setCommitIndex(1)
+
+			if err := r.verifyInvariants(); err != nil {
+				t.Fatal("invariants should hold:", err)
+			}
+
+			tt.violate(r)
+
+			if err := r.verifyInvariants(); !errors.Is(err, errInvariantViolated) {
+				t.Fatalf("expect invariant violation, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, nil, &Config{}, zap.NewNop())
+	r.commitIndex = 1
+
+	// checks are skipped unless enabled
+	r.checkInvariants()
+
+	r.config.DebugInvariants = true
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("violated invariant should panic")
+		}
+	}()
+
+	r.checkInvariants()
+}
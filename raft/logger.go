@@ -0,0 +1,46 @@
+package raft
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogSampling samples logs of the same level and message, such as logs of heartbeats, the first `First` logs within
+// each `Tick` are written, and then every `Thereafter`-th log, or none if `Thereafter` is zero
+type LogSampling struct {
+	Tick       time.Duration
+	First      int
+	Thereafter int
+}
+
+// NewProductionLogger returns a logger writing JSON logs at info level with ISO8601 timestamps, which is the
+// recommended logger to run raft in production along with `LogSampling`, since logs at info level are written for
+// every RPC. Each log of the server carries its ID in the `id` field.
+func NewProductionLogger(opts ...zap.Option) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	// raft samples its own logs by `LogSampling`
+	config.Sampling = nil
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	return config.Build(opts...)
+}
+
+// NewDevelopmentLogger returns a logger writing human-readable logs at debug level, which is meant for tests and
+// debugging.
+func NewDevelopmentLogger(opts ...zap.Option) (*zap.Logger, error) {
+	return zap.NewDevelopment(opts...)
+}
+
+// sampleLogger wraps the logger to sample its logs by `LogSampling` of the config if set
+func sampleLogger(logger *zap.Logger, sampling *LogSampling) *zap.Logger {
+	if sampling == nil {
+		return logger
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, sampling.Tick, sampling.First, sampling.Thereafter)
+	}))
+}
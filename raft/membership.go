@@ -0,0 +1,755 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxJoinRedirects is the maximum number of leader hints to follow when joining a cluster
+const maxJoinRedirects = 3
+
+// JoinCluster joins the node into an existing cluster by asking the given node to add it into the configuration,
+// the leader hint is followed if the given node is not the leader.
+//
+// The node is a voter once the configuration including it is appended, before it has caught up with any log, so
+// while it catches up the cluster tolerates one failure less, e.g. growing 3 servers to 4 needs 3 of them to commit,
+// and a failure of another server stalls the cluster until the node catches up. A node with a long log to catch up
+// should join by JoinClusterAsLearner instead, and be promoted by PromoteLearner or `PromotionThreshold`.
+//
+// Note that the node should be created with empty peers, and JoinCluster should be called before running it, so the
+// node never starts an election before receiving the configuration including itself.
+func (r *Raft) JoinCluster(ctx context.Context, leader Peer) error {
+	return r.joinCluster(ctx, leader, false, false)
+}
+
+// JoinClusterAsLearner joins the node into an existing cluster as a learner, which replicates logs without voting
+// until it is promoted by PromoteLearner, see JoinCluster for details.
+func (r *Raft) JoinClusterAsLearner(ctx context.Context, leader Peer) error {
+	return r.joinCluster(ctx, leader, true, false)
+}
+
+// JoinClusterAsObserver joins the node into an existing cluster as an observer, which replicates logs without voting
+// and can never be promoted, see JoinCluster for details.
+func (r *Raft) JoinClusterAsObserver(ctx context.Context, leader Peer) error {
+	return r.joinCluster(ctx, leader, false, true)
+}
+
+func (r *Raft) joinCluster(ctx context.Context, leader Peer, learner, observer bool) error {
+	if r.config.Address == "" {
+		return errNoAddress
+	}
+
+	r.mu.Lock()
+	r.initialConfiguration = map[uint32]string{}
+	r.configuration = map[uint32]string{}
+	r.mu.Unlock()
+
+	req := &pb.AddServerRequest{
+		ServerId:  r.id,
+		Address:   r.config.Address,
+		Learner:   learner,
+		Observer:  observer,
+		GroupId:   r.config.GroupId,
+		ClusterId: r.config.ClusterId,
+	}
+
+	// peers dialed to follow leader hints are closed once they are done with, the given peer is left to the caller
+	var dialed Peer
+	defer func() {
+		if dialed != nil {
+			r.closePeer(dialed)
+		}
+	}()
+
+	for i := 0; i <= maxJoinRedirects; i++ {
+		resp, err := leader.AddServer(ctx, req)
+		if err != nil {
+			return fmt.Errorf("fail to send AddServer RPC: %w", err)
+		}
+
+		if resp.GetSuccess() {
+			r.logger.Info("join cluster successfully", zap.Uint32("leader", resp.GetLeaderId()))
+			return nil
+		}
+
+		if resp.GetLeaderAddress() == "" {
+			return errNotLeader
+		}
+
+		r.logger.Info("contacted node is not leader, follow the leader hint",
+			zap.Uint32("leader", resp.GetLeaderId()),
+			zap.String("addr", resp.GetLeaderAddress()))
+
+		if dialed != nil {
+			r.closePeer(dialed)
+			dialed = nil
+		}
+		if leader, err = r.dialPeer(resp.GetLeaderAddress()); err != nil {
+			return fmt.Errorf("fail to connect to leader: %w", err)
+		}
+		dialed = leader
+	}
+
+	return fmt.Errorf("%w: too many redirects", errNotLeader)
+}
+
+// follower: reject with leader hint
+// candidate: reject with leader hint
+// leader: append configuration log including the new server, the server does not vote if it is added as a learner or an observer
+func (r *Raft) addServer(req *pb.AddServerRequest) (*pb.AddServerResponse, error) {
+	if r.state != Leader {
+		r.logger.Info("reject add server since not leader", zap.Uint32("leader", r.leaderId))
+		return &pb.AddServerResponse{Success: false, LeaderId: r.leaderId, LeaderAddress: r.serverAddress(r.leaderId)}, nil
+	}
+
+	if _, ok := r.configuration[req.GetServerId()]; ok {
+		r.logger.Info("server is already a member", zap.Uint32("server", req.GetServerId()))
+		return &pb.AddServerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+	}
+
+	if err := r.checkConfigurationCommitted(); err != nil {
+		r.logger.Info("reject add server", zap.Error(err), zap.Uint32("server", req.GetServerId()))
+		return nil, err
+	}
+
+	configuration := make(map[uint32]string, len(r.configuration)+1)
+	for id := range r.configuration {
+		configuration[id] = r.serverAddress(id)
+	}
+	configuration[req.GetServerId()] = req.GetAddress()
+
+	// observers are learners that can never be promoted
+	learners := copyServers(r.learners)
+	observers := copyServers(r.observers)
+	if req.GetLearner() || req.GetObserver() {
+		learners[req.GetServerId()] = true
+	}
+	if req.GetObserver() {
+		observers[req.GetServerId()] = true
+	}
+
+	if err := r.appendConfiguration(configuration, learners, observers); err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("add server", zap.Uint32("server", req.GetServerId()), zap.String("addr", req.GetAddress()),
+		zap.Bool("learner", req.GetLearner()), zap.Bool("observer", req.GetObserver()))
+
+	return &pb.AddServerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+}
+
+// follower: reject with leader hint
+// candidate: reject with leader hint
+// leader: append configuration log excluding the server, transfer leadership first if removing itself
+func (r *Raft) removeServer(req *pb.RemoveServerRequest) (*pb.RemoveServerResponse, error) {
+	if r.state != Leader {
+		r.logger.Info("reject remove server since not leader", zap.Uint32("leader", r.leaderId))
+		return &pb.RemoveServerResponse{Success: false, LeaderId: r.leaderId, LeaderAddress: r.serverAddress(r.leaderId)}, nil
+	}
+
+	serverId := req.GetServerId()
+	if _, ok := r.configuration[serverId]; !ok {
+		r.logger.Info("server is not a member", zap.Uint32("server", serverId))
+		return &pb.RemoveServerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+	}
+
+	if err := r.checkConfigurationCommitted(); err != nil {
+		r.logger.Info("reject remove server", zap.Error(err), zap.Uint32("server", serverId))
+		return nil, err
+	}
+
+	configuration := make(map[uint32]string, len(r.configuration))
+	for id := range r.configuration {
+		if id != serverId {
+			configuration[id] = r.serverAddress(id)
+		}
+	}
+
+	learners := copyServers(r.learners)
+	delete(learners, serverId)
+	observers := copyServers(r.observers)
+	delete(observers, serverId)
+
+	if err := r.checkQuorum(configuration, learners); err != nil {
+		r.logger.Info("reject remove server", zap.Error(err), zap.Uint32("server", serverId))
+		return nil, err
+	}
+
+	// the leader hands over its leadership, the new leader is responsible to remove it
+	if serverId == r.id {
+		targetId, err := r.transferLeadership(configuration, learners)
+		if err != nil {
+			r.logger.Info("reject remove server", zap.Error(err), zap.Uint32("server", serverId))
+			return nil, err
+		}
+
+		return &pb.RemoveServerResponse{Success: false, LeaderId: targetId, LeaderAddress: r.serverAddress(targetId)}, nil
+	}
+
+	if err := r.appendConfiguration(configuration, learners, observers); err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("remove server", zap.Uint32("server", serverId))
+
+	return &pb.RemoveServerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+}
+
+// follower: reject with leader hint
+// candidate: reject with leader hint
+// leader: append configuration log making the learner a voter once it has caught up
+func (r *Raft) promoteLearner(req *pb.PromoteLearnerRequest) (*pb.PromoteLearnerResponse, error) {
+	if r.state != Leader {
+		r.logger.Info("reject promote learner since not leader", zap.Uint32("leader", r.leaderId))
+		return &pb.PromoteLearnerResponse{Success: false, LeaderId: r.leaderId, LeaderAddress: r.serverAddress(r.leaderId)}, nil
+	}
+
+	serverId := req.GetServerId()
+	if _, ok := r.configuration[serverId]; !ok {
+		return nil, fmt.Errorf("%w: server %d is not a member", errNotVoter, serverId)
+	}
+
+	if r.observers[serverId] {
+		return nil, fmt.Errorf("%w: server %d", errObserver, serverId)
+	}
+
+	if !r.learners[serverId] {
+		r.logger.Info("server is already a voter", zap.Uint32("server", serverId))
+		return &pb.PromoteLearnerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+	}
+
+	if err := r.checkConfigurationCommitted(); err != nil {
+		return nil, err
+	}
+
+	// the learner may have caught up through a snapshot, matchIndex is then set to the last included log
+	if lastLogId, _ := r.getLastLog(); r.matchIndex[serverId] < lastLogId {
+		return nil, fmt.Errorf("%w: match index %d, last log id %d", errLearnerNotCaughtUp, r.matchIndex[serverId], lastLogId)
+	}
+
+	if err := r.appendPromotion(serverId); err != nil {
+		return nil, err
+	}
+
+	return &pb.PromoteLearnerResponse{Success: true, LeaderId: r.id, LeaderAddress: r.config.Address}, nil
+}
+
+// appendPromotion appends a configuration log making the learner a voter
+func (r *Raft) appendPromotion(serverId uint32) error {
+	configuration := make(map[uint32]string, len(r.configuration))
+	for id := range r.configuration {
+		configuration[id] = r.serverAddress(id)
+	}
+
+	learners := copyServers(r.learners)
+	delete(learners, serverId)
+
+	if err := r.appendConfiguration(configuration, learners, r.observers); err != nil {
+		return err
+	}
+
+	r.logger.Info("promote learner", zap.Uint32("server", serverId))
+
+	return nil
+}
+
+// promoteCaughtUpLearners promotes a learner once its matchIndex stays within `PromotionThreshold` logs of the last
+// log for an election timeout, at most one learner is promoted at a time since servers are changed one at a time
+func (r *Raft) promoteCaughtUpLearners(ctx context.Context) {
+	if r.config.PromotionThreshold <= 0 || r.checkConfigurationCommitted() != nil {
+		return
+	}
+
+	lastLogId, _ := r.getLastLog()
+	for id := range r.caughtUpSince {
+		if !r.learners[id] {
+			delete(r.caughtUpSince, id)
+		}
+	}
+
+	for id := range r.learners {
+		if r.observers[id] || r.matchIndex[id]+uint64(r.config.PromotionThreshold) < lastLogId {
+			delete(r.caughtUpSince, id)
+			continue
+		}
+
+		since, ok := r.caughtUpSince[id]
+		if !ok {
+			r.caughtUpSince[id] = time.Now()
+			continue
+		}
+		if time.Since(since) < r.config.ElectionTimeout {
+			continue
+		}
+
+		if err := r.appendPromotion(id); err != nil {
+			r.logger.Error("fail to promote caught up learner", zap.Error(err), zap.Uint32("server", id))
+			return
+		}
+		delete(r.caughtUpSince, id)
+		r.persistState(ctx)
+
+		return
+	}
+}
+
+// checkConfigurationCommitted rejects a membership change until the latest configuration log is committed,
+// changing a single server at a time is only safe if at most one configuration is uncommitted
+func (r *Raft) checkConfigurationCommitted() error {
+	if r.configurationId > r.commitIndex {
+		return fmt.Errorf("%w: configuration log %d is not committed, commit index %d", ErrConfigChangeInProgress,
+			r.configurationId, r.commitIndex)
+	}
+
+	return nil
+}
+
+// checkQuorum checks that the active voters form a quorum of the given configuration,
+// otherwise the configuration log can never be committed
+func (r *Raft) checkQuorum(configuration map[uint32]string, learners map[uint32]bool) error {
+	voters, active := 0, 0
+	for id := range configuration {
+		if learners[id] {
+			continue
+		}
+
+		voters++
+		if id == r.id || r.isActive(id) {
+			active++
+		}
+	}
+
+	if voters == 0 {
+		return fmt.Errorf("%w: cannot remove the last voter", errUnsafeRemoval)
+	}
+
+	if active <= voters/2 {
+		return fmt.Errorf("%w: only %d of %d voters are active", errUnsafeRemoval, active, voters)
+	}
+
+	return nil
+}
+
+// isActive reports whether the peer has responded to the leader within the heartbeat timeout
+func (r *Raft) isActive(peerId uint32) bool {
+	lastContact, ok := r.lastContact[peerId]
+
+	return ok && time.Since(lastContact) <= r.config.HeartbeatTimeout
+}
+
+// transferLeadership sends TimeoutNow to the active voter in the configuration with the highest matchIndex,
+// so it starts an election immediately and wins it with the most up-to-date log, the target must be caught up
+func (r *Raft) transferLeadership(configuration map[uint32]string, learners map[uint32]bool) (uint32, error) {
+	lastLogId, _ := r.getLastLog()
+
+	// ties are broken by the smaller ID, so the same target is chosen for the same state
+	var targetId uint32
+	for id := range configuration {
+		if id == r.id || learners[id] || r.isWitness(id) || r.paused[id] || !r.isActive(id) {
+			continue
+		}
+
+		if targetId == 0 || r.matchIndex[id] > r.matchIndex[targetId] ||
+			(r.matchIndex[id] == r.matchIndex[targetId] && id < targetId) {
+			targetId = id
+		}
+	}
+
+	if targetId == 0 {
+		return 0, errNoTransferTarget
+	}
+
+	if r.matchIndex[targetId] < lastLogId {
+		return 0, fmt.Errorf("%w: the most up-to-date server %d has match index %d, last log id %d", errNoTransferTarget,
+			targetId, r.matchIndex[targetId], lastLogId)
+	}
+
+	peer := r.peers[targetId]
+	req := &pb.TimeoutNowRequest{Term: r.currentTerm, LeaderId: r.id, GroupId: r.config.GroupId, ClusterId: r.config.ClusterId}
+
+	// send rpc by the worker of the peer, so it is ordered after RPCs queued for the peer
+	submitted := r.submitRPC(r.workers, targetId, "TimeoutNow", func() {
+		rpcCtx, cancel := r.rpcContext(context.Background())
+		defer cancel()
+
+		err := r.withRetry(rpcCtx, func() error {
+			_, err := peer.TimeoutNow(rpcCtx, req)
+			return err
+		})
+		if err != nil {
+			r.logger.Error("fail to send TimeoutNow RPC", zap.Error(err), zap.Uint32("peer", targetId))
+		}
+	})
+	if !submitted {
+		return 0, fmt.Errorf("%w: fail to send TimeoutNow RPC to server %d", errNoTransferTarget, targetId)
+	}
+
+	r.transferTarget = targetId
+	r.transferStart = time.Now()
+	r.logger.Info("transfer leadership", zap.Uint32("target", targetId))
+
+	return targetId, nil
+}
+
+type transferLeadershipRequest struct{}
+
+type transferLeadershipResponse struct {
+	targetId uint32
+}
+
+// follower: reject
+// candidate: reject
+// leader: transfer leadership to the most up-to-date voter
+func (r *Raft) handleTransferLeadership(req *transferLeadershipRequest) (*transferLeadershipResponse, error) {
+	if r.state != Leader {
+		return nil, errNotLeader
+	}
+
+	targetId, err := r.transferLeadership(r.configuration, r.learners)
+	if err != nil {
+		r.logger.Info("reject leadership transfer", zap.Error(err))
+		return nil, err
+	}
+
+	return &transferLeadershipResponse{targetId: targetId}, nil
+}
+
+// TransferLeadership hands over the leadership to the active voter with the most up-to-date log and returns its ID,
+// e.g. to offload the leader before maintenance, it fails if no voter has caught up with the leader, the transfer
+// is done once the target wins its election
+func (r *Raft) TransferLeadership(ctx context.Context) (uint32, error) {
+	rpcResp, err := r.dispatchRPCRequest(ctx, &transferLeadershipRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, ok := rpcResp.(*transferLeadershipResponse)
+	if !ok {
+		return 0, errResponseTypeMismatch
+	}
+
+	return resp.targetId, nil
+}
+
+type abortLeadershipTransferRequest struct{}
+
+type abortLeadershipTransferResponse struct{}
+
+// follower: reject
+// candidate: reject
+// leader: stop the leadership transfer in progress, so commands are accepted again
+func (r *Raft) abortLeadershipTransfer(req *abortLeadershipTransferRequest) (*abortLeadershipTransferResponse, error) {
+	if r.state != Leader {
+		return nil, errNotLeader
+	}
+
+	if r.transferTarget != 0 {
+		r.logger.Info("abort leadership transfer", zap.Uint32("target", r.transferTarget))
+	}
+	r.transferTarget = 0
+	r.transferStart = time.Time{}
+
+	return &abortLeadershipTransferResponse{}, nil
+}
+
+// AbortLeadershipTransfer stops the leadership transfer in progress, e.g. the target stalls, so the leader accepts
+// commands again without waiting for the transfer to be abandoned, it does nothing if no transfer is in progress.
+// A target that has already started its election is not stopped, the leader steps down once it sees the new term.
+func (r *Raft) AbortLeadershipTransfer(ctx context.Context) error {
+	rpcResp, err := r.dispatchRPCRequest(ctx, &abortLeadershipTransferRequest{})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rpcResp.(*abortLeadershipTransferResponse); !ok {
+		return errResponseTypeMismatch
+	}
+
+	return nil
+}
+
+// transferring returns the target of the leadership transfer in progress, or 0 if there is none, the transfer is
+// abandoned if the leader is not replaced within the election timeout, e.g. the target fails
+func (r *Raft) transferring() uint32 {
+	if r.transferTarget != 0 && time.Since(r.transferStart) > r.config.ElectionTimeout {
+		r.logger.Info("abandon leadership transfer", zap.Uint32("target", r.transferTarget))
+		r.transferTarget = 0
+	}
+
+	return r.transferTarget
+}
+
+// appendConfiguration appends a configuration log as leader, the configuration takes effect once it is appended
+func (r *Raft) appendConfiguration(configuration map[uint32]string, learners, observers map[uint32]bool) error {
+	data, err := encodeConfiguration(configuration, learners, observers)
+	if err != nil {
+		return err
+	}
+
+	lastLogId, _ := r.getLastLog()
+	entry := &pb.Entry{Id: lastLogId + 1, Term: r.currentTerm, Data: data, Type: pb.EntryType_CONFIGURATION}
+	if err := r.appendLogs([]*pb.Entry{entry}); err != nil {
+		return err
+	}
+	r.trackAppended(entry)
+
+	r.setConfiguration(entry.GetId(), configuration, learners, observers)
+
+	if len(r.peers) == 0 {
+		r.advanceCommitIndex()
+	}
+
+	return nil
+}
+
+// reloadConfiguration sets the configuration by the latest configuration log
+func (r *Raft) reloadConfiguration() error {
+	lastLogId, _ := r.getLastLog()
+
+	configurationId, configuration, learners, observers, err := r.configurationAt(lastLogId)
+	if err != nil {
+		return err
+	}
+
+	r.setConfiguration(configurationId, configuration, learners, observers)
+
+	return nil
+}
+
+// configurationAt returns the latest configuration log up to the given log id, falls back to the configuration
+// in the snapshot, or the initial configuration if there is no configuration log
+func (r *Raft) configurationAt(id uint64) (uint64, map[uint32]string, map[uint32]bool, map[uint32]bool, error) {
+	for i := len(r.logs) - 1; i >= 0; i-- {
+		log := r.logs[i]
+		if log.GetId() > id || log.GetType() != pb.EntryType_CONFIGURATION {
+			continue
+		}
+
+		configuration, learners, observers, err := decodeConfiguration(log.GetData())
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+
+		return log.GetId(), configuration, learners, observers, nil
+	}
+
+	if meta := r.snapshotMeta; meta.LastIncludedId != 0 {
+		return meta.ConfigurationId, meta.Configuration, meta.Learners, meta.Observers, nil
+	}
+
+	return 0, r.initialConfiguration, nil, nil, nil
+}
+
+// setConfiguration sets the configuration, connects to added servers and forgets removed servers
+func (r *Raft) setConfiguration(id uint64, configuration map[uint32]string, learners, observers map[uint32]bool) {
+	for serverId, addr := range configuration {
+		if _, ok := r.peers[serverId]; ok || serverId == r.id {
+			continue
+		}
+
+		peer, err := r.dialPeer(addr)
+		if err != nil {
+			r.logger.Error("fail to connect to server", zap.Error(err), zap.Uint32("server", serverId))
+			continue
+		}
+
+		r.addPeer(serverId, peer)
+	}
+
+	for peerId := range r.peers {
+		if _, ok := configuration[peerId]; !ok {
+			r.removePeer(peerId)
+		}
+	}
+
+	r.mu.Lock()
+	r.configurationId = id
+	r.configuration = configuration
+	r.learners = learners
+	r.observers = observers
+	r.mu.Unlock()
+
+	r.logger.Info("configuration changed", zap.Uint64("logId", id), zap.Int("servers", len(configuration)),
+		zap.Int("learners", len(learners)), zap.Int("observers", len(observers)))
+}
+
+// isVoter reports whether the server is a member of the configuration and not a learner or an observer
+func (r *Raft) isVoter(serverId uint32) bool {
+	_, ok := r.configuration[serverId]
+
+	return ok && !r.learners[serverId]
+}
+
+// committedVoters returns voters of the latest committed configuration, falls back to voters of the latest
+// configuration if the committed configuration cannot be loaded
+func (r *Raft) committedVoters() map[uint32]bool {
+	_, configuration, learners, _, err := r.configurationAt(r.commitIndex)
+	if err != nil {
+		r.logger.Error("fail to load committed configuration", zap.Error(err))
+		configuration, learners = r.configuration, r.learners
+	}
+
+	voters := make(map[uint32]bool, len(configuration))
+	for id := range configuration {
+		if !learners[id] {
+			voters[id] = true
+		}
+	}
+
+	return voters
+}
+
+// canStartElection reports whether the server is a voter of both the latest and the committed configuration,
+// so a promoted learner only starts elections once its promotion is committed, a witness never starts elections
+func (r *Raft) canStartElection() bool {
+	return r.isVoter(r.id) && !r.isWitness(r.id) && r.committedVoters()[r.id]
+}
+
+// numVoters returns the number of voters in the configuration, including the server itself
+func (r *Raft) numVoters() int {
+	voters := 0
+	for id := range r.configuration {
+		if !r.learners[id] {
+			voters++
+		}
+	}
+
+	return voters
+}
+
+// addPeer adds a peer, the whole log is replicated to the new peer from the beginning
+func (r *Raft) addPeer(peerId uint32, peer Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.peers[peerId] = peer
+	r.nextIndex[peerId] = 1
+	r.matchIndex[peerId] = 0
+}
+
+func (r *Raft) removePeer(peerId uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.peers, peerId)
+	r.workers.remove(peerId)
+	r.snapshotWorkers.remove(peerId)
+	delete(r.nextIndex, peerId)
+	delete(r.matchIndex, peerId)
+	delete(r.lastContact, peerId)
+	delete(r.paused, peerId)
+}
+
+// serverAddress returns the address of the given server and returns empty string if not known
+func (r *Raft) serverAddress(serverId uint32) string {
+	if serverId == r.id {
+		return r.config.Address
+	}
+
+	if addr := r.configuration[serverId]; addr != "" {
+		return addr
+	}
+
+	if peer, ok := r.peers[serverId].(interface{ Address() string }); ok {
+		return peer.Address()
+	}
+
+	return ""
+}
+
+func (r *Raft) dialPeer(addr string) (Peer, error) {
+	if r.config.DialPeer != nil {
+		return r.config.DialPeer(addr)
+	}
+
+	return NewGRPCPeer(addr, grpc.WithInsecure())
+}
+
+// closePeer closes the connection of the peer created by dialPeer, peers created by `DialPeer` are closed if they
+// implement io.Closer
+func (r *Raft) closePeer(p Peer) {
+	var err error
+	switch c := p.(type) {
+	case io.Closer:
+		err = c.Close()
+	case interface{ close() error }:
+		err = c.close()
+	}
+
+	if err != nil {
+		r.logger.Warn("fail to close peer", zap.Error(err))
+	}
+}
+
+func encodeConfiguration(configuration map[uint32]string, learners, observers map[uint32]bool) ([]byte, error) {
+	return proto.Marshal(toConfigurationProto(configuration, learners, observers))
+}
+
+func decodeConfiguration(data []byte) (map[uint32]string, map[uint32]bool, map[uint32]bool, error) {
+	var c pb.Configuration
+	if err := proto.Unmarshal(data, &c); err != nil {
+		return nil, nil, nil, fmt.Errorf("fail to decode configuration: %w", err)
+	}
+
+	configuration, learners, observers := fromConfigurationProto(&c)
+
+	return configuration, learners, observers, nil
+}
+
+func toConfigurationProto(configuration map[uint32]string, learners, observers map[uint32]bool) *pb.Configuration {
+	servers := make([]*pb.Server, 0, len(configuration))
+	for id, addr := range configuration {
+		servers = append(servers, &pb.Server{Id: id, Address: addr, Learner: learners[id], Observer: observers[id]})
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].GetId() < servers[j].GetId()
+	})
+
+	return &pb.Configuration{Servers: servers}
+}
+
+// fromConfigurationProto decodes the configuration, observers are always included in learners so they never vote
+func fromConfigurationProto(c *pb.Configuration) (map[uint32]string, map[uint32]bool, map[uint32]bool) {
+	configuration := make(map[uint32]string, len(c.GetServers()))
+	learners := make(map[uint32]bool)
+	observers := make(map[uint32]bool)
+	for _, server := range c.GetServers() {
+		configuration[server.GetId()] = server.GetAddress()
+		if server.GetLearner() || server.GetObserver() {
+			learners[server.GetId()] = true
+		}
+		if server.GetObserver() {
+			observers[server.GetId()] = true
+		}
+	}
+
+	return configuration, learners, observers
+}
+
+func copyServers(servers map[uint32]bool) map[uint32]bool {
+	copied := make(map[uint32]bool, len(servers))
+	for id := range servers {
+		copied[id] = true
+	}
+
+	return copied
+}
+
+func containsConfiguration(logs []*pb.Entry) bool {
+	for _, log := range logs {
+		if log.GetType() == pb.EntryType_CONFIGURATION {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,80 @@
+package raft
+
+import "time"
+
+// metric names emitted by raft
+const (
+	// MetricElectionSplitVote counts elections timed out after a majority of voters responded without granting
+	// a majority of votes, the votes are split among candidates
+	MetricElectionSplitVote = "raft.election.split_vote"
+	// MetricElectionTimeout counts elections timed out before a majority of voters responded
+	MetricElectionTimeout = "raft.election.timeout"
+	// MetricElectionRounds observes the number of election rounds the server takes to become the leader
+	MetricElectionRounds = "raft.election.rounds"
+
+	// MetricFollowerTime counts the nanoseconds spent as follower, counted when the server leaves the role
+	MetricFollowerTime = "raft.role.follower.time"
+	// MetricCandidateTime counts the nanoseconds spent as candidate, counted when the server leaves the role
+	MetricCandidateTime = "raft.role.candidate.time"
+	// MetricLeaderTime counts the nanoseconds spent as leader, counted when the server leaves the role
+	MetricLeaderTime = "raft.role.leader.time"
+
+	// MetricCommitLatency observes the nanoseconds from when the leader appends a log to when the log is committed,
+	// logs committed after the leader steps down are not observed
+	MetricCommitLatency = "raft.commit.latency"
+
+	// MetricPersistRaftStateLatency observes the nanoseconds each save of the raft state to the persister takes
+	MetricPersistRaftStateLatency = "raft.persist.raft_state.latency"
+	// MetricPersistSnapshotLatency observes the nanoseconds each save of a snapshot to the persister takes,
+	// or to close the sink of a `SnapshotStore`, excluding the time the application writes the snapshot data
+	MetricPersistSnapshotLatency = "raft.persist.snapshot.latency"
+
+	// MetricRPCDropped counts outgoing RPCs dropped since too many RPCs are queued for the peer
+	MetricRPCDropped = "raft.rpc.dropped"
+)
+
+// Metrics receives events and measurements of raft, implementations must be safe for concurrent use
+type Metrics interface {
+	// IncrCounter increments the counter with the given name by delta
+	IncrCounter(name string, delta int64)
+	// Observe records a measurement of the given name
+	Observe(name string, value float64)
+}
+
+type noopMetrics struct{}
+
+var _ Metrics = noopMetrics{}
+
+func (noopMetrics) IncrCounter(name string, delta int64) {}
+
+func (noopMetrics) Observe(name string, value float64) {}
+
+// roleTimeMetrics maps roles to the metrics counting the time spent in them
+var roleTimeMetrics = map[RaftState]string{
+	Follower:  MetricFollowerTime,
+	Candidate: MetricCandidateTime,
+	Leader:    MetricLeaderTime,
+}
+
+// roleTimer counts the time spent in each role to the metrics
+type roleTimer struct {
+	clock   Clock
+	metrics Metrics
+	since   time.Time
+}
+
+func newRoleTimer(clock Clock, metrics Metrics) *roleTimer {
+	return &roleTimer{clock: clock, metrics: metrics, since: clock.Now()}
+}
+
+// transition counts the time since the last transition to the role the server leaves,
+// a transition to the same role counts the time as well
+func (t *roleTimer) transition(from RaftState) {
+	if t == nil {
+		return
+	}
+
+	now := t.clock.Now()
+	t.metrics.IncrCounter(roleTimeMetrics[from], now.Sub(t.since).Nanoseconds())
+	t.since = now
+}
@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type pausePeerRequest struct {
+	id     uint32
+	paused bool
+}
+
+type pausePeerResponse struct{}
+
+// pausePeer pauses or resumes sending RPCs to the peer, the peer stays in the configuration,
+// and its last known matchIndex still counts towards commits since the peer did replicate those logs,
+// but it receives no RequestVote RPCs and so never grants a vote while paused
+func (r *Raft) pausePeer(req *pausePeerRequest) (*pausePeerResponse, error) {
+	if _, ok := r.peers[req.id]; !ok {
+		return nil, errUnknownPeer
+	}
+
+	if req.paused {
+		r.paused[req.id] = true
+		r.logger.Info("pause peer", zap.Uint32("peer", req.id))
+	} else {
+		delete(r.paused, req.id)
+		r.logger.Info("resume peer", zap.Uint32("peer", req.id))
+	}
+
+	return &pausePeerResponse{}, nil
+}
+
+// PausePeer stops sending RPCs to the peer without removing it from the configuration, e.g. during maintenance,
+// the paused peer starts elections once it misses heartbeats, pausing the majority of voters stalls commits
+func (r *Raft) PausePeer(ctx context.Context, id uint32) error {
+	return r.setPeerPaused(ctx, id, true)
+}
+
+// ResumePeer resumes sending RPCs to the peer paused by `PausePeer`, the peer catches up on the next heartbeat
+func (r *Raft) ResumePeer(ctx context.Context, id uint32) error {
+	return r.setPeerPaused(ctx, id, false)
+}
+
+func (r *Raft) setPeerPaused(ctx context.Context, id uint32, paused bool) error {
+	rpcResp, err := r.dispatchRPCRequest(ctx, &pausePeerRequest{id: id, paused: paused})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rpcResp.(*pausePeerResponse); !ok {
+		return errResponseTypeMismatch
+	}
+
+	return nil
+}
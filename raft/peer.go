@@ -19,12 +19,24 @@ type Peer interface {
 type peer struct {
 	pb.RaftClient
 
+	addr string
 	conn *grpc.ClientConn
 	mu   sync.Mutex
 }
 
 var _ Peer = (*peer)(nil)
 
+// NewGRPCPeer creates a Peer connecting to the node at the given address through gRPC,
+// credentials are carried by options such as `grpc.WithTransportCredentials` or `grpc.WithPerRPCCredentials`
+func NewGRPCPeer(addr string, opts ...grpc.DialOption) (Peer, error) {
+	p := &peer{}
+	if err := p.dial(addr, opts...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
 func (p *peer) ApplyCommand(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (*pb.ApplyCommandResponse, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -32,6 +44,13 @@ func (p *peer) ApplyCommand(ctx context.Context, in *pb.ApplyCommandRequest, opt
 	return p.RaftClient.ApplyCommand(ctx, in, opts...)
 }
 
+func (p *peer) ApplyCommandStream(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (pb.Raft_ApplyCommandStreamClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.ApplyCommandStream(ctx, in, opts...)
+}
+
 func (p *peer) AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest, opts ...grpc.CallOption) (*pb.AppendEntriesResponse, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -46,6 +65,49 @@ func (p *peer) RequestVote(ctx context.Context, in *pb.RequestVoteRequest, opts
 	return p.RaftClient.RequestVote(ctx, in, opts...)
 }
 
+func (p *peer) TimeoutNow(ctx context.Context, in *pb.TimeoutNowRequest, opts ...grpc.CallOption) (*pb.TimeoutNowResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.TimeoutNow(ctx, in, opts...)
+}
+
+func (p *peer) InstallSnapshot(ctx context.Context, in *pb.InstallSnapshotRequest, opts ...grpc.CallOption) (*pb.InstallSnapshotResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.InstallSnapshot(ctx, in, opts...)
+}
+
+func (p *peer) AddServer(ctx context.Context, in *pb.AddServerRequest, opts ...grpc.CallOption) (*pb.AddServerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.AddServer(ctx, in, opts...)
+}
+
+func (p *peer) RemoveServer(ctx context.Context, in *pb.RemoveServerRequest, opts ...grpc.CallOption) (*pb.RemoveServerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.RemoveServer(ctx, in, opts...)
+}
+
+func (p *peer) PromoteLearner(ctx context.Context, in *pb.PromoteLearnerRequest, opts ...grpc.CallOption) (*pb.PromoteLearnerResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.RaftClient.PromoteLearner(ctx, in, opts...)
+}
+
+// Address returns the address of the connected node
+func (p *peer) Address() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addr
+}
+
 func (p *peer) dial(addr string, opts ...grpc.DialOption) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -55,6 +117,7 @@ func (p *peer) dial(addr string, opts ...grpc.DialOption) error {
 		return err
 	}
 
+	p.addr = addr
 	p.conn = conn
 	p.RaftClient = pb.NewRaftClient(conn)
 
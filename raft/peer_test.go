@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockPeer is a Peer whose RPCs are handled by the func field of the same name, the same as rafttest.PeerMock,
+// which cannot be used by tests of this package, RPCs whose func field is nil fail with codes.Unimplemented.
+//
+// Note that RPCs are sent concurrently, the func fields must be safe for concurrent use.
+type mockPeer struct {
+	applyCommandFunc       func(ctx context.Context, in *pb.ApplyCommandRequest) (*pb.ApplyCommandResponse, error)
+	applyCommandStreamFunc func(ctx context.Context, in *pb.ApplyCommandRequest) (pb.Raft_ApplyCommandStreamClient, error)
+	appendEntriesFunc      func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error)
+	requestVoteFunc        func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error)
+	timeoutNowFunc         func(ctx context.Context, in *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error)
+	installSnapshotFunc    func(ctx context.Context, in *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error)
+	addServerFunc          func(ctx context.Context, in *pb.AddServerRequest) (*pb.AddServerResponse, error)
+	removeServerFunc       func(ctx context.Context, in *pb.RemoveServerRequest) (*pb.RemoveServerResponse, error)
+	promoteLearnerFunc     func(ctx context.Context, in *pb.PromoteLearnerRequest) (*pb.PromoteLearnerResponse, error)
+}
+
+var _ Peer = (*mockPeer)(nil)
+
+// unmocked returns the error of an RPC whose func field is not set
+func unmocked(method string) error {
+	return status.Errorf(codes.Unimplemented, "%s is not mocked", method)
+}
+
+func (p *mockPeer) ApplyCommand(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (*pb.ApplyCommandResponse, error) {
+	if p.applyCommandFunc == nil {
+		return nil, unmocked("ApplyCommand")
+	}
+
+	return p.applyCommandFunc(ctx, in)
+}
+
+func (p *mockPeer) ApplyCommandStream(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (pb.Raft_ApplyCommandStreamClient, error) {
+	if p.applyCommandStreamFunc == nil {
+		return nil, unmocked("ApplyCommandStream")
+	}
+
+	return p.applyCommandStreamFunc(ctx, in)
+}
+
+func (p *mockPeer) AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest, opts ...grpc.CallOption) (*pb.AppendEntriesResponse, error) {
+	if p.appendEntriesFunc == nil {
+		return nil, unmocked("AppendEntries")
+	}
+
+	return p.appendEntriesFunc(ctx, in)
+}
+
+func (p *mockPeer) RequestVote(ctx context.Context, in *pb.RequestVoteRequest, opts ...grpc.CallOption) (*pb.RequestVoteResponse, error) {
+	if p.requestVoteFunc == nil {
+		return nil, unmocked("RequestVote")
+	}
+
+	return p.requestVoteFunc(ctx, in)
+}
+
+func (p *mockPeer) TimeoutNow(ctx context.Context, in *pb.TimeoutNowRequest, opts ...grpc.CallOption) (*pb.TimeoutNowResponse, error) {
+	if p.timeoutNowFunc == nil {
+		return nil, unmocked("TimeoutNow")
+	}
+
+	return p.timeoutNowFunc(ctx, in)
+}
+
+func (p *mockPeer) InstallSnapshot(ctx context.Context, in *pb.InstallSnapshotRequest, opts ...grpc.CallOption) (*pb.InstallSnapshotResponse, error) {
+	if p.installSnapshotFunc == nil {
+		return nil, unmocked("InstallSnapshot")
+	}
+
+	return p.installSnapshotFunc(ctx, in)
+}
+
+func (p *mockPeer) AddServer(ctx context.Context, in *pb.AddServerRequest, opts ...grpc.CallOption) (*pb.AddServerResponse, error) {
+	if p.addServerFunc == nil {
+		return nil, unmocked("AddServer")
+	}
+
+	return p.addServerFunc(ctx, in)
+}
+
+func (p *mockPeer) RemoveServer(ctx context.Context, in *pb.RemoveServerRequest, opts ...grpc.CallOption) (*pb.RemoveServerResponse, error) {
+	if p.removeServerFunc == nil {
+		return nil, unmocked("RemoveServer")
+	}
+
+	return p.removeServerFunc(ctx, in)
+}
+
+func (p *mockPeer) PromoteLearner(ctx context.Context, in *pb.PromoteLearnerRequest, opts ...grpc.CallOption) (*pb.PromoteLearnerResponse, error) {
+	if p.promoteLearnerFunc == nil {
+		return nil, unmocked("PromoteLearner")
+	}
+
+	return p.promoteLearnerFunc(ctx, in)
+}
+
+// ackAppendEntries acknowledges the AppendEntries RPC as if the peer has all logs in it
+func ackAppendEntries(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	return &pb.AppendEntriesResponse{Term: in.GetTerm(), Success: true, LastLogId: in.GetPrevLogId() + uint64(len(in.GetEntries()))}, nil
+}
+
+// grantVote grants the RequestVote RPC
+func grantVote(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	return &pb.RequestVoteResponse{Term: in.GetTerm(), VoteGranted: true}, nil
+}
+
+// voteBy returns a peer granting or rejecting votes by the given grant function
+func voteBy(grant func() bool) *mockPeer {
+	return &mockPeer{
+		requestVoteFunc: func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+			return &pb.RequestVoteResponse{Term: in.GetTerm(), VoteGranted: grant()}, nil
+		},
+	}
+}
+
+// rpcCounts counts RPCs received by a peer created by countRPCs
+type rpcCounts struct {
+	appendEntries int64
+	requestVote   int64
+}
+
+func (c *rpcCounts) total() int64 {
+	return atomic.LoadInt64(&c.appendEntries) + atomic.LoadInt64(&c.requestVote)
+}
+
+// countRPCs returns a peer granting votes and acknowledging AppendEntries RPCs after the latency, which counts
+// the RPCs it receives
+func countRPCs(counts *rpcCounts, latency time.Duration) *mockPeer {
+	return &mockPeer{
+		appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+			atomic.AddInt64(&counts.appendEntries, 1)
+			time.Sleep(latency)
+
+			return ackAppendEntries(ctx, in)
+		},
+		requestVoteFunc: func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+			atomic.AddInt64(&counts.requestVote, 1)
+
+			return grantVote(ctx, in)
+		},
+	}
+}
+
+// recordAppendEntries returns a peer recording AppendEntries requests to the channel and acknowledging them
+func recordAppendEntries(reqCh chan<- *pb.AppendEntriesRequest) *mockPeer {
+	return &mockPeer{
+		appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+			reqCh <- in
+
+			return ackAppendEntries(ctx, in)
+		},
+	}
+}
+
+// recordTimeoutNow returns peers recording TimeoutNow RPCs to the channel of the peer without starting an election
+func recordTimeoutNow(peerIds ...uint32) (map[uint32]Peer, map[uint32]chan *pb.TimeoutNowRequest) {
+	peers := make(map[uint32]Peer, len(peerIds))
+	reqChs := make(map[uint32]chan *pb.TimeoutNowRequest, len(peerIds))
+
+	for _, peerId := range peerIds {
+		reqCh := make(chan *pb.TimeoutNowRequest, 1)
+		reqChs[peerId] = reqCh
+		peers[peerId] = &mockPeer{
+			timeoutNowFunc: func(ctx context.Context, in *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+				reqCh <- in
+
+				return &pb.TimeoutNowResponse{Term: in.GetTerm()}, nil
+			},
+		}
+	}
+
+	return peers, reqChs
+}
+
+// stallRPCs returns a peer never responding to AppendEntries and RequestVote RPCs until they are cancelled,
+// the errors of cancelled RPCs are sent to the channel
+func stallRPCs(errCh chan<- error) *mockPeer {
+	return &mockPeer{
+		appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+			<-ctx.Done()
+			errCh <- ctx.Err()
+
+			return nil, ctx.Err()
+		},
+		requestVoteFunc: func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+			<-ctx.Done()
+			errCh <- ctx.Err()
+
+			return nil, ctx.Err()
+		},
+	}
+}
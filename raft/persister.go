@@ -1,20 +1,55 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"sync"
+
+	"go.uber.org/zap"
 )
 
+// persistQueueSize is the maximum number of raft states queued for the background writer
+const persistQueueSize = 64
+
 type Persister interface {
 	SaveRaftState(raftState []byte) error
 	LoadRaftState() ([]byte, error)
+
+	// SaveSnapshot saves the snapshot data with its metadata
+	SaveSnapshot(meta SnapshotMeta, snapshot []byte) error
+	// LoadSnapshot loads the latest snapshot and returns zero-values if not found
+	LoadSnapshot() (SnapshotMeta, []byte, error)
+}
+
+// SnapshotSink is written with the snapshot data, which is saved on `Close`, or discarded on `Cancel`
+type SnapshotSink interface {
+	io.WriteCloser
+
+	// Cancel discards the written snapshot data
+	Cancel() error
+}
+
+// SnapshotStore is implemented by persisters that save and load snapshots as streams, so large snapshots are not
+// buffered in memory, `SaveSnapshot` and `LoadSnapshot` are used for persisters that do not implement it
+type SnapshotStore interface {
+	// CreateSnapshot returns the sink to write the snapshot data with its metadata
+	CreateSnapshot(meta SnapshotMeta) (SnapshotSink, error)
+	// OpenSnapshot opens the latest snapshot and returns zero-values with an empty reader if not found
+	OpenSnapshot() (SnapshotMeta, io.ReadCloser, error)
 }
 
 type persister struct {
-	raftState []byte
-	mu        sync.Mutex
+	raftState    []byte
+	snapshotMeta SnapshotMeta
+	snapshot     []byte
+	mu           sync.Mutex
 }
 
-var _ Persister = (*persister)(nil)
+var (
+	_ Persister     = (*persister)(nil)
+	_ SnapshotStore = (*persister)(nil)
+)
 
 func newPersister() *persister {
 	return &persister{}
@@ -36,3 +71,154 @@ func (p *persister) LoadRaftState() ([]byte, error) {
 
 	return p.raftState, nil
 }
+
+func (p *persister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshotMeta = meta
+	p.snapshotMeta.Configuration = make(map[uint32]string, len(meta.Configuration))
+	for id, addr := range meta.Configuration {
+		p.snapshotMeta.Configuration[id] = addr
+	}
+	p.snapshotMeta.Learners = copyServers(meta.Learners)
+	p.snapshotMeta.Observers = copyServers(meta.Observers)
+
+	p.snapshot = make([]byte, len(snapshot))
+	copy(p.snapshot, snapshot)
+
+	return nil
+}
+
+func (p *persister) LoadSnapshot() (SnapshotMeta, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snapshotMeta, p.snapshot, nil
+}
+
+func (p *persister) CreateSnapshot(meta SnapshotMeta) (SnapshotSink, error) {
+	return &snapshotSink{persister: p, meta: meta}, nil
+}
+
+func (p *persister) OpenSnapshot() (SnapshotMeta, io.ReadCloser, error) {
+	meta, snapshot, err := p.LoadSnapshot()
+	if err != nil {
+		return SnapshotMeta{}, nil, err
+	}
+
+	return meta, io.NopCloser(bytes.NewReader(snapshot)), nil
+}
+
+// snapshotSink buffers the snapshot data written to the in-memory persister until it is closed
+type snapshotSink struct {
+	persister *persister
+	meta      SnapshotMeta
+	buf       bytes.Buffer
+	cancelled bool
+}
+
+func (s *snapshotSink) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *snapshotSink) Close() error {
+	if s.cancelled {
+		return nil
+	}
+
+	return s.persister.SaveSnapshot(s.meta, s.buf.Bytes())
+}
+
+func (s *snapshotSink) Cancel() error {
+	s.cancelled = true
+	s.buf.Reset()
+
+	return nil
+}
+
+type persistRequest struct {
+	raftState []byte
+	done      chan error
+}
+
+// persist saves the raft state and returns after the state is durable
+func (r *Raft) persist(ctx context.Context) error {
+	if r.persistCh == nil {
+		// the term, the vote and logs are saved together, and states are saved in the order they are encoded,
+		// so an RPC goroutine never overwrites a newer state with the older one it encoded
+		r.persistMu.Lock()
+		defer r.persistMu.Unlock()
+
+		raftState := r.encodeRaftState()
+		return r.observePersist(MetricPersistRaftStateLatency, func() error {
+			return r.persister.SaveRaftState(raftState)
+		})
+	}
+
+	done := make(chan error, 1)
+
+	r.persistMu.Lock()
+	select {
+	case r.persistCh <- &persistRequest{raftState: r.encodeRaftState(), done: done}:
+		r.persistMu.Unlock()
+	case <-ctx.Done():
+		r.persistMu.Unlock()
+		return ctx.Err()
+	}
+
+	// flush barrier, wait until the state is written
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// persistState persists the raft state changed by the main loop outside of RPC handlers, such as the term
+// advanced on an election or on an RPC response
+func (r *Raft) persistState(ctx context.Context) {
+	if err := r.persist(ctx); err != nil {
+		r.logger.Error("fail to save raft state", zap.Error(err))
+	}
+}
+
+// runPersister writes queued raft states in background, only the latest queued state is written
+// since it includes all changes of the earlier states
+func (r *Raft) runPersister(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case req := <-r.persistCh:
+			reqs := []*persistRequest{req}
+			for len(r.persistCh) != 0 {
+				reqs = append(reqs, <-r.persistCh)
+			}
+
+			raftState := reqs[len(reqs)-1].raftState
+			err := r.observePersist(MetricPersistRaftStateLatency, func() error {
+				return r.persister.SaveRaftState(raftState)
+			})
+			if err != nil {
+				r.logger.Error("fail to persist raft state", zap.Error(err))
+			}
+
+			for _, req := range reqs {
+				req.done <- err
+			}
+		}
+	}
+}
+
+// observePersist runs save and observes how long it takes to the metric of the given name, so slow disks on the
+// critical path of commits are detected
+func (r *Raft) observePersist(name string, save func() error) error {
+	start := r.clock.Now()
+	err := save()
+	r.metrics.Observe(name, float64(r.clock.Now().Sub(start).Nanoseconds()))
+
+	return err
+}
@@ -2,10 +2,14 @@ package raft
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/justin0u0/raft/pb"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
 type Raft struct {
@@ -17,21 +21,116 @@ type Raft struct {
 	id    uint32
 	peers map[uint32]Peer
 
-	config *Config
-	logger *zap.Logger
+	// initialConfiguration is the configuration before any configuration log is appended
+	initialConfiguration map[uint32]string
+
+	config  *Config
+	logger  *zap.Logger
+	metrics Metrics
 
 	// lastHeartbeat stores the last time of a valid RPC received from the leader
 	lastHeartbeat time.Time
+	// lastContact stores the last time of a response received from each peer
+	lastContact map[uint32]time.Time
+	// appliedIndex stores the lastApplied reported by each peer in AppendEntries responses, used by the leader
+	appliedIndex map[uint32]uint64
+	// rtt estimates the round-trip time of RPCs sent to peers
+	rtt rttEstimator
+	// snapshotting stores peers that a snapshot is being sent to, used by the leader
+	snapshotting map[uint32]bool
+	// replicating stores peers that an AppendEntries RPC is in flight to, used by the leader to coalesce new logs
+	// into the next RPC instead of sending one for each command
+	replicating map[uint32]bool
+	// paused stores peers that no RPC is sent to until they are resumed
+	paused map[uint32]bool
+	// restartElection makes the candidate start a new election without waiting for the election timeout
+	restartElection bool
+	// electionRounds is the number of elections started since the server last followed a leader
+	electionRounds int
+	// electionVoters are voters of the committed configuration when the election starts, the candidate needs votes
+	// from a majority of them besides a majority of the latest configuration, so servers added or promoted by an
+	// uncommitted configuration alone never decide the election
+	electionVoters map[uint32]bool
+	// grantedVoters are servers granting votes to the candidate in the election
+	grantedVoters map[uint32]bool
+	// votesGranted and votesRequired are the votes granted to the candidate in the election and the votes required
+	// to win it, guarded by the lock so they are read by VoteTally
+	votesGranted  int
+	votesRequired int
+
+	// workers send outgoing RPCs to peers
+	workers *peerWorkers
+	// snapshotWorkers send InstallSnapshot RPCs to peers, so a large snapshot does not hold up heartbeats
+	snapshotWorkers *peerWorkers
+
+	// invariants stores the state observed by invariant checks if `DebugInvariants` is enabled
+	invariants invariants
 
 	// rpcCh stores incoming RPCs
 	rpcCh chan *rpc
 	// applyCh stores logs that can be applied
 	applyCh chan *pb.Entry
+	// stopCh is closed once Run is shutting down, logs being sent to the ApplyCh are abandoned on it unless
+	// `DrainApplyOnShutdown`
+	stopCh <-chan struct{}
+	// snapshotRequestCh stores the log ID the application is requested to take a snapshot up to
+	snapshotRequestCh chan uint64
+	// snapshotRequested is the last log ID the application is requested to take a snapshot up to
+	snapshotRequested uint64
+	// snapshotInProgress reports whether SnapshotNow is taking a snapshot, so at most one is taken at a time
+	snapshotInProgress bool
+	// clock measures the time reported to metrics
+	clock Clock
+	// appendedAt maps IDs of logs appended by the leader and not committed yet to when they are appended
+	appendedAt map[uint64]time.Time
+
+	// caughtUpSince maps learners to when their logs caught up within `PromotionThreshold` logs of the leader
+	caughtUpSince map[uint32]time.Time
+
+	// transferTarget is the server the leader hands over its leadership to, 0 if no transfer is in progress
+	transferTarget uint32
+	// transferStart is when the leadership transfer started, the transfer is abandoned after the election timeout
+	transferStart time.Time
+	// restoringSnapshot gates applying logs on startup until the persisted snapshot is handed to the state machine
+	// through the ApplyCh or `ApplyFunc`, if it is not restored by `RestoreSnapshot`
+	restoringSnapshot bool
+	// installing is the snapshot from the leader whose install is not complete, AppendEntries RPCs of the same leader
+	// are rejected until the snapshot is installed, so logs are never appended on top of a partially installed snapshot
+	installing *pb.InstallSnapshotRequest
+
+	// running reports whether Run is in progress, the node can be reset only when it is not running
+	running bool
+
+	// persistCh stores raft states to be persisted by the background writer if `AsyncPersist` is enabled
+	persistCh chan *persistRequest
+	// persistMu keeps raft states queued, or saved if `AsyncPersist` is disabled, in the order they are encoded
+	persistMu sync.Mutex
 }
 
 var _ pb.RaftServer = (*Raft)(nil)
 
+// defaultApplyChannelBuffer is the buffer size of the ApplyCh if `ApplyChannelBuffer` is not configured
+const defaultApplyChannelBuffer = 256
+
+// defaultRPCTimeout bounds each outgoing RPC if `RPCTimeout` is not configured, so a peer that never responds
+// does not hold up later RPCs queued for it
+const defaultRPCTimeout = 1 * time.Second
+
+// snapshotRPCTimeoutFactor multiplies the RPC timeout for InstallSnapshot RPCs, which carry the whole snapshot
+const snapshotRPCTimeoutFactor = 10
+
+// NewRaft creates the server of the given ID with its peers keyed by their IDs, IDs need not be contiguous,
+// but ID 0 is reserved for no vote and no leader, so it panics if any ID is 0 or a peer has the ID of the server
 func NewRaft(id uint32, peers map[uint32]Peer, persister Persister, config *Config, logger *zap.Logger) *Raft {
+	if err := validatePeers(id, peers); err != nil {
+		panic(err)
+	}
+
+	configuration := map[uint32]string{id: config.Address}
+	for peerId := range peers {
+		configuration[peerId] = ""
+	}
+
 	raftState := &raftState{
 		state:       Follower,
 		currentTerm: 0,
@@ -41,19 +140,78 @@ func NewRaft(id uint32, peers map[uint32]Peer, persister Persister, config *Conf
 		lastApplied: 0,
 		nextIndex:   make(map[uint32]uint64),
 		matchIndex:  make(map[uint32]uint64),
+
+		configuration: configuration,
+
+		strictLogChecks: config.StrictLogChecks,
+		panicOnLogGaps:  config.StrictLogChecks && config.DebugInvariants,
+		ackApply:        config.ApplyFunc == nil,
+	}
+
+	var metrics Metrics = noopMetrics{}
+	if config.Metrics != nil {
+		metrics = config.Metrics
+	}
+
+	var clock Clock = systemClock{}
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+	raftState.roleTimer = newRoleTimer(clock, metrics)
+
+	applyChannelBuffer := defaultApplyChannelBuffer
+	if config.ApplyChannelBuffer > 0 {
+		applyChannelBuffer = config.ApplyChannelBuffer
+	}
+
+	var persistCh chan *persistRequest
+	if config.AsyncPersist {
+		persistCh = make(chan *persistRequest, persistQueueSize)
 	}
 
 	return &Raft{
-		raftState:     raftState,
-		persister:     persister,
-		id:            id,
-		peers:         peers,
-		config:        config,
-		logger:        logger.With(zap.Uint32("id", id)),
-		lastHeartbeat: time.Now(),
-		rpcCh:         make(chan *rpc),
-		applyCh:       make(chan *pb.Entry),
+		raftState:            raftState,
+		persister:            persister,
+		id:                   id,
+		peers:                peers,
+		initialConfiguration: configuration,
+		config:               config,
+		logger:               sampleLogger(logger, config.LogSampling).With(zap.Uint32("id", id)),
+		metrics:              metrics,
+		clock:                clock,
+		appendedAt:           make(map[uint64]time.Time),
+		caughtUpSince:        make(map[uint32]time.Time),
+		lastHeartbeat:        time.Now(),
+		lastContact:          make(map[uint32]time.Time),
+		appliedIndex:         make(map[uint32]uint64),
+		snapshotting:         make(map[uint32]bool),
+		replicating:          make(map[uint32]bool),
+		paused:               make(map[uint32]bool),
+		workers:              newPeerWorkers(),
+		snapshotWorkers:      newPeerWorkers(),
+		rpcCh:                make(chan *rpc),
+		applyCh:              make(chan *pb.Entry, applyChannelBuffer),
+		snapshotRequestCh:    make(chan uint64, 1),
+		persistCh:            persistCh,
+	}
+}
+
+// validatePeers checks that the ID of the server and its peers are neither reserved nor duplicated
+func validatePeers(id uint32, peers map[uint32]Peer) error {
+	if id == 0 {
+		return fmt.Errorf("%w: server ID 0 is reserved", errInvalidPeerId)
+	}
+
+	for peerId := range peers {
+		if peerId == 0 {
+			return fmt.Errorf("%w: peer ID 0 is reserved", errInvalidPeerId)
+		}
+		if peerId == id {
+			return fmt.Errorf("%w: peer ID %d is the ID of the server", errInvalidPeerId, peerId)
+		}
 	}
+
+	return nil
 }
 
 // RPC handlers
@@ -62,20 +220,53 @@ func NewRaft(id uint32, peers map[uint32]Peer, persister Persister, config *Conf
 // candidate: reject
 // leader: add log entry to log
 func (r *Raft) applyCommand(req *pb.ApplyCommandRequest) (*pb.ApplyCommandResponse, error) {
+	// the leadership the client connected to may be lost, even if the server is elected again since
+	if err := r.checkLeadershipEpoch(req.GetLeadershipEpoch()); err != nil {
+		return nil, err
+	}
 	// TODO: (B.1)* - if not leader, reject client operation and returns `errNotLeader`
 	if r.state != Leader {
 		return nil, errNotLeader
 	}
+	// commands appended now would delay the target from catching up and taking over
+	if targetId := r.transferring(); targetId != 0 {
+		r.logger.Info("reject command since leadership is being transferred", zap.Uint32("target", targetId))
+		return nil, &LeadershipTransferError{TargetId: targetId, TargetAddress: r.serverAddress(targetId)}
+	}
+	// the leader sheds commands under overload instead of queueing uncommitted logs without a bound
+	if maxInflight := r.config.MaxInflight; maxInflight > 0 {
+		if lastLogId, _ := r.getLastLog(); lastLogId-r.commitIndex >= uint64(maxInflight) {
+			r.logger.Info("reject command since too many logs are not committed", zap.Uint64("lastLogId", lastLogId),
+				zap.Uint64("commitIndex", r.commitIndex))
+			return nil, fmt.Errorf("%w: %d logs are not committed", ErrTooManyRequests, lastLogId-r.commitIndex)
+		}
+	}
 	// TODO: (B.1)* - create a new log entry, append to the local entries
 	// Hint:
 	// - use `getLastLog` to get the last log ID
 	// - use `appendLogs` to append new log
 	entry_id, _ := r.getLastLog()
 	entry_term := r.currentTerm
-	new_entry := &pb.Entry{Id: entry_id + 1, Term: entry_term, Data: req.GetData()}
+	new_entry := &pb.Entry{Id: entry_id + 1, Term: entry_term, Data: req.GetData(), Type: pb.EntryType_COMMAND}
+	// the whole log is checked, since it is replicated with the framing of the other fields
+	if maxSize := r.config.MaxCommandSize; maxSize > 0 {
+		if size := proto.Size(new_entry); size > maxSize {
+			r.logger.Info("reject command since it is too large", zap.Int("size", size), zap.Int("maxSize", maxSize))
+			return nil, fmt.Errorf("%w: %d bytes exceeds %d bytes", ErrCommandTooLarge, size, maxSize)
+		}
+	}
 	var new_logs []*pb.Entry
 	new_logs = append(new_logs, new_entry)
-	r.appendLogs(new_logs)
+	if err := r.appendLogs(new_logs); err != nil {
+		r.logger.Error("fail to append new entry", zap.Error(err))
+		return nil, err
+	}
+	r.trackAppended(new_entry)
+
+	// a single-node cluster commits the log right after it is appended, since the leader itself is the majority
+	if len(r.peers) == 0 {
+		r.advanceCommitIndex()
+	}
 	// TODO: (B.1)* - return the new log entry
 	return &pb.ApplyCommandResponse{Entry: new_entry}, nil
 }
@@ -93,7 +284,7 @@ func (r *Raft) appendEntries(req *pb.AppendEntriesRequest) (*pb.AppendEntriesRes
 	// Log: r.logger.Info("reject append entries since current term is older")
 	if req.GetTerm() < r.currentTerm {
 		r.logger.Info("reject append entries since current term is older")
-		return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: false}, nil
+		return r.appendEntriesResponse(false), nil
 	}
 
 	// TODO: (A.2)* - reset the `lastHeartbeat`
@@ -103,6 +294,8 @@ func (r *Raft) appendEntries(req *pb.AppendEntriesRequest) (*pb.AppendEntriesRes
 	// TODO: (A.3) - if RPC request or response contains term T > currentTerm: set currentTerm = T, convert to follower
 	// Hint: use `toFollower` to convert to follower
 	// Log: r.logger.Info("increase term since receive a newer one", zap.Uint64("term", r.currentTerm))
+	// the new term is persisted along with logs appended below in a single state before the response is sent,
+	// so a crash never leaves logs of the new term without the term
 	if req.GetTerm() > r.currentTerm {
 		r.toFollower(req.GetTerm())
 		r.logger.Info("increase term since receive a newer one", zap.Uint64("term", r.currentTerm))
@@ -113,16 +306,46 @@ func (r *Raft) appendEntries(req *pb.AppendEntriesRequest) (*pb.AppendEntriesRes
 		r.toFollower(req.GetTerm())
 		r.logger.Info("receive request from leader, fallback to follower", zap.Uint64("term", r.currentTerm))
 	}
+	// the leader is reset once the term advances, another leader of the same term violates the election safety
+	if leaderId := r.leaderId; leaderId != 0 && leaderId != req.GetLeaderId() {
+		r.reportSafetyViolation(fmt.Errorf("%w: leader %d and leader %d in term %d", ErrSafetyViolation, leaderId,
+			req.GetLeaderId(), r.currentTerm))
+	}
+	r.setLeader(req.GetLeaderId())
+
+	if r.isWitness(r.id) {
+		return r.witnessAppendEntries(req), nil
+	}
+
+	// the leader sends the snapshot again once the hinted next log is compacted in its snapshot,
+	// a newer leader decides on its own whether the snapshot is needed
+	if r.installing != nil {
+		if r.installing.GetTerm() == req.GetTerm() {
+			r.logger.Info("reject append entries since a snapshot is being installed",
+				zap.Uint64("lastIncludedId", r.installing.GetLastIncludedId()))
+			return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: false, LastLogId: r.installing.GetLastIncludedId() - 1,
+				LastApplied: r.lastApplied}, nil
+		}
+
+		r.logger.Info("abandon snapshot install of the previous leader", zap.Uint64("lastIncludedId", r.installing.GetLastIncludedId()))
+		r.installing = nil
+	}
 
 	prevLogId := req.GetPrevLogId()
 	prevLogTerm := req.GetPrevLogTerm()
+	// malformed entries would corrupt the log, they must start right after the previous log and be contiguous
+	if err := checkLogsFollow(prevLogId, req.GetEntries()); err != nil {
+		r.logger.Warn("reject append entries with malformed entries", zap.Error(err), zap.Uint64("prevLogId", prevLogId))
+		return r.appendEntriesResponse(false), nil
+	}
 	if prevLogId != 0 && prevLogTerm != 0 {
 		// TODO: (B.2) - reply false if log doesn’t contain an entry at prevLogIndex whose term matches prevLogTerm
 		// Hint: use `getLog` to get log with ID equals to prevLogId
 		// Log: r.logger.Info("the given previous log from leader is missing or mismatched", zap.Uint64("prevLogId", prevLogId), zap.Uint64("prevLogTerm", prevLogTerm), zap.Uint64("logTerm", log.GetTerm()))
-		if r.getLog(prevLogId).GetTerm() != prevLogTerm {
-			r.logger.Info("the given previous log from leader is missing or mismatched", zap.Uint64("prevLogId", prevLogId), zap.Uint64("prevLogTerm", prevLogTerm), zap.Uint64("logTerm", r.getLog(prevLogId).GetTerm()))
-			return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: false}, nil
+		// logs before the snapshot are committed, so they always match
+		if prevLogId >= r.snapshotMeta.LastIncludedId && r.getLogTerm(prevLogId) != prevLogTerm {
+			r.logger.Info("the given previous log from leader is missing or mismatched", zap.Uint64("prevLogId", prevLogId), zap.Uint64("prevLogTerm", prevLogTerm), zap.Uint64("logTerm", r.getLogTerm(prevLogId)))
+			return r.appendEntriesResponse(false), nil
 		}
 	}
 	if len(req.GetEntries()) != 0 {
@@ -130,27 +353,56 @@ func (r *Raft) appendEntries(req *pb.AppendEntriesRequest) (*pb.AppendEntriesRes
 		// TODO: (B.4) - append any new entries not already in the log
 		// Hint: use `deleteLogs` follows by `appendLogs`
 		// Log: r.logger.Info("receive and append new entries", zap.Int("newEntries", len(req.GetEntries())), zap.Int("numberOfEntries", len(r.logs)))
-		r.deleteLogs(prevLogId)
-		r.appendLogs(req.GetEntries())
-		r.logger.Info("receive and append new entries", zap.Int("newEntries", len(req.GetEntries())), zap.Int("numberOfEntries", len(r.logs)))
+		// skip entries already in the log, so a stale or duplicated request does not truncate the log
+		entries := req.GetEntries()
+		for len(entries) != 0 && (entries[0].GetId() <= r.snapshotMeta.LastIncludedId || r.getLogTerm(entries[0].GetId()) == entries[0].GetTerm()) {
+			entries = entries[1:]
+		}
+
+		if len(entries) != 0 {
+			r.deleteLogs(entries[0].GetId() - 1)
+			if err := r.appendLogs(entries); err != nil {
+				r.logger.Error("fail to append new entries", zap.Error(err))
+				return r.appendEntriesResponse(false), nil
+			}
+
+			// the configuration takes effect once it is appended, and is rollbacked if it is deleted
+			if r.configurationId >= entries[0].GetId() || containsConfiguration(entries) {
+				if err := r.reloadConfiguration(); err != nil {
+					r.logger.Error("fail to reload configuration", zap.Error(err))
+				}
+			}
+		}
+		r.logger.Info("receive and append new entries", zap.Int("newEntries", len(entries)), zap.Int("numberOfEntries", len(r.logs)))
 	}
 
 	// TODO: (B.5) - if leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index of last new entry)
 	// Hint: use `getLastLog` to get the index of last new entry
 	// Hint: use `applyLogs` to apply(commit) new logs in background
 	// Log: r.logger.Info("update commit index from leader", zap.Uint64("commitIndex", r.commitIndex))
-	if req.GetLeaderCommitId() > r.commitIndex {
-		lastEntryId, _ := r.getLastLog()
-		if req.GetLeaderCommitId() < lastEntryId {
-			r.setCommitIndex(req.GetLeaderCommitId())
+	// the last new entry is the last entry known to match the leader, logs after it may be stale,
+	// and it is only known if the previous log is checked, so a follower with a short log only commits logs it has
+	if req.GetLeaderCommitId() > r.commitIndex && (prevLogTerm != 0 || prevLogId <= r.snapshotMeta.LastIncludedId) {
+		lastNewEntryId := prevLogId + uint64(len(req.GetEntries()))
+		if req.GetLeaderCommitId() < lastNewEntryId {
+			r.commit(req.GetLeaderCommitId())
 		} else {
-			r.setCommitIndex(lastEntryId)
+			r.commit(lastNewEntryId)
 		}
-		r.applyLogs(r.applyCh)
 		r.logger.Info("update commit index from leader", zap.Uint64("commitIndex", r.commitIndex))
 	}
 
-	return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: true}, nil
+	// logs failed to apply are retried on every heartbeat
+	r.applyCommittedLogs()
+
+	return r.appendEntriesResponse(true), nil
+}
+
+// appendEntriesResponse reports the last log id besides the result, so the leader can check the replication progress
+func (r *Raft) appendEntriesResponse(success bool) *pb.AppendEntriesResponse {
+	lastLogId, _ := r.getLastLog()
+
+	return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: success, LastLogId: lastLogId, LastApplied: r.lastApplied}
 }
 
 // leader: 1, 2
@@ -178,7 +430,8 @@ func (r *Raft) requestVote(req *pb.RequestVoteRequest) (*pb.RequestVoteResponse,
 
 	// TODO: (A.7) - if votedFor is null or candidateId, and candidate’s log is at least as up-to-date as receiver’s log, grant vote
 	// Hint: (fix the condition) if already vote for another candidate, reply false
-	if r.votedFor != 0 {
+	// a retried request of the candidate already voted for is granted again
+	if r.votedFor != 0 && r.votedFor != req.GetCandidateId() {
 		r.logger.Info("reject since already vote for another candidate",
 			zap.Uint64("term", r.currentTerm),
 			zap.Uint32("votedFor", r.votedFor))
@@ -186,8 +439,7 @@ func (r *Raft) requestVote(req *pb.RequestVoteRequest) (*pb.RequestVoteResponse,
 	}
 	// Hint: (fix the condition) if the local last entry is more up-to-date than the candidate's last entry, reply false
 	// Hint: use `getLastLog` to get the last log entry
-	lastEntryId, lastEntryTerm := r.getLastLog()
-	if (req.GetLastLogTerm() < lastEntryTerm) || (req.GetLastLogTerm() == lastEntryTerm && req.GetLastLogId() < lastEntryId) {
+	if !r.isCandidateUpToDate(req.GetLastLogId(), req.GetLastLogTerm()) {
 		r.logger.Info("reject since last entry is more up-to-date")
 		return &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: false}, nil
 	}
@@ -202,13 +454,128 @@ func (r *Raft) requestVote(req *pb.RequestVoteRequest) (*pb.RequestVoteResponse,
 	return &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, nil
 }
 
+// isCandidateUpToDate reports whether the candidate's last log is at least as up-to-date as the local log, while a
+// snapshot install is not complete, the snapshot's last included log is compared instead unless the local log
+// extends it, since logs of the snapshot are committed and other local logs are to be discarded by the install
+func (r *Raft) isCandidateUpToDate(lastLogId, lastLogTerm uint64) bool {
+	if r.installing == nil {
+		return r.isLogUpToDate(lastLogId, lastLogTerm)
+	}
+
+	lastEntryId, lastEntryTerm := r.getLastLog()
+	includedId, includedTerm := r.installing.GetLastIncludedId(), r.installing.GetLastIncludedTerm()
+	if lastEntryId < includedId || r.getLogTerm(includedId) != includedTerm {
+		lastEntryId, lastEntryTerm = includedId, includedTerm
+	}
+
+	return isUpToDate(lastLogId, lastLogTerm, lastEntryId, lastEntryTerm)
+}
+
+// follower: 1, 2
+// candidate: 1
+// leader: 1
+// 1. reject old term rpc and rpc not from the current leader
+// 2. start election immediately without waiting for heartbeat timeout
+func (r *Raft) timeoutNow(req *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	if req.GetTerm() < r.currentTerm {
+		r.logger.Info("reject timeout now since current term is older")
+		return &pb.TimeoutNowResponse{Term: r.currentTerm}, nil
+	}
+
+	if req.GetTerm() > r.currentTerm {
+		r.toFollower(req.GetTerm())
+		r.logger.Info("increase term since receive a newer one", zap.Uint64("term", r.currentTerm))
+	}
+
+	// only the leader of the term hands over its leadership
+	if r.leaderId != 0 && r.leaderId != req.GetLeaderId() {
+		r.logger.Info("reject timeout now since it is not from the current leader",
+			zap.Uint32("leader", r.leaderId), zap.Uint32("sender", req.GetLeaderId()))
+		return &pb.TimeoutNowResponse{Term: r.currentTerm}, nil
+	}
+
+	// the follower loop exits once the state changes, so the election starts without waiting for the heartbeat timeout
+	if r.state == Follower && r.canStartElection() {
+		r.toCandidate()
+		r.logger.Info("receive timeout now from leader, change state from follower to candidate", zap.Uint32("leader", req.GetLeaderId()))
+	}
+
+	return &pb.TimeoutNowResponse{Term: r.currentTerm}, nil
+}
+
+type forceElectionRequest struct{}
+
+type forceElectionResponse struct{}
+
+// follower: 1
+// candidate: 2
+// leader: reject
+// 1. start election immediately without waiting for heartbeat timeout
+// 2. restart election immediately without waiting for election timeout
+func (r *Raft) forceElection(req *forceElectionRequest) (*forceElectionResponse, error) {
+	if !r.canStartElection() {
+		return nil, errNotVoter
+	}
+
+	switch r.state {
+	case Follower:
+		r.toCandidate()
+		r.logger.Info("force election, change state from follower to candidate")
+	case Candidate:
+		r.restartElection = true
+		r.logger.Info("force election, restart election")
+	default:
+		return nil, errAlreadyLeader
+	}
+
+	return &forceElectionResponse{}, nil
+}
+
 // raft main loop
 func (r *Raft) Run(ctx context.Context) {
+	r.mu.Lock()
+	r.running = true
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+	}()
+
 	if err := r.loadRaftState(r.persister); err != nil {
 		r.logger.Error("fail to load raft state", zap.Error(err))
 		return
 	}
 
+	if err := r.reloadConfiguration(); err != nil {
+		r.logger.Error("fail to load configuration", zap.Error(err))
+		return
+	}
+
+	// the state machine is seeded from the snapshot before logs after it are applied
+	if err := r.restoreSnapshot(); err != nil {
+		r.logger.Error("fail to restore snapshot", zap.Error(err))
+		return
+	}
+
+	if r.persistCh != nil {
+		go r.runPersister(ctx)
+	}
+
+	// workers are stopped when Run returns, so each run starts its own
+	r.workers = newPeerWorkers()
+	defer r.workers.stop()
+	r.snapshotWorkers = newPeerWorkers()
+	defer r.snapshotWorkers.stop()
+
+	r.stopCh = ctx.Done()
+
+	// the persisted snapshot is delivered before any log is applied
+	if r.restoringSnapshot {
+		r.applyCommittedLogs()
+	}
+
 	r.logger.Info("starting raft",
 		zap.Uint64("term", r.currentTerm),
 		zap.Uint32("votedFor", r.votedFor),
@@ -218,11 +585,17 @@ func (r *Raft) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			r.logger.Info("raft server stopped gracefully")
+			if r.drainApplyOnShutdown() {
+				r.applyCommittedLogs()
+			}
+			r.logger.Info("raft server stopped gracefully", zap.Uint64("commitIndex", r.commitIndex),
+				zap.Uint64("lastApplied", r.lastApplied))
 			return
 		default:
 		}
 
+		r.checkInvariants()
+
 		switch r.state {
 		case Follower:
 			r.runFollower(ctx)
@@ -234,11 +607,284 @@ func (r *Raft) Run(ctx context.Context) {
 	}
 }
 
+// Reset wipes the logs, snapshot and persisted state of the node, and resets it to a follower at term 0, so a node
+// recovered from divergence can rejoin the cluster fresh, e.g. by JoinClusterAsLearner after it is removed from the
+// configuration. It returns ErrRunning if Run is in progress, the node can be run again after it is reset.
+func (r *Raft) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return ErrRunning
+	}
+
+	if err := r.persister.SaveSnapshot(SnapshotMeta{}, nil); err != nil {
+		return fmt.Errorf("fail to clear snapshot: %w", err)
+	}
+	if err := r.persister.SaveRaftState(nil); err != nil {
+		return fmt.Errorf("fail to clear raft state: %w", err)
+	}
+
+	failWaiters(r.commitWaiters, errShutdown)
+	failWaiters(r.applyWaiters, errShutdown)
+
+	r.roleTimer.transition(r.state)
+	r.state = Follower
+	r.currentTerm = 0
+	r.votedFor = 0
+	r.leaderId = 0
+	r.logs = make([]*pb.Entry, 0)
+	r.snapshotMeta = SnapshotMeta{}
+	r.commitIndex = 0
+	r.lastApplied = 0
+	r.deliveredIndex = 0
+	r.ackedIndex = 0
+	r.nextIndex = make(map[uint32]uint64)
+	r.matchIndex = make(map[uint32]uint64)
+	r.installing = nil
+	r.restoringSnapshot = false
+	r.snapshotRequested = 0
+
+	r.logger.Info("raft state is reset")
+
+	return nil
+}
+
 // apply to log machine channel
+// snapshots installed from the leader are sent as `SNAPSHOT` entries, the state machine should be restored from them,
+// the persisted snapshot is sent first on startup unless it is restored by `RestoreSnapshot`.
+//
+// Logs are buffered in the ApplyCh, so the state machine calls Applied after processing each entry, until then the
+// entry is not applied for ReadAtLeast, FollowerRead and the APPLIED stage of ApplyCommandStream.
 func (r *Raft) ApplyCh() <-chan *pb.Entry {
 	return r.applyCh
 }
 
+// Applied acknowledges that the state machine has applied entries up to the given id received from the ApplyCh,
+// it is not needed with `ApplyFunc`, which applies the entry before returning
+func (r *Raft) Applied(id uint64) {
+	r.ackApplied(id)
+}
+
+// WaitForCommit blocks until the log with the given index is committed, or returns the error of the context,
+// or returns ErrLeadershipLost if the server steps down from leader before the log is committed
+func (r *Raft) WaitForCommit(ctx context.Context, index uint64) error {
+	return r.waitForCommit(ctx, index)
+}
+
+// IsCommitted reports whether the log with the given index is committed without blocking,
+// WaitForCommit returns immediately for the same index if it reports true
+func (r *Raft) IsCommitted(index uint64) bool {
+	return r.isCommitted(index)
+}
+
+// LeadershipEpoch returns the epoch of the current role, which changes whenever the server steps down or becomes the
+// leader, clients connecting to the leader set it as `LeadershipEpoch` of their ApplyCommandRequest, so commands are
+// rejected with ErrLeadershipLost once the leadership they connected to is lost
+func (r *Raft) LeadershipEpoch() uint64 {
+	return atomic.LoadUint64(&r.leadershipEpoch)
+}
+
+// Committed reports whether the entry returned by ApplyCommand is committed, the entry is never committed if a new
+// leader overwrites the log at its index with a log in another term, which a bare index check cannot tell,
+// it also reports false once the log is compacted into a snapshot, since its term is no longer known
+func (r *Raft) Committed(entry *pb.Entry) bool {
+	return r.isEntryCommitted(entry)
+}
+
+// commit advances the commitIndex to the given index, and invokes `OnCommit` in order for each newly committed log,
+// waiters of `WaitForCommit` are released before that, so they are not delayed by callbacks or applying logs
+func (r *Raft) commit(index uint64) {
+	prevCommitIndex := r.commitIndex
+	r.setCommitIndex(index)
+	r.checkInvariants()
+	r.observeCommitLatency()
+
+	if r.config.OnCommit == nil {
+		return
+	}
+
+	for _, log := range r.getLogs(prevCommitIndex + 1) {
+		if log.GetId() > r.commitIndex {
+			break
+		}
+
+		r.config.OnCommit(log)
+	}
+}
+
+// trackAppended records when the leader appends the log, so its commit latency is observed once it is committed
+func (r *Raft) trackAppended(entry *pb.Entry) {
+	r.appendedAt[entry.GetId()] = r.clock.Now()
+}
+
+// observeCommitLatency observes the commit latency of committed logs appended by the leader and stops tracking them,
+// logs appended in a previous leadership may be replaced by other leaders, so they are dropped without observing
+func (r *Raft) observeCommitLatency() {
+	if len(r.appendedAt) == 0 {
+		return
+	}
+
+	now := r.clock.Now()
+	for id, appendedAt := range r.appendedAt {
+		if id > r.commitIndex {
+			continue
+		}
+
+		if r.state == Leader {
+			r.metrics.Observe(MetricCommitLatency, float64(now.Sub(appendedAt).Nanoseconds()))
+		}
+		delete(r.appendedAt, id)
+	}
+}
+
+// applyCommittedLogs applies committed logs through `ApplyFunc` if configured, otherwise through the ApplyCh,
+// logs failed to apply are retried on the next call
+func (r *Raft) applyCommittedLogs() {
+	apply := r.config.ApplyFunc
+	if apply == nil {
+		apply = r.sendToApplyCh
+	}
+
+	// the snapshot installed from the leader, or persisted before startup, is applied before logs after it
+	if (r.lastApplied < r.snapshotMeta.LastIncludedId || r.restoringSnapshot) && !r.applySnapshot(apply) {
+		return
+	}
+
+	if err := r.applyLogs(apply); err != nil {
+		r.logger.Warn("fail to apply committed logs, retry later", zap.Error(err), zap.Uint64("lastApplied", r.lastApplied))
+	}
+
+	r.requestSnapshot()
+}
+
+// sendToApplyCh sends the log to the ApplyCh, the send is abandoned once Run is shutting down unless
+// `DrainApplyOnShutdown`
+func (r *Raft) sendToApplyCh(log *pb.Entry) error {
+	if r.drainApplyOnShutdown() {
+		r.applyCh <- log
+		return nil
+	}
+
+	// stop before sending even if the ApplyCh has room
+	select {
+	case <-r.stopCh:
+		return errShutdown
+	default:
+	}
+
+	select {
+	case r.applyCh <- log:
+		return nil
+	case <-r.stopCh:
+		return errShutdown
+	}
+}
+
+// drainApplyOnShutdown returns `DrainApplyOnShutdown` of the config, which defaults to true
+func (r *Raft) drainApplyOnShutdown() bool {
+	return r.config.DrainApplyOnShutdown == nil || *r.config.DrainApplyOnShutdown
+}
+
+// DumpLog returns copies of all logs including uncommitted ones for debugging, along with the metadata of the
+// snapshot, logs up to and including `LastIncludedId` are compacted and not returned
+func (r *Raft) DumpLog() ([]*pb.Entry, SnapshotMeta) {
+	return r.dumpLogs()
+}
+
+// LogStats returns the number and the size of logs not compacted into the snapshot, e.g. to tune when to take
+// snapshots
+func (r *Raft) LogStats() LogStats {
+	return r.logStats()
+}
+
+// LeaderId returns the ID of the last known leader, or 0 if the leader is unknown
+func (r *Raft) LeaderId() uint32 {
+	return r.getLeader()
+}
+
+// IsLeader reports whether the server believes it is the leader, it becomes false as soon as the server steps down,
+// but a leader partitioned from the cluster may still report true until it learns about a newer term
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state == Leader
+}
+
+// MinAppliedIndex returns the minimum lastApplied of all servers in the configuration, as reported to the leader in
+// AppendEntries responses, servers not reported yet count as 0. Logs after it must not be compacted if no server is to
+// be stranded behind the snapshot. It returns false if the server is not the leader.
+func (r *Raft) MinAppliedIndex() (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != Leader {
+		return 0, false
+	}
+
+	return r.minAppliedIndex(), true
+}
+
+// minAppliedIndex returns the minimum lastApplied of the leader and servers in the configuration
+func (r *Raft) minAppliedIndex() uint64 {
+	minApplied := r.lastApplied
+	for serverId := range r.configuration {
+		if serverId == r.id || r.isWitness(serverId) {
+			continue
+		}
+
+		if applied := r.appliedIndex[serverId]; applied < minApplied {
+			minApplied = applied
+		}
+	}
+
+	return minApplied
+}
+
+// Ready reports whether the server is the leader and has committed a log in its current term, only then the commit
+// index includes all logs committed by previous leaders, see `LeaderNoop` to commit such a log once elected
+func (r *Raft) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state == Leader && r.commitIndex != 0 && r.getLogTerm(r.commitIndex) == r.currentTerm
+}
+
+// Configuration returns members of the latest committed configuration, including learners and observers,
+// changes of configurations not committed yet are not reflected
+func (r *Raft) Configuration() map[uint32]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, configuration, _, _, err := r.configurationAt(r.commitIndex)
+	if err != nil {
+		r.logger.Error("fail to load committed configuration", zap.Error(err))
+		return nil
+	}
+
+	members := make(map[uint32]struct{}, len(configuration))
+	for id := range configuration {
+		members[id] = struct{}{}
+	}
+
+	return members
+}
+
+// ForceElection starts an election at a new term immediately, it is rejected if the server is the leader
+func (r *Raft) ForceElection() error {
+	rpcResp, err := r.dispatchRPCRequest(context.Background(), &forceElectionRequest{})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rpcResp.(*forceElectionResponse); !ok {
+		return errResponseTypeMismatch
+	}
+
+	return nil
+}
+
 // follower related
 
 // follower main loop
@@ -250,7 +896,7 @@ func (r *Raft) runFollower(ctx context.Context) {
 	r.logger.Info("running follower")
 
 	// setting timeout
-	timeoutCh := randomTimeout(r.config.HeartbeatTimeout)
+	timeoutCh := r.heartbeatRandomTimeout(r.heartbeatTimeout())
 
 	for r.state == Follower {
 		select {
@@ -258,9 +904,9 @@ func (r *Raft) runFollower(ctx context.Context) {
 			return
 
 		case <-timeoutCh: // timeout
-			timeoutCh = randomTimeout(r.config.HeartbeatTimeout)
+			timeoutCh = r.heartbeatRandomTimeout(r.heartbeatTimeout())
 
-			if time.Now().Sub(r.lastHeartbeat) > r.config.HeartbeatTimeout {
+			if time.Now().Sub(r.lastHeartbeat) > r.heartbeatTimeout() {
 				r.handleFollowerHeartbeatTimeout()
 			}
 
@@ -271,6 +917,16 @@ func (r *Raft) runFollower(ctx context.Context) {
 }
 
 func (r *Raft) handleFollowerHeartbeatTimeout() {
+	// a server not voting in the configuration (e.g. joining the cluster or a learner) should not disrupt the cluster
+	if !r.canStartElection() {
+		r.logger.Debug("heartbeat timeout, but not a voter of the configuration")
+		return
+	}
+	if !r.electionStrategy().ShouldStartElection(r.id) {
+		r.logger.Debug("heartbeat timeout, but the election strategy does not start an election")
+		return
+	}
+
 	// TODO: (A.9) - if election timeout elapses without receiving AppendEntries RPC from current leader or granting vote to candidate: convert to candidate
 	// Hint: use `toCandidate` to convert to candidate
 	r.toCandidate()
@@ -285,6 +941,12 @@ type voteResult struct {
 	peerId uint32
 }
 
+// electionResult is the result of an election sent to `electionResultCh` of the config
+type electionResult struct {
+	term uint64
+	won  bool
+}
+
 // candidate man loop
 // setting: vote related varible, requestvote rpc response channel, election timeout channel
 // action:
@@ -295,40 +957,77 @@ type voteResult struct {
 func (r *Raft) runCandidate(ctx context.Context) {
 	r.logger.Info("running candidate")
 
+	// RPCs of the election are cancelled once the election is over
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// set votes count inital
-	grantedVotes := 0                     // votes which it aleady has
-	votesNeeded := (len(r.peers) + 1) / 2 // to win votes count
+	grantedVotes := 0  // votes which it aleady has
+	receivedVotes := 0 // vote results received from peers
+	// granted votes must exceed it to win, including the candidate's own vote, that is, 2 votes out of 2 or 3 voters,
+	// and 3 votes out of 4 or 5 voters
+	votesNeeded := r.numElectionVoters() / 2
 	// will get vote result(response) from channel
 	voteCh := make(chan *voteResult, len(r.peers))
 	// set election timeout
-	timeoutCh := randomTimeout(r.config.ElectionTimeout)
+	timeoutCh := r.electionRandomTimeout(r.backoffElectionTimeout())
+	r.restartElection = false
+	r.electionRounds++
 
-	// vote for itself
+	// vote for itself, the vote must be durable before requesting votes
 	r.voteForSelf(&grantedVotes)
+	r.persistState(ctx)
+	electionTerm := r.currentTerm
 
 	// requestvote rpc to peers
 	r.broadcastRequestVote(ctx, voteCh)
 
+	// a single-node cluster wins the election by its own vote, since no vote result is received
+	r.checkElectionWon(grantedVotes, votesNeeded)
+
 	// wait until:
 	// 1. it wins the election
 	// 2. another server establishes itself as leader (see AppendEntries)
 	// 3. election timeout
-	for r.state == Candidate {
+	// 4. election is forced to restart (see ForceElection)
+	for r.state == Candidate && !r.restartElection {
 		select {
 		case <-ctx.Done(): // shutdown
 			return
 
 		case vote := <-voteCh: // get rpc response
-			r.handleVoteResult(vote, &grantedVotes, votesNeeded)
+			receivedVotes++
+			r.handleVoteResult(ctx, vote, &grantedVotes, votesNeeded)
 
 		case <-timeoutCh: // timeout election time
 			r.logger.Info("election timeout reached, restarting election")
+			r.recordElectionFailure(receivedVotes, votesNeeded)
+			r.notifyElectionResult(electionTerm, false)
 			return
 
 		case rpc := <-r.rpcCh: // get rpc request
 			r.handleRPCRequest(rpc)
 		}
 	}
+
+	r.notifyElectionResult(electionTerm, r.state == Leader)
+
+	// another server establishes itself as leader, rounds are counted again from the next election
+	if r.state == Follower {
+		r.electionRounds = 0
+	}
+}
+
+// recordElectionFailure emits a split vote event if a majority of voters responded without electing the candidate,
+// otherwise emits a timeout event
+func (r *Raft) recordElectionFailure(receivedVotes int, votesNeeded int) {
+	// the candidate itself is also a voter responded
+	if receivedVotes+1 > votesNeeded {
+		r.metrics.IncrCounter(MetricElectionSplitVote, 1)
+		return
+	}
+
+	r.metrics.IncrCounter(MetricElectionTimeout, 1)
 }
 
 func (r *Raft) voteForSelf(grantedVotes *int) {
@@ -337,9 +1036,40 @@ func (r *Raft) voteForSelf(grantedVotes *int) {
 	// Hint: use `voteFor` to vote for self
 	(*grantedVotes)++
 	r.voteFor(r.id, true) // vote to who's id, itself?
+	r.electionVoters = r.committedVoters()
+	for id := range r.electionVoters {
+		if !r.electionStrategy().CountsTowardQuorum(id) {
+			delete(r.electionVoters, id)
+		}
+	}
+	r.grantedVoters = map[uint32]bool{r.id: true}
+	r.setVoteTally(*grantedVotes, r.numElectionVoters()/2+1)
 	r.logger.Info("vote for self", zap.Uint64("term", r.currentTerm))
 }
 
+// setVoteTally sets the votes granted to the candidate and the votes required to win the election
+func (r *Raft) setVoteTally(granted, required int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.votesGranted = granted
+	r.votesRequired = required
+}
+
+// VoteTally returns the votes granted to the server, including its own vote, and the votes required to win the
+// election while it is a candidate, e.g. to diagnose slow or split elections, it returns zeros if the server is not a
+// candidate.
+func (r *Raft) VoteTally() (granted, needed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != Candidate {
+		return 0, 0
+	}
+
+	return r.votesGranted, r.votesRequired
+}
+
 func (r *Raft) broadcastRequestVote(ctx context.Context, voteCh chan *voteResult) {
 	r.logger.Info("broadcast request vote", zap.Uint64("term", r.currentTerm))
 
@@ -352,79 +1082,158 @@ func (r *Raft) broadcastRequestVote(ctx context.Context, voteCh chan *voteResult
 		CandidateId: r.id,
 		LastLogId:   candidateLastLogId,
 		LastLogTerm: candidateLastLogTerm,
+		GroupId:     r.config.GroupId,
+		ClusterId:   r.config.ClusterId,
 	}
 
 	// TODO: (A.11) - send RequestVote RPCs to all other servers (modify the code to send `RequestVote` RPCs in parallel)
-	// var wg sync.WaitGroup
 	for peerId, peer := range r.peers {
 		peerId := peerId
 		peer := peer
 
-		// send rpc
-		// wg.Add(1)
-		go func() {
-			// defer wg.Done()
-			resp, err := peer.RequestVote(ctx, req)
+		// learners do not vote, paused peers are not asked for votes, the server never sends RPCs to itself
+		if peerId == r.id || !r.isVoter(peerId) || r.paused[peerId] {
+			continue
+		}
+
+		// send rpc by the worker of the peer
+		r.submitRPC(r.workers, peerId, "RequestVote", func() {
+			// the election is over
+			if ctx.Err() != nil {
+				return
+			}
+
+			rpcCtx, cancel := r.rpcContext(ctx)
+			defer cancel()
+
+			var resp *pb.RequestVoteResponse
+			start := time.Now()
+			err := r.withRetry(rpcCtx, func() (err error) {
+				resp, err = peer.RequestVote(rpcCtx, req)
+				return err
+			})
 			if err != nil {
 				r.logger.Error("fail to send RequestVote RPC", zap.Error(err), zap.Uint32("peer", peerId))
 				return
 			}
+			r.rtt.observe(time.Since(start))
 
-			voteCh <- &voteResult{RequestVoteResponse: resp, peerId: peerId}
-		}()
+			select {
+			case voteCh <- &voteResult{RequestVoteResponse: resp, peerId: peerId}:
+			case <-ctx.Done():
+			}
+		})
 	}
-	// wg.Wait() no be lock at here
-	// close(voteCh)
 }
 
 // 1. candidate's term < rpc response's term -> follower
 // 2. get vote
 // 3. if candidate's votes > majority -> leader
-func (r *Raft) handleVoteResult(vote *voteResult, grantedVotes *int, votesNeeded int) {
+func (r *Raft) handleVoteResult(ctx context.Context, vote *voteResult, grantedVotes *int, votesNeeded int) {
 	// TODO: (A.12) - if RPC request or response contains term T > currentTerm: set currentTerm = T, convert to follower
 	// Hint: use `toFollower` to convert to follower
 	// Log: r.logger.Info("receive new term on RequestVote response, fallback to follower", zap.Uint32("peer", vote.peerId))
 	if vote.GetTerm() > r.currentTerm {
 		r.toFollower(vote.GetTerm())
+		r.persistState(ctx)
 		r.logger.Info("receive new term on RequestVote response, fallback to follower", zap.Uint32("peer", vote.peerId))
+		return
 	}
 
-	// candidate get vote
-	if vote.VoteGranted {
+	r.lastContact[vote.peerId] = time.Now()
+
+	// the vote channel of each election round is abandoned once the round is over, so votes of a previous round are
+	// never delivered to the current one, they are still ignored here in case a stale vote is delivered anyway
+	if vote.GetTerm() < r.currentTerm {
+		r.logger.Info("ignore vote of a previous election", zap.Uint32("peer", vote.peerId), zap.Uint64("voteTerm", vote.GetTerm()))
+		return
+	}
+
+	// candidate get vote, votes not counting towards the quorum are ignored
+	if vote.VoteGranted && r.electionStrategy().CountsTowardQuorum(vote.peerId) {
 		(*grantedVotes)++
+		r.grantedVoters[vote.peerId] = true
+		r.setVoteTally(*grantedVotes, r.votesRequired)
 		r.logger.Info("vote granted", zap.Uint32("peer", vote.peerId), zap.Int("grantedVote", (*grantedVotes)))
 	}
 
 	// TODO: (A.13) - if votes received from majority of servers: become leader
 	// Log: r.logger.Info("election won", zap.Int("grantedVote", (*grantedVotes)), zap.Uint64("term", r.currentTerm))
 	// Hint: use `toLeader` to convert to leader
-	if *grantedVotes > votesNeeded {
-		r.toLeader()
-		r.logger.Info("election won", zap.Int("grantedVote", (*grantedVotes)), zap.Uint64("term", r.currentTerm))
+	r.checkElectionWon(*grantedVotes, votesNeeded)
+}
+
+// checkElectionWon converts to leader if votes received from majority of servers in both the latest and the committed
+// configuration, extra votes received after the election is won are ignored
+func (r *Raft) checkElectionWon(grantedVotes int, votesNeeded int) {
+	if grantedVotes > votesNeeded && r.hasCommittedMajority() && r.toLeader(r.peers) {
+		r.setLeader(r.id)
+		r.metrics.Observe(MetricElectionRounds, float64(r.electionRounds))
+		r.electionRounds = 0
+		r.logger.Info("election won", zap.Int("grantedVote", grantedVotes), zap.Uint64("term", r.currentTerm))
+	}
+}
+
+// notifyElectionResult sends the result of the election to `electionResultCh` of the config if set,
+// the result is dropped if the channel is full so the main loop is never blocked
+func (r *Raft) notifyElectionResult(term uint64, won bool) {
+	if r.config.electionResultCh == nil {
+		return
+	}
+
+	select {
+	case r.config.electionResultCh <- electionResult{term: term, won: won}:
+	default:
 	}
 }
 
+// hasCommittedMajority reports whether votes are granted by a majority of voters of the committed configuration
+func (r *Raft) hasCommittedMajority() bool {
+	granted := 0
+	for id := range r.electionVoters {
+		if r.grantedVoters[id] {
+			granted++
+		}
+	}
+
+	return granted > len(r.electionVoters)/2
+}
+
 // leader related
 // appendentry rpc reponse, server id + result + information
+// the result is sent even if the RPC fails, with err set and no response, so the peer is replicated again
 type appendEntriesResult struct {
 	*pb.AppendEntriesResponse
 	req    *pb.AppendEntriesRequest
 	peerId uint32
+	err    error
 }
 
 // leader main loop
-// setting: heartbeat time channel, nextIndex[], matchIndex[], appendentry rpc reponse channel
+// setting: heartbeat time channel, appendentry rpc reponse channel (nextIndex[], matchIndex[] are reset by toLeader)
 // 2. handle request, handle response, send heatbeat, append
 func (r *Raft) runLeader(ctx context.Context) {
+	// RPCs of the leadership are cancelled once the leadership is over
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// setting when to send heartbeat
-	timeoutCh := randomTimeout(r.config.HeartbeatInterval)
+	timeoutCh := r.randomTimeout(r.config.HeartbeatInterval)
 	// appendentry rpc reponse channel
 	appendEntriesResultCh := make(chan *appendEntriesResult, len(r.peers))
-	// reset `nextIndex` and `matchIndex`
-	lastLogId, _ := r.getLastLog()
-	for peerId := range r.peers {
-		r.nextIndex[peerId] = lastLogId + 1
-		r.matchIndex[peerId] = 0
+	// installsnapshot rpc response channel
+	installSnapshotResultCh := make(chan *installSnapshotResult, len(r.peers))
+	r.snapshotting = make(map[uint32]bool)
+	r.replicating = make(map[uint32]bool)
+	r.transferTarget = 0
+	r.appendedAt = make(map[uint64]time.Time)
+	r.caughtUpSince = make(map[uint32]time.Time)
+	r.mu.Lock()
+	r.appliedIndex = make(map[uint32]uint64)
+	r.mu.Unlock()
+
+	if r.config.LeaderNoop {
+		r.appendNoop(ctx)
 	}
 
 	for r.state == Leader {
@@ -433,90 +1242,210 @@ func (r *Raft) runLeader(ctx context.Context) {
 			return
 
 		case <-timeoutCh: // send heartbeat/appendentry to all the other server
-			timeoutCh = randomTimeout(r.config.HeartbeatInterval)
-			r.broadcastAppendEntries(ctx, appendEntriesResultCh)
+			timeoutCh = r.randomTimeout(r.config.HeartbeatInterval)
+			r.promoteCaughtUpLearners(ctx)
+			r.broadcastAppendEntries(ctx, appendEntriesResultCh, installSnapshotResultCh)
+
+			// logs failed to apply are retried on every heartbeat
+			r.applyCommittedLogs()
 
 		case result := <-appendEntriesResultCh: // get appendentry rpc response
-			r.handleAppendEntriesResult(result)
+			r.handleAppendEntriesResult(ctx, result)
+			// peers failed to reach are retried by the next heartbeat instead of in a tight loop
+			if result.err == nil {
+				r.replicateLogs(ctx, appendEntriesResultCh, installSnapshotResultCh)
+			}
+
+		case result := <-installSnapshotResultCh: // get installsnapshot rpc response
+			r.handleInstallSnapshotResult(ctx, result)
 
 		case rpc := <-r.rpcCh: // receive rpc request
 			r.handleRPCRequest(rpc)
+			r.replicateLogs(ctx, appendEntriesResultCh, installSnapshotResultCh)
 		}
 	}
 }
 
-func (r *Raft) broadcastAppendEntries(ctx context.Context, appendEntriesResultCh chan *appendEntriesResult) {
+// appendNoop appends a no-op log of the current term as leader, which is replicated along with the next heartbeat
+func (r *Raft) appendNoop(ctx context.Context) {
+	lastLogId, _ := r.getLastLog()
+	entry := &pb.Entry{Id: lastLogId + 1, Term: r.currentTerm, Type: pb.EntryType_NOOP}
+	if err := r.appendLogs([]*pb.Entry{entry}); err != nil {
+		r.logger.Error("fail to append no-op log", zap.Error(err))
+		return
+	}
+	r.trackAppended(entry)
+
+	r.persistState(ctx)
+
+	if len(r.peers) == 0 {
+		r.advanceCommitIndex()
+	}
+}
+
+func (r *Raft) broadcastAppendEntries(ctx context.Context, appendEntriesResultCh chan *appendEntriesResult, installSnapshotResultCh chan *installSnapshotResult) {
 	r.logger.Info("broadcast append entries")
 
-	// var wg sync.WaitGroup
 	for peerId, peer := range r.peers {
-		peerId := peerId
-		peer := peer
+		// an RPC to itself would deadlock, since it is handled by the main loop sending it
+		if peerId == r.id || r.paused[peerId] {
+			continue
+		}
+
+		// logs the peer needs are compacted, send the snapshot instead, witnesses store neither logs nor snapshots
+		if r.nextIndex[peerId] <= r.snapshotMeta.LastIncludedId && !r.isWitness(peerId) {
+			r.sendSnapshot(ctx, peerId, peer, installSnapshotResultCh)
+			continue
+		}
+
+		r.sendAppendEntries(ctx, peerId, peer, appendEntriesResultCh)
+	}
+}
+
+// replicateLogs sends new logs to peers without an AppendEntries RPC in flight if `MaxBatchSize` is set,
+// logs appended while an RPC is in flight are coalesced into the RPC sent once its response arrives
+func (r *Raft) replicateLogs(ctx context.Context, appendEntriesResultCh chan *appendEntriesResult, installSnapshotResultCh chan *installSnapshotResult) {
+	if r.config.MaxBatchSize <= 0 || r.state != Leader {
+		return
+	}
+
+	lastLogId, _ := r.getLastLog()
+	for peerId, peer := range r.peers {
+		// peers needing a snapshot are left to the heartbeat
+		if peerId == r.id || r.replicating[peerId] || r.paused[peerId] || r.isWitness(peerId) || r.nextIndex[peerId] > lastLogId || r.nextIndex[peerId] <= r.snapshotMeta.LastIncludedId {
+			continue
+		}
 
-		// nextindex is leader next send's log entry
-		// if the nextIndex's log entry is empty -> heatbeat
-		// otherwise -> append entry
-
-		// TODO: (A.14) - send initial empty AppendEntries RPCs (heartbeat) to each server; repeat during idle periods to prevent election timeouts
-		// Hint: set `req` with the correct fields (entries, prevLogId, prevLogTerm can be ignored for heartbeat)
-		entries := r.getLogs(r.nextIndex[peerId])
-		req := &pb.AppendEntriesRequest{
-			Term:           r.currentTerm,
-			LeaderId:       r.id,
-			LeaderCommitId: r.commitIndex,
-			Entries:        entries,
-		}
-		// TODO: (B.6) - send AppendEntries RPC with log entries starting at nextIndex
-		// Hint: set `req` with the correct fields (entries, prevLogId and prevLogTerm MUST be set)
-		// Hint: use `getLog` to get specific log, `getLogs` to get all logs after and include the specific log Id
-		// Log: r.logger.Debug("send append entries", zap.Uint32("peer", peerId), zap.Any("request", req), zap.Int("entries", len(entries)))
-		if req.GetEntries() != nil {
-			req.PrevLogId = r.getLog(r.nextIndex[peerId] - 1).GetId()
-			req.PrevLogTerm = r.getLog(r.nextIndex[peerId] - 1).GetTerm()
+		r.sendAppendEntries(ctx, peerId, peer, appendEntriesResultCh)
+	}
+}
+
+// sendAppendEntries sends logs starting at the nextIndex of the peer, or a heartbeat if the peer has all logs
+func (r *Raft) sendAppendEntries(ctx context.Context, peerId uint32, peer Peer, appendEntriesResultCh chan *appendEntriesResult) {
+	lastLogId, lastLogTerm := r.getLastLog()
+
+	// nextindex is leader next send's log entry
+	// if the nextIndex's log entry is empty -> heatbeat
+	// otherwise -> append entry
+
+	// TODO: (A.14) - send initial empty AppendEntries RPCs (heartbeat) to each server; repeat during idle periods to prevent election timeouts
+	// Hint: set `req` with the correct fields (entries, prevLogId, prevLogTerm can be ignored for heartbeat)
+	req := &pb.AppendEntriesRequest{
+		Term:           r.currentTerm,
+		LeaderId:       r.id,
+		LeaderCommitId: r.commitIndex,
+		GroupId:        r.config.GroupId,
+		ClusterId:      r.config.ClusterId,
+	}
+	// TODO: (B.6) - send AppendEntries RPC with log entries starting at nextIndex
+	// Hint: set `req` with the correct fields (entries, prevLogId and prevLogTerm MUST be set)
+	// Hint: use `getLog` to get specific log, `getLogs` to get all logs after and include the specific log Id
+	// Log: r.logger.Debug("send append entries", zap.Uint32("peer", peerId), zap.Any("request", req), zap.Int("entries", len(entries)))
+	var entries []*pb.Entry
+	if r.isWitness(peerId) {
+		// witnesses store no logs, heartbeats only carry the term and the leader
+		req.PrevLogId = 0
+		req.PrevLogTerm = 0
+	} else if r.config.CommitOnlyHeartbeat && lastLogId != 0 && r.matchIndex[peerId] == lastLogId {
+		// the peer has all logs, only the commit index is carried
+		req.PrevLogId = lastLogId
+		req.PrevLogTerm = lastLogTerm
+	} else if entries = r.getLogs(r.nextIndex[peerId]); entries != nil {
+		// the rest of the logs are sent once the response arrives
+		if limit := r.config.MaxBatchSize; limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+		}
+		req.Entries = entries
+		req.PrevLogId = r.nextIndex[peerId] - 1
+		req.PrevLogTerm = r.getLogTerm(req.PrevLogId)
+	} else {
+		req.PrevLogId = 0
+		req.PrevLogTerm = 0
+	}
+	r.logger.Debug("send append entries", zap.Uint32("peer", peerId), zap.Any("request", req), zap.Int("entries", len(entries)))
+
+	// TODO: (A.14) & (B.6)
+	// Hint: modify the code to send `AppendEntries` RPCs in parallel
+	// send appendentry rpc request by the worker of the peer
+	submitted := r.submitRPC(r.workers, peerId, "AppendEntries", func() {
+		// the leadership is over
+		if ctx.Err() != nil {
+			return
+		}
+
+		rpcCtx, cancel := r.rpcContext(ctx)
+		defer cancel()
+
+		var resp *pb.AppendEntriesResponse
+		start := time.Now()
+		err := r.withRetry(rpcCtx, func() (err error) {
+			resp, err = peer.AppendEntries(rpcCtx, req)
+			return err
+		})
+		if err != nil {
+			r.logger.Error("fail to send AppendEntries RPC", zap.Error(err), zap.Uint32("peer", peerId))
 		} else {
-			req.PrevLogId = 0
-			req.PrevLogTerm = 0
-		}
-		r.logger.Debug("send append entries", zap.Uint32("peer", peerId), zap.Any("request", req), zap.Int("entries", len(entries)))
-
-		// TODO: (A.14) & (B.6)
-		// Hint: modify the code to send `AppendEntries` RPCs in parallel
-		// send appendentry rpc request
-		// wg.Add(1)
-		go func() {
-			// defer wg.Done()
-			resp, err := peer.AppendEntries(ctx, req)
-			if err != nil {
-				r.logger.Error("fail to send AppendEntries RPC", zap.Error(err), zap.Uint32("peer", peerId))
-				// connection issue, should not be handled
-				return
-			}
+			r.rtt.observe(time.Since(start))
+		}
 
-			// send this appendentry rpc's response to channel
-			appendEntriesResultCh <- &appendEntriesResult{
-				AppendEntriesResponse: resp,
-				req:                   req,
-				peerId:                peerId,
-			}
-		}()
+		// the result is always sent, so the logs can be sent again on failure
+		select {
+		case appendEntriesResultCh <- &appendEntriesResult{
+			AppendEntriesResponse: resp,
+			req:                   req,
+			peerId:                peerId,
+			err:                   err,
+		}:
+		case <-ctx.Done():
+		}
+	})
+	// the next heartbeat sends the latest logs again if the RPC is dropped
+	if !submitted {
+		return
 	}
-	// wg.Wait()
-	// close(appendEntriesResultCh)
+	r.replicating[peerId] = true
 }
 
 // 1. discover higher term change into follower
 // 2. success append entry rpc: update nextIndex[response server id] = itself + rpc.entry.length, matchIndex[response server id] = nextIndex[response server id] - 1
 // 2. fail append entry rpc: update nextIndex[response server id] = itself - 1, matchIndex[response server id] = itself
 // 3. handle commit
-func (r *Raft) handleAppendEntriesResult(result *appendEntriesResult) {
+func (r *Raft) handleAppendEntriesResult(ctx context.Context, result *appendEntriesResult) {
+	delete(r.replicating, result.peerId)
+
+	// the peer is removed while the RPC is in flight, its state must not be recreated
+	if _, ok := r.peers[result.peerId]; !ok || result.err != nil {
+		return
+	}
+
 	// TODO: (A.15) - if RPC request or response contains term T > currentTerm: set currentTerm = T, convert to follower
 	// Hint: use `toFollower` to convert to follower
 	// Log: r.logger.Info("receive new term on AppendEntries response, fallback to follower", zap.Uint32("peer", result.peerId))
 	if result.GetTerm() > r.currentTerm {
 		r.toFollower(result.GetTerm())
+		r.persistState(ctx)
 		r.logger.Info("receive new term on AppendEntries response, fallback to follower", zap.Uint32("peer", result.peerId))
+		return
+	}
+
+	// responses to requests sent in a previous term must not count towards the matchIndex of the current term
+	if result.req.GetTerm() != r.currentTerm {
+		r.logger.Info("ignore AppendEntries response of a previous term", zap.Uint32("peer", result.peerId),
+			zap.Uint64("requestTerm", result.req.GetTerm()))
+		return
+	}
+
+	r.lastContact[result.peerId] = time.Now()
+
+	// witnesses store no logs, their responses only keep the leadership
+	if result.GetWitness() {
+		return
 	}
 
+	r.mu.Lock()
+	r.appliedIndex[result.peerId] = result.GetLastApplied()
+	r.mu.Unlock()
+
 	// result update to leader
 	// matchIndex: in every server the lastest be replicated log entry index
 	entries := result.req.GetEntries()
@@ -524,23 +1453,60 @@ func (r *Raft) handleAppendEntriesResult(result *appendEntriesResult) {
 		// TODO: (B.7) - if AppendEntries fails because of log inconsistency: decrease nextIndex and retry
 		// Hint: use `setNextAndMatchIndex` to decrease nextIndex
 		// Log: logger.Info("append entries failed, decrease next index", zap.Uint64("nextIndex", nextIndex), zap.Uint64("matchIndex", matchIndex))
-		nextIndex := r.nextIndex[result.peerId] - 1
+		// retry from the previous log of the rejected request, responses of duplicated requests should not decrease it twice
+		nextIndex := r.nextIndex[result.peerId]
+		if prevLogId := result.req.GetPrevLogId(); prevLogId != 0 && prevLogId < nextIndex {
+			nextIndex = prevLogId
+		}
+		// skip logs the follower does not have at all
+		if lastLogId := result.GetLastLogId(); lastLogId+1 < nextIndex {
+			nextIndex = lastLogId + 1
+		}
 		matchIndex := r.matchIndex[result.peerId]
+		if lastLogId := result.GetLastLogId(); lastLogId < matchIndex {
+			r.logger.Warn("follower reports last log before the match index", zap.Uint32("peer", result.peerId),
+				zap.Uint64("lastLogId", lastLogId), zap.Uint64("matchIndex", matchIndex))
+			matchIndex = lastLogId
+		}
 		r.setNextAndMatchIndex(result.peerId, nextIndex, matchIndex)
 
 		r.logger.Info("append entries failed, decrease next index", zap.Uint64("nextIndex", nextIndex), zap.Uint64("matchIndex", matchIndex))
+	} else if lastLogId, replicatedId := result.GetLastLogId(), result.req.GetPrevLogId()+uint64(len(entries)); lastLogId < replicatedId {
+		// the follower claims to have the replicated logs but reports a shorter log, replicate again from its last log
+		matchIndex := r.matchIndex[result.peerId]
+		if lastLogId < matchIndex {
+			matchIndex = lastLogId
+		}
+		nextIndex := lastLogId + 1
+		r.setNextAndMatchIndex(result.peerId, nextIndex, matchIndex)
+		r.logger.Warn("follower reports last log before the replicated logs", zap.Uint32("peer", result.peerId),
+			zap.Uint64("lastLogId", lastLogId), zap.Uint64("replicatedId", replicatedId), zap.Uint64("nextIndex", nextIndex))
 	} else if len(entries) != 0 {
 		// TODO: (B.8) - if successful: update nextIndex and matchIndex for follower
 		// Hint: use `setNextAndMatchIndex` to update nextIndex and matchIndex
 		// Log: logger.Info("append entries successfully, set next index and match index", zap.Uint32("peer", result.peerId), zap.Uint64("nextIndex", nextIndex), zap.Uint64("matchIndex", matchIndex))
-		nextIndex := r.nextIndex[result.peerId] + uint64(len(result.req.GetEntries()))
-		matchIndex := nextIndex - 1
+		// compute from the request instead of the current nextIndex, since responses of duplicated requests may arrive
+		matchIndex := result.req.GetPrevLogId() + uint64(len(entries))
+		// responses of pipelined requests may arrive out of order, the matchIndex never decreases by an older one
+		if matchIndex <= r.matchIndex[result.peerId] {
+			r.logger.Debug("ignore stale append entries response", zap.Uint32("peer", result.peerId),
+				zap.Uint64("replicatedId", matchIndex), zap.Uint64("matchIndex", r.matchIndex[result.peerId]))
+			return
+		}
+		nextIndex := matchIndex + 1
 		r.setNextAndMatchIndex(result.peerId, nextIndex, matchIndex)
 		r.logger.Info("append entries successfully, set next index and match index", zap.Uint32("peer", result.peerId), zap.Uint64("nextIndex", nextIndex), zap.Uint64("matchIndex", matchIndex))
 	}
 
+	r.advanceCommitIndex()
+}
+
+// advanceCommitIndex commits logs that are replicated on the majority of servers, it runs on every AppendEntries
+// response, so logs are committed as soon as the response completing the majority arrives, witnesses count towards
+// the size of the majority but never towards the replicas, since they store no logs
+func (r *Raft) advanceCommitIndex() {
 	// commit log entry
-	majority := (len(r.peers) + 1) / 2
+	majority := r.numVoters() / 2
 	uncommitLogs := r.getLogs(r.commitIndex + 1) // all of not commit entry in leader
 	// find commit possible entry from highest entry
 	// its index bigger then commitIndex -> before commitIndex already commit
@@ -554,14 +1520,14 @@ func (r *Raft) handleAppendEntriesResult(result *appendEntriesResult) {
 		replicas := 1 // leader itself
 		// check every server
 		for serverId, _ := range r.peers {
-			if r.matchIndex[serverId] >= uncommitLogs[i].GetId() && uncommitLogs[i].GetTerm() == r.currentTerm {
+			if serverId != r.id && r.isVoter(serverId) && !r.isWitness(serverId) && r.matchIndex[serverId] >= uncommitLogs[i].GetId() && uncommitLogs[i].GetTerm() == r.currentTerm {
 				replicas++
 			}
 		}
 		// set commitId, apply commit entry to leader's state machine
 		if replicas > majority {
-			r.setCommitIndex(uncommitLogs[i].GetId())
-			r.applyLogs(r.applyCh)
+			r.commit(uncommitLogs[i].GetId())
+			r.applyCommittedLogs()
 			break
 		}
 	}
@@ -1,11 +1,24 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestInitialElection(t *testing.T) {
@@ -17,6 +30,50 @@ func TestInitialElection(t *testing.T) {
 	c.checkSingleLeader()
 }
 
+func TestElectChosenLeader(t *testing.T) {
+	numNodes := 3
+
+	for i := 1; i <= numNodes; i++ {
+		chosenId := uint32(i)
+
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c := newClusterWithConfig(t, numNodes, timeoutFirst(chosenId))
+			defer c.stopAll()
+
+			time.Sleep(1 * time.Second)
+
+			if leaderId, leaderTerm := c.checkSingleLeader(); leaderId != chosenId || leaderTerm != 1 {
+				t.Fatalf("server %d should be elected in term 1, got server %d in term %d", chosenId, leaderId, leaderTerm)
+			}
+		})
+	}
+}
+
+func TestElectionResultNotified(t *testing.T) {
+	numNodes := 3
+	chosenId := uint32(2)
+	electionResultCh := make(chan electionResult, numNodes)
+
+	c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		timeoutFirst(chosenId)(id, config)
+		config.electionResultCh = electionResultCh
+	})
+	defer c.stopAll()
+
+	select {
+	case result := <-electionResultCh:
+		if !result.won || result.term != 1 {
+			t.Fatalf("election of term 1 should be won, got %+v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("election result should be notified")
+	}
+
+	if leaderId, leaderTerm := c.checkSingleLeader(); leaderId != chosenId || leaderTerm != 1 {
+		t.Fatalf("server %d should be elected in term 1, got server %d in term %d", chosenId, leaderId, leaderTerm)
+	}
+}
+
 func TestElectionAfterLeaderDisconnect(t *testing.T) {
 	c := newCluster(t, 5)
 	defer c.stopAll()
@@ -67,6 +124,336 @@ func TestElectionAfterLeaderDisconnectLoop(t *testing.T) {
 	}
 }
 
+func TestElectionPriority(t *testing.T) {
+	numNodes := 5
+	preferredId := uint32(3)
+
+	c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		if id == preferredId {
+			config.ElectionPriority = 10
+		}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	oldId, _ := c.checkSingleLeader()
+
+	// only elections after losing another leader are counted, since the preferred server cannot win its own loss
+	elections, wins := 0, 0
+	for i := 0; i < 8 && elections < 4; i++ {
+		c.disconnectAll(oldId)
+		time.Sleep(1 * time.Second)
+		c.connectAll(oldId)
+
+		newId, _ := c.checkSingleLeader()
+		if oldId != preferredId {
+			elections++
+			if newId == preferredId {
+				wins++
+			}
+		}
+
+		oldId = newId
+	}
+
+	if elections == 0 || wins <= elections/2 {
+		t.Fatalf("server %d should win most elections, won %d of %d", preferredId, wins, elections)
+	}
+}
+
+// noElectionStrategy prevents the given server from ever starting elections, and counts how many times it is asked
+type noElectionStrategy struct {
+	serverId uint32
+	asked    int32
+}
+
+func (s *noElectionStrategy) ShouldStartElection(serverId uint32) bool {
+	if serverId != s.serverId {
+		return true
+	}
+
+	atomic.AddInt32(&s.asked, 1)
+	return false
+}
+
+func (s *noElectionStrategy) ComputeTimeout(minTimeout time.Duration) time.Duration {
+	return minTimeout + time.Duration(rand.Int63n(int64(minTimeout)))
+}
+
+func (s *noElectionStrategy) CountsTowardQuorum(serverId uint32) bool {
+	return true
+}
+
+func TestElectionStrategy(t *testing.T) {
+	strategy := &noElectionStrategy{serverId: 1}
+	c := newClusterWithConfig(t, 3, func(id uint32, config *Config) {
+		config.ElectionStrategy = strategy
+		// the server is always the first to notice the loss of the leader, so the strategy is asked every time
+		timeoutFirst(strategy.serverId)(id, config)
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, _ := c.checkSingleLeader()
+	for i := 0; i < 3; i++ {
+		if leaderId == strategy.serverId {
+			t.Fatalf("server %d should never start an election", strategy.serverId)
+		}
+
+		c.disconnectAll(leaderId)
+		time.Sleep(1 * time.Second)
+		c.connectAll(leaderId)
+
+		leaderId, _ = c.checkSingleLeader()
+	}
+	if leaderId == strategy.serverId {
+		t.Fatalf("server %d should never start an election", strategy.serverId)
+	}
+
+	if atomic.LoadInt32(&strategy.asked) == 0 {
+		t.Fatal("the strategy should be asked whether to start an election")
+	}
+}
+
+func TestWitness(t *testing.T) {
+	witnessId := uint32(3)
+	c := newClusterWithConfig(t, 3, func(id uint32, config *Config) {
+		config.Witnesses = map[uint32]bool{witnessId: true}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, leaderTerm := c.checkSingleLeader()
+	if leaderId == witnessId {
+		t.Fatal("witness should never be elected")
+	}
+	followerId := 3 - leaderId
+
+	// logs are committed across both full servers, the witness stores nothing
+	data1 := []byte("command 1")
+	log1Id := c.applyCommand(leaderId, leaderTerm, data1)
+	time.Sleep(500 * time.Millisecond)
+	c.checkLog(leaderId, log1Id, leaderTerm, data1)
+	c.checkLog(followerId, log1Id, leaderTerm, data1)
+
+	witness := c.rafts[witnessId]
+	witness.mu.Lock()
+	if len(witness.logs) != 0 || witness.commitIndex != 0 {
+		t.Fatalf("witness should store no logs, got %d logs and commit index %d", len(witness.logs), witness.commitIndex)
+	}
+	witness.mu.Unlock()
+
+	// the leader keeps its leadership with the witness, but the witness never counts towards the replication of logs
+	c.disconnectAll(followerId)
+	c.disconnect(leaderId, followerId)
+
+	log2Id := c.applyCommand(leaderId, leaderTerm, []byte("command 2"))
+	time.Sleep(500 * time.Millisecond)
+	if !c.rafts[leaderId].IsLeader() {
+		t.Fatalf("server %d should keep its leadership with the vote of the witness", leaderId)
+	}
+	if c.rafts[leaderId].IsCommitted(log2Id) {
+		t.Fatalf("log %d should not be committed without the other full server", log2Id)
+	}
+
+	c.connectAll(followerId)
+	c.connect(leaderId, followerId)
+	time.Sleep(1 * time.Second)
+
+	leaderId, leaderTerm = c.checkSingleLeader()
+	if leaderId == witnessId {
+		t.Fatal("witness should never be elected")
+	}
+
+	data3 := []byte("command 3")
+	log3Id := c.applyCommand(leaderId, leaderTerm, data3)
+	time.Sleep(500 * time.Millisecond)
+	for _, id := range []uint32{1, 2} {
+		c.checkLog(id, log3Id, leaderTerm, data3)
+	}
+}
+
+func TestSeededElection(t *testing.T) {
+	numNodes := 3
+
+	// each server draws its timeouts from its own seeded source, so the server with the earliest timeout wins
+	elect := func() (uint32, uint64) {
+		c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+			config.Rand = rand.New(rand.NewSource(int64(id)))
+		})
+		defer c.stopAll()
+
+		time.Sleep(1 * time.Second)
+
+		return c.checkSingleLeader()
+	}
+
+	leaderId, term := elect()
+	for i := 0; i < 2; i++ {
+		if id, tm := elect(); id != leaderId || tm != term {
+			t.Fatalf("seeded elections should have the same outcome, expect leader %d in term %d, got leader %d in term %d",
+				leaderId, term, id, tm)
+		}
+	}
+}
+
+func TestSeededRandomTimeout(t *testing.T) {
+	// a source shared among servers is safe to use concurrently
+	shared := rand.New(rand.NewSource(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		r := NewRaft(uint32(i+1), map[uint32]Peer{}, newPersister(), &Config{Rand: shared}, zap.NewNop())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.int63n(100)
+			}
+		}()
+	}
+	wg.Wait()
+
+	r1 := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{Rand: rand.New(rand.NewSource(7))}, zap.NewNop())
+	r2 := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{Rand: rand.New(rand.NewSource(7))}, zap.NewNop())
+	for i := 0; i < 10; i++ {
+		if n1, n2 := r1.int63n(int64(time.Second)), r2.int63n(int64(time.Second)); n1 != n2 {
+			t.Fatalf("identically seeded servers should draw the same timeouts, got %d and %d", n1, n2)
+		}
+	}
+}
+
+func TestIsLeader(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	checkIsLeader := func(leaderId uint32) {
+		t.Helper()
+
+		for id, r := range c.rafts {
+			if id == leaderId {
+				continue
+			}
+			if r.IsLeader() {
+				t.Fatalf("server %d should not be the leader, the leader is %d", id, leaderId)
+			}
+		}
+		if !c.rafts[leaderId].IsLeader() {
+			t.Fatalf("server %d should be the leader", leaderId)
+		}
+	}
+
+	oldId, _ := c.checkSingleLeader()
+	checkIsLeader(oldId)
+
+	// the old leader steps down once it learns about the new leader
+	c.disconnectAll(oldId)
+	time.Sleep(1 * time.Second)
+	c.connectAll(oldId)
+	time.Sleep(1 * time.Second)
+
+	newId, _ := c.checkSingleLeader()
+	if newId == oldId {
+		t.Fatalf("a new leader should be elected after server %d is disconnected", oldId)
+	}
+	checkIsLeader(newId)
+}
+
+func TestSparseIds(t *testing.T) {
+	ids := []uint32{10, 42, 7}
+
+	c := newClusterWithIds(t, ids, nil)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, term := c.checkSingleLeader()
+
+	data := []byte("command")
+	logId := c.applyCommand(leaderId, term, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for _, id := range ids {
+		c.checkLog(id, logId, term, data)
+	}
+
+	// a new leader is elected among the remaining servers
+	c.disconnectAll(leaderId)
+	time.Sleep(1 * time.Second)
+
+	newId, newTerm := c.getCurrentLeader()
+	if newId == leaderId || newTerm <= term {
+		t.Fatalf("a new leader should be elected after server %d is disconnected, got leader %d in term %d", leaderId, newId, newTerm)
+	}
+}
+
+func TestInvalidPeerIds(t *testing.T) {
+	for name, tc := range map[string]struct {
+		id    uint32
+		peers map[uint32]Peer
+	}{
+		"server ID 0": {0, map[uint32]Peer{1: &peer{}}},
+		"peer ID 0":   {1, map[uint32]Peer{0: &peer{}, 2: &peer{}}},
+		"own ID":      {1, map[uint32]Peer{1: &peer{}, 2: &peer{}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if err, ok := recover().(error); !ok || !errors.Is(err, errInvalidPeerId) {
+					t.Fatal("NewRaft should panic with invalid peer ID, got:", err)
+				}
+			}()
+
+			NewRaft(tc.id, tc.peers, newPersister(), &Config{}, zap.NewNop())
+		})
+	}
+}
+
+func TestNoRPCToSelf(t *testing.T) {
+	var self, other rpcCounts
+	peers := map[uint32]Peer{2: countRPCs(&other, 0), 3: countRPCs(&rpcCounts{}, 0)}
+	r := NewRaft(1, peers, newPersister(), &Config{MaxBatchSize: 1}, zap.NewNop())
+	defer r.workers.stop()
+
+	// the peers map is misconfigured with the server itself after the server is created
+	peers[1] = countRPCs(&self, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r.toCandidate()
+	r.broadcastRequestVote(ctx, make(chan *voteResult, len(peers)))
+
+	r.toLeader(r.peers)
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	r.replicateLogs(ctx, make(chan *appendEntriesResult, len(peers)), nil)
+	r.broadcastAppendEntries(ctx, make(chan *appendEntriesResult, len(peers)), nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if calls := self.total(); calls != 0 {
+		t.Fatalf("server should never send RPCs to itself, got %d RPCs", calls)
+	}
+	if calls := other.total(); calls == 0 {
+		t.Fatal("RPCs should be sent to other peers")
+	}
+
+	// the server itself is not counted as a replica twice
+	r.matchIndex[1] = 1
+	r.advanceCommitIndex()
+	if r.commitIndex != 0 {
+		t.Fatalf("log should not be committed by the leader alone, got commit index %d", r.commitIndex)
+	}
+}
+
 func TestFollowerDisconnect(t *testing.T) {
 	numNodes := 5
 
@@ -425,12 +812,4068 @@ func TestCannotCommitLogIfTermMismatch(t *testing.T) {
 	}
 }
 
-func randomPeerId(serverId uint32, numNodes int) uint32 {
-	peerId := serverId
+func TestSingleNodeCluster(t *testing.T) {
+	c := newCluster(t, 1)
+	defer c.stopAll()
 
-	for peerId == serverId {
-		peerId = rand.Uint32()%uint32(numNodes) + 1
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	data := []byte("command 1")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := c.rafts[leaderId].WaitForCommit(ctx, logId); err != nil {
+		t.Fatal("log should be committed by the single node:", err)
 	}
 
-	return peerId
+	time.Sleep(100 * time.Millisecond)
+	c.checkLog(leaderId, logId, leaderTerm, data)
+}
+
+func TestJoinCluster(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	data1 := []byte("command 1")
+	log1Id := c.applyCommand(leaderId, leaderTerm, data1)
+
+	// the new node contacts a follower, which hints the leader
+	newId := uint32(numNodes + 1)
+	c.join(newId, randomPeerId(leaderId, numNodes))
+
+	data2 := []byte("command 2")
+	log2Id := c.applyCommand(leaderId, leaderTerm, data2)
+
+	time.Sleep(1 * time.Second)
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("joining the cluster should not affect the current leader")
+	}
+
+	// logs before and after joining are both replicated to the new node
+	for i := 1; i <= numNodes+1; i++ {
+		id := uint32(i)
+		c.checkLog(id, log1Id, leaderTerm, data1)
+		c.checkLog(id, log2Id, leaderTerm, data2)
+	}
+
+	for id, raft := range c.rafts {
+		raft.mu.Lock()
+		if _, ok := raft.configuration[newId]; !ok || len(raft.configuration) != numNodes+1 {
+			t.Fatalf("server %d should have the new node in its configuration", id)
+		}
+		raft.mu.Unlock()
+
+		// the configuration is committed along with the log after it
+		if members := raft.Configuration(); len(members) != numNodes+1 {
+			t.Fatalf("server %d should have the new node in its committed configuration, got %v", id, members)
+		}
+	}
+}
+
+// closablePeer is a mockPeer recording whether it is closed
+type closablePeer struct {
+	*mockPeer
+	closed bool
+}
+
+func (p *closablePeer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestJoinClusterClosesDialedPeers(t *testing.T) {
+	// the given peer hints server 2, which hints server 3, which is the leader
+	redirectTo := func(leaderId uint32) *closablePeer {
+		return &closablePeer{mockPeer: &mockPeer{
+			addServerFunc: func(ctx context.Context, in *pb.AddServerRequest) (*pb.AddServerResponse, error) {
+				return &pb.AddServerResponse{LeaderId: leaderId, LeaderAddress: fmt.Sprintf("server-%d", leaderId)}, nil
+			},
+		}}
+	}
+	via := redirectTo(2)
+	dialed := map[string]*closablePeer{
+		"server-2": redirectTo(3),
+		"server-3": {mockPeer: &mockPeer{
+			addServerFunc: func(ctx context.Context, in *pb.AddServerRequest) (*pb.AddServerResponse, error) {
+				return &pb.AddServerResponse{Success: true, LeaderId: 3, LeaderAddress: "server-3"}, nil
+			},
+		}},
+	}
+	dialPeer := func(addr string) (Peer, error) {
+		// the previously dialed peer is closed before dialing the next one
+		for prev, p := range dialed {
+			if prev < addr && !p.closed {
+				t.Fatalf("peer to %s should be closed before dialing %s", prev, addr)
+			}
+		}
+		return dialed[addr], nil
+	}
+
+	r := NewRaft(4, map[uint32]Peer{}, newPersister(), &Config{Address: "server-4", DialPeer: dialPeer}, zap.NewNop())
+	if err := r.JoinCluster(context.Background(), via); err != nil {
+		t.Fatal("fail to join cluster:", err)
+	}
+
+	for addr, p := range dialed {
+		if !p.closed {
+			t.Fatalf("peer to %s should be closed after joining", addr)
+		}
+	}
+	if via.closed {
+		t.Fatal("the given peer should be left to the caller")
+	}
+}
+
+func TestJoinAsVoterReducesAvailability(t *testing.T) {
+	tests := []struct {
+		name      string
+		join      func(c *cluster, serverId, viaId uint32)
+		committed bool
+	}{
+		// 4 voters need 3 of them to commit, the leader and a follower are not enough
+		{name: "voter", join: (*cluster).join, committed: false},
+		// the learner does not count, 3 voters need 2 of them
+		{name: "learner", join: (*cluster).joinAsLearner, committed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			numNodes := 3
+
+			c := newCluster(t, numNodes)
+			defer c.stopAll()
+
+			time.Sleep(1 * time.Second)
+			leaderId, _ := c.checkSingleLeader()
+
+			newId := uint32(numNodes + 1)
+			tt.join(c, newId, leaderId)
+			time.Sleep(500 * time.Millisecond)
+
+			// the new server fails before catching up, and so does a follower
+			c.stop(newId)
+			c.stop(randomPeerId(leaderId, numNodes))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			leader := c.rafts[leaderId]
+			resp, err := leader.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte("command")})
+			if err == nil {
+				err = leader.WaitForCommit(ctx, resp.GetEntry().GetId())
+			}
+			if committed := err == nil; committed != tt.committed {
+				t.Fatalf("expect committed %v after the joiner and a follower fail, got error %v", tt.committed, err)
+			}
+		})
+	}
+}
+
+func TestCrossClusterRequestsRejected(t *testing.T) {
+	numNodes := 3
+
+	// two clusters with the same server IDs share the network
+	clusterOf := func(clusterId string) func(id uint32, config *Config) {
+		return func(id uint32, config *Config) {
+			config.ClusterId = clusterId
+		}
+	}
+	a := newClusterWithConfig(t, numNodes, clusterOf("a"))
+	defer a.stopAll()
+	b := newClusterWithConfig(t, numNodes, clusterOf("b"))
+	defer b.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := a.checkSingleLeader()
+	bLeaderId, _ := b.checkSingleLeader()
+
+	// a server of cluster b reaches the leader of cluster a by mistake
+	bLeader := b.rafts[bLeaderId]
+	via, err := NewGRPCPeer(a.listerers[leaderId].Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := via.AppendEntries(ctx, &pb.AppendEntriesRequest{Term: leaderTerm + 1, LeaderId: bLeaderId,
+		ClusterId: bLeader.config.ClusterId}); err == nil {
+		t.Fatal("AppendEntries from another cluster should be rejected")
+	}
+	if _, err := via.RequestVote(ctx, &pb.RequestVoteRequest{Term: leaderTerm + 1, CandidateId: bLeaderId,
+		ClusterId: bLeader.config.ClusterId}); err == nil {
+		t.Fatal("RequestVote from another cluster should be rejected")
+	}
+
+	// a new server of cluster b cannot join cluster a
+	newId := uint32(numNodes + 1)
+	joining := NewRaft(newId, map[uint32]Peer{}, newPersister(), &Config{ClusterId: "b", Address: "localhost:0"}, zap.NewNop())
+	if err := joining.JoinCluster(ctx, via); err == nil {
+		t.Fatal("server of another cluster should not join")
+	}
+
+	// membership changes meant for cluster b are rejected
+	leader := a.rafts[leaderId]
+	followerId := leaderId%uint32(numNodes) + 1
+	if _, err := leader.RemoveServer(ctx, &pb.RemoveServerRequest{ServerId: followerId, ClusterId: bLeader.config.ClusterId}); !errors.Is(err, errClusterMismatch) {
+		t.Fatal("RemoveServer from another cluster should be rejected, got error:", err)
+	}
+	if _, err := leader.PromoteLearner(ctx, &pb.PromoteLearnerRequest{ServerId: followerId, ClusterId: bLeader.config.ClusterId}); !errors.Is(err, errClusterMismatch) {
+		t.Fatal("PromoteLearner from another cluster should be rejected, got error:", err)
+	}
+
+	if nowId, nowTerm := a.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatalf("requests from another cluster should not affect leader %d in term %d, got leader %d in term %d",
+			leaderId, leaderTerm, nowId, nowTerm)
+	}
+	for id, raft := range a.rafts {
+		if members := raft.Configuration(); len(members) != numNodes {
+			t.Fatalf("server %d should not have servers of another cluster in its configuration, got %v", id, members)
+		}
+	}
+}
+
+func TestRemoveServerBreakingQuorum(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	// isolate a follower, so it is not active anymore
+	lostId := randomPeerId(leaderId, numNodes)
+	c.disconnectAll(lostId)
+	for id := range c.rafts {
+		if id != lostId {
+			c.disconnect(id, lostId)
+		}
+	}
+
+	c.applyCommand(leaderId, leaderTerm, []byte("command 1"))
+
+	time.Sleep(500 * time.Millisecond)
+
+	var aliveId uint32
+	for id := range c.rafts {
+		if id != leaderId && id != lostId {
+			aliveId = id
+		}
+	}
+
+	// only the leader is active in the configuration without the alive follower
+	if _, err := c.removeServer(leaderId, aliveId); !errors.Is(err, errUnsafeRemoval) {
+		t.Fatalf("removing the alive follower should be rejected, got error: %v", err)
+	}
+
+	if _, err := c.removeServer(leaderId, lostId); err != nil {
+		t.Fatal("fail to remove the lost follower:", err)
+	}
+	c.stop(lostId)
+
+	// the next change waits for the removal to be committed
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err := c.removeServer(leaderId, aliveId); err != nil {
+		t.Fatal("fail to remove the alive follower:", err)
+	}
+	c.stop(aliveId)
+
+	if _, err := c.removeServer(leaderId, leaderId); !errors.Is(err, errUnsafeRemoval) {
+		t.Fatalf("removing the last server should be rejected, got error: %v", err)
+	}
+
+	raft := c.rafts[leaderId]
+	raft.mu.Lock()
+	if _, ok := raft.configuration[leaderId]; !ok || len(raft.configuration) != 1 {
+		t.Fatal("the leader should be the only member in the configuration")
+	}
+	raft.mu.Unlock()
+}
+
+func TestRemoveLeader(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	oldLeaderId, oldLeaderTerm := c.checkSingleLeader()
+
+	c.applyCommand(oldLeaderId, oldLeaderTerm, []byte("command 1"))
+
+	time.Sleep(200 * time.Millisecond)
+
+	// the leader transfers its leadership instead of removing itself
+	resp, err := c.removeServer(oldLeaderId, oldLeaderId)
+	if err != nil {
+		t.Fatal("fail to remove the leader:", err)
+	}
+	if resp.GetSuccess() || resp.GetLeaderId() == oldLeaderId || resp.GetLeaderId() == 0 {
+		t.Fatal("the leader should transfer its leadership and hint the new leader")
+	}
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, leaderTerm := c.checkSingleLeader()
+	if leaderId != resp.GetLeaderId() || leaderTerm <= oldLeaderTerm {
+		t.Fatal("the hinted server should become the new leader")
+	}
+
+	resp, err = c.removeServer(leaderId, oldLeaderId)
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to remove the old leader:", err)
+	}
+	c.stop(oldLeaderId)
+
+	data := []byte("command 2")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(1 * time.Second)
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("removing the old leader should not affect the new leader")
+	}
+
+	for id, raft := range c.rafts {
+		c.checkLog(id, logId, leaderTerm, data)
+
+		raft.mu.Lock()
+		if _, ok := raft.configuration[oldLeaderId]; ok || len(raft.configuration) != numNodes-1 {
+			t.Fatalf("server %d should not have the old leader in its configuration", id)
+		}
+		raft.mu.Unlock()
+	}
+}
+
+// newLeader turns the server into the leader of the given term as if it won the election of the term,
+// which must be newer than the current term of the server
+func newLeader(t testing.TB, r *Raft, term uint64) {
+	t.Helper()
+
+	r.toFollower(term - 1)
+	r.toCandidate()
+	r.voteFor(r.id, true)
+	if !r.toLeader(r.peers) || r.currentTerm != term {
+		t.Fatalf("server %d should become the leader of term %d, got %v of term %d", r.id, term, r.state, r.currentTerm)
+	}
+}
+
+func TestTransferLeadershipToMostUpToDate(t *testing.T) {
+	peers, reqChs := recordTimeoutNow(2, 3, 4)
+	config := &Config{HeartbeatTimeout: 1 * time.Second, ElectionTimeout: 1 * time.Second}
+	r := NewRaft(1, peers, newPersister(), config, zap.NewNop())
+
+	if _, err := r.handleTransferLeadership(&transferLeadershipRequest{}); !errors.Is(err, errNotLeader) {
+		t.Fatal("follower should not transfer leadership, got error:", err)
+	}
+
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}, {Id: 4, Term: 1}, {Id: 5, Term: 1}})
+	newLeader(t, r, 1)
+	r.lastContact[2] = time.Now()
+	r.lastContact[3] = time.Now()
+
+	// the inactive server 4 is never chosen even though it has all logs
+	r.setNextAndMatchIndex(2, 4, 3)
+	r.setNextAndMatchIndex(3, 5, 4)
+	r.setNextAndMatchIndex(4, 6, 5)
+	if _, err := r.handleTransferLeadership(&transferLeadershipRequest{}); !errors.Is(err, errNoTransferTarget) {
+		t.Fatal("leadership should not be transferred to a server not caught up, got error:", err)
+	}
+
+	r.setNextAndMatchIndex(3, 6, 5)
+	resp, err := r.handleTransferLeadership(&transferLeadershipRequest{})
+	if err != nil {
+		t.Fatal("fail to transfer leadership:", err)
+	}
+	if resp.targetId != 3 {
+		t.Fatalf("leadership should be transferred to the most up-to-date server 3, got %d", resp.targetId)
+	}
+	if req := <-reqChs[3]; req.GetTerm() != r.currentTerm || req.GetLeaderId() != 1 {
+		t.Fatalf("target should receive TimeoutNow of the current term, got %v", req)
+	}
+}
+
+func TestTimeoutNow(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{HeartbeatTimeout: 10 * time.Second}, zap.NewNop())
+
+	r.toFollower(2)
+	r.setLeader(2)
+	r.lastHeartbeat = time.Now()
+
+	if _, err := r.timeoutNow(&pb.TimeoutNowRequest{Term: 1, LeaderId: 2}); err != nil || r.state != Follower {
+		t.Fatal("TimeoutNow of an older term should be rejected:", err)
+	}
+	if _, err := r.timeoutNow(&pb.TimeoutNowRequest{Term: 2, LeaderId: 3}); err != nil || r.state != Follower {
+		t.Fatal("TimeoutNow not from the current leader should be rejected:", err)
+	}
+
+	// the follower starts an election right away, although the heartbeat timeout is far from elapsed
+	resp, err := r.timeoutNow(&pb.TimeoutNowRequest{Term: 2, LeaderId: 2})
+	if err != nil {
+		t.Fatal("fail to handle TimeoutNow:", err)
+	}
+	if r.state != Candidate || resp.GetTerm() != 2 {
+		t.Fatalf("expect the follower to become candidate in term 2, got %v in term %d", r.state, resp.GetTerm())
+	}
+}
+
+func TestApplyCommandTooLarge(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}}, newPersister(), &Config{MaxCommandSize: 64}, zap.NewNop())
+
+	newLeader(t, r, 1)
+
+	// the command data alone fits the limit, but not with the framing of the log
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: bytes.Repeat([]byte("x"), 64)}); !errors.Is(err, ErrCommandTooLarge) {
+		t.Fatalf("expect ErrCommandTooLarge, got %v", err)
+	}
+	if lastLogId, _ := r.getLastLog(); lastLogId != 0 {
+		t.Fatalf("the oversized command should not be appended, got last log %d", lastLogId)
+	}
+
+	resp, err := r.applyCommand(&pb.ApplyCommandRequest{Data: bytes.Repeat([]byte("x"), 32)})
+	if err != nil {
+		t.Fatal("fail to apply command within the limit:", err)
+	}
+	if resp.GetEntry().GetId() != 1 {
+		t.Fatalf("expect the command appended as log 1, got %d", resp.GetEntry().GetId())
+	}
+}
+
+func TestApplyCommandOverInflightLimit(t *testing.T) {
+	config := &Config{MaxInflight: 3, ApplyFunc: func(*pb.Entry) error { return nil }}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), config, zap.NewNop())
+
+	newLeader(t, r, 1)
+
+	// peers do not acknowledge any log, commands above the limit are shed
+	shed := 0
+	for i := 0; i < 10; i++ {
+		_, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")})
+		if errors.Is(err, ErrTooManyRequests) {
+			shed++
+		} else if err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+	}
+	if lastLogId, _ := r.getLastLog(); lastLogId != 3 || shed != 7 {
+		t.Fatalf("expect 3 logs appended and 7 commands shed, got %d logs and %d shed", lastLogId, shed)
+	}
+
+	// commands are admitted again once replication catches up
+	logs := r.getLogs(1)
+	r.handleAppendEntriesResult(context.Background(), &appendEntriesResult{
+		AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: true, LastLogId: 3},
+		req:                   &pb.AppendEntriesRequest{Term: 1, Entries: logs},
+		peerId:                2,
+	})
+	if r.commitIndex != 3 {
+		t.Fatalf("expect commit index 3, got %d", r.commitIndex)
+	}
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("command should be admitted once logs are committed:", err)
+	}
+}
+
+func TestTimeoutNowRetriedByWorker(t *testing.T) {
+	var calls int32
+	reqCh := make(chan *pb.TimeoutNowRequest, 1)
+	target := &mockPeer{
+		timeoutNowFunc: func(ctx context.Context, in *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return nil, status.Error(codes.Unavailable, "connection reset")
+			}
+
+			reqCh <- in
+			return &pb.TimeoutNowResponse{Term: in.GetTerm()}, nil
+		},
+	}
+	config := &Config{HeartbeatTimeout: 1 * time.Second, ElectionTimeout: 1 * time.Second, RPCRetries: 1}
+	r := NewRaft(1, map[uint32]Peer{2: target}, newPersister(), config, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(t, r, 1)
+	r.lastContact[2] = time.Now()
+
+	if _, err := r.handleTransferLeadership(&transferLeadershipRequest{}); err != nil {
+		t.Fatal("fail to transfer leadership:", err)
+	}
+
+	// the TimeoutNow RPC failed with a transient error is retried
+	select {
+	case req := <-reqCh:
+		if req.GetTerm() != r.currentTerm {
+			t.Fatalf("target should receive TimeoutNow of the current term, got %v", req)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("TimeoutNow RPC should be retried")
+	}
+}
+
+func TestApplyCommandDuringLeadershipTransfer(t *testing.T) {
+	peers, reqChs := recordTimeoutNow(2, 3)
+	config := &Config{HeartbeatTimeout: 1 * time.Second, ElectionTimeout: 100 * time.Millisecond}
+	r := NewRaft(1, peers, newPersister(), config, zap.NewNop())
+
+	newLeader(t, r, 1)
+	r.lastContact[2] = time.Now()
+	r.lastContact[3] = time.Now()
+
+	resp, err := r.removeServer(&pb.RemoveServerRequest{ServerId: 1})
+	if err != nil || resp.GetSuccess() {
+		t.Fatalf("the leader should transfer its leadership, got response %v, err %v", resp, err)
+	}
+	<-reqChs[resp.GetLeaderId()]
+
+	// commands are redirected to the target while the transfer is in progress
+	_, err = r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")})
+	if !errors.Is(err, ErrLeadershipTransferInProgress) {
+		t.Fatal("command should be rejected during leadership transfer, got error:", err)
+	}
+	var transferErr *LeadershipTransferError
+	if !errors.As(err, &transferErr) || transferErr.TargetId != resp.GetLeaderId() {
+		t.Fatalf("error should hint the target %d, got %v", resp.GetLeaderId(), err)
+	}
+
+	// the transfer is abandoned once the target does not take over within the election timeout
+	time.Sleep(2 * config.ElectionTimeout)
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("command should be accepted after the transfer is abandoned, got error:", err)
+	}
+}
+
+func TestAbortLeadershipTransfer(t *testing.T) {
+	// the targets are unreachable, TimeoutNow RPCs sent to them always fail
+	unreachable := &mockPeer{
+		timeoutNowFunc: func(ctx context.Context, in *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+			return nil, status.Error(codes.Unavailable, "connection refused")
+		},
+	}
+	config := &Config{HeartbeatTimeout: 1 * time.Second, ElectionTimeout: 1 * time.Second}
+	r := NewRaft(1, map[uint32]Peer{2: unreachable, 3: unreachable}, newPersister(), config, zap.NewNop())
+	defer r.workers.stop()
+
+	if _, err := r.abortLeadershipTransfer(&abortLeadershipTransferRequest{}); !errors.Is(err, errNotLeader) {
+		t.Fatal("follower should not abort leadership transfer, got error:", err)
+	}
+
+	newLeader(t, r, 1)
+	r.lastContact[2] = time.Now()
+	r.lastContact[3] = time.Now()
+
+	// the leader removing itself transfers its leadership to a target that never takes over
+	resp, err := r.removeServer(&pb.RemoveServerRequest{ServerId: 1})
+	if err != nil || resp.GetSuccess() {
+		t.Fatalf("the leader should transfer its leadership, got response %v, err %v", resp, err)
+	}
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); !errors.Is(err, ErrLeadershipTransferInProgress) {
+		t.Fatal("command should be rejected during leadership transfer, got error:", err)
+	}
+
+	// commands are accepted right after the transfer is aborted, without waiting for the election timeout
+	if _, err := r.abortLeadershipTransfer(&abortLeadershipTransferRequest{}); err != nil {
+		t.Fatal("fail to abort leadership transfer:", err)
+	}
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("command should be accepted after the transfer is aborted, got error:", err)
+	}
+	if r.state != Leader {
+		t.Fatal("the leader should keep its leadership after the transfer is aborted")
+	}
+
+	// aborting without a transfer in progress does nothing
+	if _, err := r.abortLeadershipTransfer(&abortLeadershipTransferRequest{}); err != nil {
+		t.Fatal("aborting without a transfer in progress should succeed, got error:", err)
+	}
+}
+
+func TestRequestVoteWithEqualLog(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, nil, &Config{}, zap.NewNop())
+	r.toFollower(2)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 2}})
+
+	// the candidate with the exactly same last log should be granted
+	resp, err := r.requestVote(&pb.RequestVoteRequest{Term: 3, CandidateId: 2, LastLogId: 2, LastLogTerm: 2})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if !resp.GetVoteGranted() || r.votedFor != 2 {
+		t.Fatal("vote should be granted to the candidate with equal log")
+	}
+
+	// the candidate with shorter log in the same term should be rejected
+	resp, err = r.requestVote(&pb.RequestVoteRequest{Term: 4, CandidateId: 3, LastLogId: 1, LastLogTerm: 2})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if resp.GetVoteGranted() {
+		t.Fatal("vote should not be granted to the candidate with shorter log")
+	}
+}
+
+func TestCommitIndexClampedAfterTruncation(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{
+		Term:     1,
+		LeaderId: 2,
+		Entries:  []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}, {Id: 4, Term: 1}},
+	})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+
+	// the new leader truncates the uncommitted logs 3 and 4, and claims a commit index beyond the follower's log
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{
+		Term:           2,
+		LeaderId:       3,
+		PrevLogId:      2,
+		PrevLogTerm:    1,
+		Entries:        []*pb.Entry{{Id: 3, Term: 2}},
+		LeaderCommitId: 10,
+	})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append conflicting entries:", err)
+	}
+	if r.commitIndex != 3 || r.lastApplied != 3 {
+		t.Fatalf("expect commit index and last applied 3, got %d and %d", r.commitIndex, r.lastApplied)
+	}
+
+	// the commit index is clamped even if it is set beyond the last log directly
+	r.setCommitIndex(10)
+	if r.commitIndex != 3 {
+		t.Fatalf("commit index should be clamped to the last log 3, got %d", r.commitIndex)
+	}
+	if err := r.applyLogs(func(*pb.Entry) error { return nil }); err != nil || r.lastApplied != 3 {
+		t.Fatalf("logs beyond the last log should not be applied, last applied %d: %v", r.lastApplied, err)
+	}
+}
+
+func TestWaitForCommitLeadershipLost(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	numLogs := 3
+	errCh := make(chan error, numLogs)
+	for i := 1; i <= numLogs; i++ {
+		resp, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command " + strconv.Itoa(i))})
+		if err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+
+		go func(id uint64) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			errCh <- r.WaitForCommit(ctx, id)
+		}(resp.GetEntry().GetId())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// step down by the leader of a newer term
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 2})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+
+	for i := 1; i <= numLogs; i++ {
+		if err := <-errCh; !errors.Is(err, ErrLeadershipLost) {
+			t.Fatalf("waiter should fail with leadership lost, got error: %v", err)
+		}
+	}
+}
+
+func TestCommittedEntryOverwritten(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	resp, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")})
+	if err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	entry := resp.GetEntry()
+	if entry.GetId() != 1 || entry.GetTerm() != 1 {
+		t.Fatalf("expect entry 1 in term 1, got entry %d in term %d", entry.GetId(), entry.GetTerm())
+	}
+	if r.Committed(entry) {
+		t.Fatal("entry should not be committed before it is replicated")
+	}
+
+	// the new leader overwrites the log at the same index and commits it
+	newEntry := &pb.Entry{Id: 1, Term: 2, Data: []byte("other command")}
+	appendResp, err := r.appendEntries(&pb.AppendEntriesRequest{
+		Term:           2,
+		LeaderId:       2,
+		LeaderCommitId: 1,
+		Entries:        []*pb.Entry{newEntry},
+	})
+	if err != nil || !appendResp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+
+	if !r.IsCommitted(entry.GetId()) {
+		t.Fatalf("log %d should be committed", entry.GetId())
+	}
+	if r.Committed(entry) {
+		t.Fatal("overwritten entry should not be committed")
+	}
+	if !r.Committed(newEntry) {
+		t.Fatal("entry of the new leader should be committed")
+	}
+}
+
+func TestApplyOnEmptyHeartbeat(t *testing.T) {
+	var applied []uint64
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{
+		ApplyFunc: func(log *pb.Entry) error {
+			applied = append(applied, log.GetId())
+			return nil
+		},
+	}, zap.NewNop())
+
+	// the follower catches up before the leader commits the entry
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{
+		Term:     1,
+		LeaderId: 2,
+		Entries:  []*pb.Entry{{Id: 1, Term: 1, Data: []byte("command")}},
+	})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("entry should not be applied before it is committed, got applied logs %v", applied)
+	}
+
+	// the next heartbeat carries no entries but the advanced commit index
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{
+		Term:           1,
+		LeaderId:       2,
+		LeaderCommitId: 1,
+		PrevLogId:      1,
+		PrevLogTerm:    1,
+	})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	if r.commitIndex != 1 || len(applied) != 1 || applied[0] != 1 {
+		t.Fatalf("expect log 1 applied on the heartbeat, got commit index %d and applied logs %v", r.commitIndex, applied)
+	}
+}
+
+func TestApplyFuncCallsRaft(t *testing.T) {
+	var r *Raft
+	leaders := make(chan uint32, 1)
+	r = NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{
+		ApplyFunc: func(log *pb.Entry) error {
+			// the state machine may query raft while applying logs
+			if r.IsLeader() {
+				return errors.New("follower should not be the leader")
+			}
+			leaders <- r.LeaderId()
+			return nil
+		},
+	}, zap.NewNop())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.appendEntries(&pb.AppendEntriesRequest{
+			Term:           1,
+			LeaderId:       2,
+			LeaderCommitId: 1,
+			Entries:        []*pb.Entry{{Id: 1, Term: 1, Data: []byte("command")}},
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("fail to append entries:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ApplyFunc calling raft should not deadlock")
+	}
+
+	if leaderId := <-leaders; leaderId != 2 || r.lastApplied != 1 {
+		t.Fatalf("expect log 1 applied with leader 2, got leader %d and last applied %d", leaderId, r.lastApplied)
+	}
+}
+
+func TestApplyCommandStaleLeadershipEpoch(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	// the client connects to the leader
+	epoch := r.LeadershipEpoch()
+
+	// the leader steps down and is elected again before the client submits the command
+	r.toFollower(2)
+	if _, err := r.ApplyCommand(context.Background(), &pb.ApplyCommandRequest{Data: []byte("command"),
+		LeadershipEpoch: epoch}); !errors.Is(err, ErrLeadershipLost) {
+		t.Fatalf("expect %v after stepping down, got %v", ErrLeadershipLost, err)
+	}
+
+	newLeader(t, r, 3)
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command"), LeadershipEpoch: epoch}); !errors.Is(err, ErrLeadershipLost) {
+		t.Fatalf("expect %v against the previous leadership, got %v", ErrLeadershipLost, err)
+	}
+
+	// commands of clients connected to the current leadership or not fenced are accepted
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command"), LeadershipEpoch: r.LeadershipEpoch()}); err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+}
+
+func TestLeaderIdTracking(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{}, zap.NewNop())
+
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	if r.LeaderId() != 2 {
+		t.Fatalf("expect leader 2, got %d", r.LeaderId())
+	}
+
+	// the response carries the newer term from the new leader
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 3})
+	if err != nil || !resp.GetSuccess() || resp.GetTerm() != 2 {
+		t.Fatal("fail to append entries from the new leader:", err)
+	}
+	if r.LeaderId() != 3 {
+		t.Fatalf("expect leader 3, got %d", r.LeaderId())
+	}
+
+	// the stale leader is rejected and not recorded
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2})
+	if err != nil || resp.GetSuccess() || resp.GetTerm() != 2 {
+		t.Fatal("append entries from the stale leader should be rejected:", err)
+	}
+	if r.LeaderId() != 3 {
+		t.Fatalf("expect leader 3, got %d", r.LeaderId())
+	}
+
+	// the leader is unknown once an election starts
+	r.toCandidate()
+	grantedVotes := 0
+	r.voteForSelf(&grantedVotes)
+	if r.LeaderId() != 0 {
+		t.Fatalf("leader should be reset on election start, got %d", r.LeaderId())
+	}
+}
+
+func TestFollowerReportLeader(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, _ := c.checkSingleLeader()
+
+	for id, raft := range c.rafts {
+		if raft.LeaderId() != leaderId {
+			t.Fatalf("server %d reports leader %d, expect %d", id, raft.LeaderId(), leaderId)
+		}
+	}
+}
+
+func TestElectionWonOnce(t *testing.T) {
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}, 5: &peer{}}
+	r := NewRaft(1, peers, nil, &Config{}, zap.NewNop())
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+
+	r.toCandidate()
+	grantedVotes := 0
+	votesNeeded := (len(r.peers) + 1) / 2
+	r.voteForSelf(&grantedVotes)
+
+	r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, peerId: 2}, &grantedVotes, votesNeeded)
+	if r.state != Candidate {
+		t.Fatal("candidate should not win the election without majority votes")
+	}
+
+	r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, peerId: 3}, &grantedVotes, votesNeeded)
+	if r.state != Leader || r.leaderId != r.id {
+		t.Fatal("candidate should win the election with majority votes")
+	}
+	if r.nextIndex[2] != 2 || r.matchIndex[2] != 0 {
+		t.Fatal("leader state should be initialized when the election is won")
+	}
+
+	// the leader makes progress before the extra vote arrives
+	r.setNextAndMatchIndex(2, 3, 2)
+
+	r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, peerId: 4}, &grantedVotes, votesNeeded)
+	if r.state != Leader {
+		t.Fatal("extra vote should not change the leader state")
+	}
+	if r.nextIndex[2] != 3 || r.matchIndex[2] != 2 {
+		t.Fatal("leader state should be initialized exactly once")
+	}
+}
+
+func TestVoteTally(t *testing.T) {
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}, 5: &peer{}}
+	r := NewRaft(1, peers, nil, &Config{}, zap.NewNop())
+
+	if granted, needed := r.VoteTally(); granted != 0 || needed != 0 {
+		t.Fatalf("a follower should report no tally, got %d/%d", granted, needed)
+	}
+
+	r.toCandidate()
+	grantedVotes := 0
+	votesNeeded := r.numElectionVoters() / 2
+	r.voteForSelf(&grantedVotes)
+
+	checkTally := func(expectGranted int) {
+		if granted, needed := r.VoteTally(); granted != expectGranted || needed != 3 {
+			t.Fatalf("expect %d of 3 votes granted, got %d of %d", expectGranted, granted, needed)
+		}
+	}
+	checkTally(1)
+
+	vote := func(peerId uint32, granted bool) {
+		r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: granted}, peerId: peerId}, &grantedVotes, votesNeeded)
+	}
+
+	vote(2, true)
+	checkTally(2)
+	vote(3, false)
+	checkTally(2)
+
+	vote(4, true)
+	if r.state != Leader {
+		t.Fatal("candidate should win the election with majority votes")
+	}
+	if granted, needed := r.VoteTally(); granted != 0 || needed != 0 {
+		t.Fatalf("a leader should report no tally, got %d/%d", granted, needed)
+	}
+}
+
+func TestStaleVoteNotCounted(t *testing.T) {
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}, 5: &peer{}}
+	r := NewRaft(1, peers, nil, &Config{}, zap.NewNop())
+
+	r.toCandidate()
+	staleVotes := 0
+	r.voteForSelf(&staleVotes)
+	staleTerm := r.currentTerm
+
+	// the election times out and a new round starts with a fresh tally
+	grantedVotes := 0
+	votesNeeded := r.numElectionVoters() / 2
+	r.voteForSelf(&grantedVotes)
+
+	vote := func(peerId uint32, term uint64) {
+		r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: term, VoteGranted: true}, peerId: peerId}, &grantedVotes, votesNeeded)
+	}
+
+	vote(2, staleTerm)
+	vote(3, staleTerm)
+	if grantedVotes != 1 || r.grantedVoters[2] || r.grantedVoters[3] {
+		t.Fatalf("votes of the previous round should not be counted, got %d votes", grantedVotes)
+	}
+	if granted, _ := r.VoteTally(); granted != 1 {
+		t.Fatalf("expect 1 vote in the tally, got %d", granted)
+	}
+	if r.state != Candidate {
+		t.Fatal("candidate should not win the election by votes of the previous round")
+	}
+
+	vote(2, r.currentTerm)
+	vote(3, r.currentTerm)
+	if r.state != Leader {
+		t.Fatal("candidate should win the election by votes of the current round")
+	}
+}
+
+func TestVotesRequiredToWin(t *testing.T) {
+	tests := []struct {
+		numNodes      int
+		votesRequired int
+	}{
+		{numNodes: 2, votesRequired: 2},
+		{numNodes: 3, votesRequired: 2},
+		{numNodes: 4, votesRequired: 3},
+		{numNodes: 5, votesRequired: 3},
+	}
+
+	for _, tt := range tests {
+		peers := make(map[uint32]Peer, tt.numNodes-1)
+		for id := 2; id <= tt.numNodes; id++ {
+			peers[uint32(id)] = &peer{}
+		}
+		r := NewRaft(1, peers, nil, &Config{}, zap.NewNop())
+
+		r.toCandidate()
+		grantedVotes := 0
+		votesNeeded := r.numVoters() / 2
+		r.voteForSelf(&grantedVotes)
+
+		for id := 2; id <= tt.numNodes && r.state == Candidate; id++ {
+			r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, peerId: uint32(id)}, &grantedVotes, votesNeeded)
+		}
+
+		if r.state != Leader || grantedVotes != tt.votesRequired {
+			t.Fatalf("expect %d-node cluster to elect the leader with %d votes, got state %v with %d votes",
+				tt.numNodes, tt.votesRequired, r.state, grantedVotes)
+		}
+	}
+}
+
+func TestVoteWithNewerTermNotCounted(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+
+	r.toCandidate()
+	grantedVotes := 0
+	votesNeeded := (len(r.peers) + 1) / 2
+	r.voteForSelf(&grantedVotes)
+
+	r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm + 1, VoteGranted: true}, peerId: 2}, &grantedVotes, votesNeeded)
+	if r.state != Follower || grantedVotes != 1 {
+		t.Fatal("vote with a newer term should convert the candidate to follower without being counted")
+	}
+}
+
+func TestVoteInNewTerm(t *testing.T) {
+	p := newPersister()
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, p, &Config{}, zap.NewNop())
+
+	resp, err := r.requestVote(&pb.RequestVoteRequest{Term: 1, CandidateId: 2})
+	if err != nil || !resp.GetVoteGranted() {
+		t.Fatal("fail to vote for server 2:", err)
+	}
+
+	// the vote of the prior term does not block voting in the new term
+	resp, err = r.requestVote(&pb.RequestVoteRequest{Term: 2, CandidateId: 3})
+	if err != nil || !resp.GetVoteGranted() || r.votedFor != 3 {
+		t.Fatal("vote should be granted in the new term:", err)
+	}
+
+	// the candidate discovers a newer term from a vote response
+	r.toCandidate()
+	grantedVotes := 0
+	r.voteForSelf(&grantedVotes)
+	r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: 4}, peerId: 2}, &grantedVotes, 1)
+	if r.state != Follower || r.currentTerm != 4 || r.votedFor != 0 {
+		t.Fatal("vote should be cleared when the term advances")
+	}
+
+	// the advanced term and the cleared vote are persisted
+	rs := &raftState{}
+	if err := rs.loadRaftState(p); err != nil {
+		t.Fatal("fail to load raft state:", err)
+	}
+	if rs.currentTerm != 4 || rs.votedFor != 0 {
+		t.Fatalf("expect persisted term 4 without vote, got term %d and vote %d", rs.currentTerm, rs.votedFor)
+	}
+
+	resp, err = r.requestVote(&pb.RequestVoteRequest{Term: 4, CandidateId: 2})
+	if err != nil || !resp.GetVoteGranted() {
+		t.Fatal("vote should be granted in the advanced term:", err)
+	}
+}
+
+func TestSnapshotRestart(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	numLogs := 3
+	for i := 1; i <= numLogs; i++ {
+		c.applyCommand(leaderId, leaderTerm, []byte("command "+strconv.Itoa(i)))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// compact all logs of a follower into the snapshot
+	peerId := randomPeerId(leaderId, numNodes)
+	if err := c.rafts[peerId].Snapshot(context.Background(), uint64(numLogs), []byte("snapshot")); err != nil {
+		t.Fatal("fail to snapshot:", err)
+	}
+
+	c.stop(peerId)
+
+	meta, data, err := c.persisters[peerId].LoadSnapshot()
+	if err != nil {
+		t.Fatal("fail to load snapshot:", err)
+	}
+	if meta.LastIncludedId != uint64(numLogs) || meta.LastIncludedTerm != leaderTerm || string(data) != "snapshot" {
+		t.Fatal("snapshot should be persisted with its metadata")
+	}
+	if len(meta.Configuration) != numNodes {
+		t.Fatal("snapshot should be persisted with the configuration")
+	}
+
+	// restart the follower
+	c.initialize(peerId)
+	for id := range c.rafts {
+		c.connectAll(id)
+	}
+	c.start(peerId)
+
+	data4 := []byte("command 4")
+	log4Id := c.applyCommand(leaderId, leaderTerm, data4)
+
+	time.Sleep(1 * time.Second)
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("restarting the follower should not affect the current leader")
+	}
+
+	// the follower continues replication right after the snapshot
+	c.checkLog(peerId, log4Id, leaderTerm, data4)
+	for i := 1; i <= numLogs; i++ {
+		if l := c.consumers[peerId].getLog(uint64(i)); l != nil {
+			t.Fatalf("log %d is in the snapshot, should not be applied again", i)
+		}
+	}
+
+	raft := c.rafts[peerId]
+	raft.mu.Lock()
+	if raft.snapshotMeta.LastIncludedId != uint64(numLogs) || len(raft.logs) != 1 {
+		t.Fatal("the follower should restore the snapshot metadata and keep logs after the snapshot")
+	}
+	raft.mu.Unlock()
+}
+
+func TestSnapshotDeliveredBeforeLogsOnStartup(t *testing.T) {
+	p := newPersister()
+	config := &Config{
+		HeartbeatTimeout:  50 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		LeaderNoop:        true,
+	}
+
+	// the server restarts with logs up to 3 compacted into the snapshot, and log 4 after it
+	crashed := NewRaft(1, map[uint32]Peer{}, p, config, zap.NewNop())
+	crashed.toFollower(1)
+	crashed.appendLogs([]*pb.Entry{{Id: 4, Term: 1, Data: []byte("command 4")}})
+	if err := crashed.persist(context.Background()); err != nil {
+		t.Fatal("fail to persist:", err)
+	}
+	meta := SnapshotMeta{LastIncludedId: 3, LastIncludedTerm: 1, Configuration: map[uint32]string{1: ""}}
+	if err := p.SaveSnapshot(meta, []byte("snapshot")); err != nil {
+		t.Fatal("fail to save snapshot:", err)
+	}
+
+	r := NewRaft(1, map[uint32]Peer{}, p, config, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	next := func() *pb.Entry {
+		select {
+		case e := <-r.ApplyCh():
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("no entry is delivered")
+			return nil
+		}
+	}
+
+	if e := next(); e.GetType() != pb.EntryType_SNAPSHOT || e.GetId() != 3 || string(e.GetData()) != "snapshot" {
+		t.Fatalf("expect the snapshot up to log 3 delivered first, got %v", e)
+	}
+	if e := next(); e.GetType() != pb.EntryType_COMMAND || e.GetId() != 4 {
+		t.Fatalf("expect log 4 delivered after the snapshot, got %v", e)
+	}
+}
+
+func TestRestoreSnapshotOnRestart(t *testing.T) {
+	numNodes := 3
+
+	var mu sync.Mutex
+	restored := make(map[uint32][]byte)
+
+	var c *cluster
+	c = newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		config.RestoreSnapshot = func(meta SnapshotMeta, data []byte) error {
+			// the snapshot is delivered before any log
+			if ids := c.consumers[id].getLogIds(); len(ids) != 0 {
+				return fmt.Errorf("logs %v are applied before the snapshot", ids)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			restored[id] = data
+			return nil
+		}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	numLogs := 3
+	for i := 1; i <= numLogs; i++ {
+		c.applyCommand(leaderId, leaderTerm, []byte("command "+strconv.Itoa(i)))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	peerId := randomPeerId(leaderId, numNodes)
+	if err := c.rafts[peerId].Snapshot(context.Background(), uint64(numLogs), []byte("snapshot")); err != nil {
+		t.Fatal("fail to snapshot:", err)
+	}
+
+	c.stop(peerId)
+
+	// restart the follower
+	c.initialize(peerId)
+	for id := range c.rafts {
+		c.connectAll(id)
+	}
+	c.start(peerId)
+
+	data := []byte("command after restart")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(1 * time.Second)
+
+	mu.Lock()
+	if string(restored[peerId]) != "snapshot" {
+		t.Fatal("the snapshot should be restored on restart")
+	}
+	mu.Unlock()
+
+	c.checkLog(peerId, logId, leaderTerm, data)
+	if ids := c.consumers[peerId].getLogIds(); len(ids) != 1 || ids[0] != logId {
+		t.Fatalf("only logs after the snapshot should be applied, got %v", ids)
+	}
+}
+
+func TestApplyWithRoleFlapping(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	c.checkSingleLeader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// keep applying commands to whoever accepts it
+	go func() {
+		defer wg.Done()
+
+		for i := 1; ctx.Err() == nil; i++ {
+			for _, raft := range c.rafts {
+				raft.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte("command " + strconv.Itoa(i))})
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// keep forcing a follower to become candidate
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			time.Sleep(300 * time.Millisecond)
+
+			raft := c.rafts[uint32(rand.Intn(numNodes)+1)]
+			raft.mu.Lock()
+			state, term, leaderId := raft.state, raft.currentTerm, raft.leaderId
+			raft.mu.Unlock()
+
+			if state == Follower {
+				raft.TimeoutNow(ctx, &pb.TimeoutNowRequest{Term: term, LeaderId: leaderId})
+			}
+		}
+	}()
+
+	wg.Wait()
+	time.Sleep(1 * time.Second)
+
+	// logs of previous terms are committed along with a log of the current term
+	leaderId, leaderTerm := c.checkSingleLeader()
+	c.applyCommand(leaderId, leaderTerm, []byte("command"))
+	time.Sleep(500 * time.Millisecond)
+
+	leaderLogIds := c.consumers[leaderId].getLogIds()
+	if len(leaderLogIds) == 0 {
+		t.Fatal("no log is applied")
+	}
+
+	// every node applies the same contiguous sequence exactly once
+	for id := range c.rafts {
+		logIds := c.consumers[id].getLogIds()
+		if len(logIds) != len(leaderLogIds) {
+			t.Fatalf("server %d applies %d logs, expect %d logs", id, len(logIds), len(leaderLogIds))
+		}
+
+		for i, logId := range logIds {
+			if logId != uint64(i+1) {
+				t.Fatalf("server %d applies log %d at position %d", id, logId, i+1)
+			}
+			if l, ll := c.consumers[id].getLog(logId), c.consumers[leaderId].getLog(logId); l.GetTerm() != ll.GetTerm() || !bytes.Equal(l.GetData(), ll.GetData()) {
+				t.Fatalf("server %d applies log %d different from the leader", id, logId)
+			}
+		}
+	}
+}
+
+func TestAsyncPersistFlushBeforeResponse(t *testing.T) {
+	p := &gatedPersister{persister: newPersister(), gate: make(chan error)}
+	config := &Config{
+		HeartbeatTimeout:  10 * time.Second,
+		ElectionTimeout:   10 * time.Second,
+		HeartbeatInterval: 1 * time.Second,
+		AsyncPersist:      true,
+	}
+	r := NewRaft(1, map[uint32]Peer{}, p, config, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	appendEntries := func(entry *pb.Entry) <-chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := r.AppendEntries(ctx, &pb.AppendEntriesRequest{
+				Term:        1,
+				LeaderId:    2,
+				PrevLogId:   entry.GetId() - 1,
+				PrevLogTerm: entry.GetTerm(),
+				Entries:     []*pb.Entry{entry},
+			})
+			errCh <- err
+		}()
+		return errCh
+	}
+
+	errCh := appendEntries(&pb.Entry{Id: 1, Term: 1})
+
+	select {
+	case <-errCh:
+		t.Fatal("response should not be sent before the state is durable")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	p.gate <- nil
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal("fail to append entries:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("response should be sent after the state is durable")
+	}
+
+	rs := &raftState{}
+	if err := rs.loadRaftState(p); err != nil {
+		t.Fatal("fail to load raft state:", err)
+	}
+	if lastLogId, _ := rs.getLastLog(); lastLogId != 1 {
+		t.Fatal("the appended log should be durable")
+	}
+
+	// failed writes should not be acknowledged
+	errCh = appendEntries(&pb.Entry{Id: 2, Term: 1})
+	p.gate <- errors.New("disk failure")
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("response should fail if the state is not durable")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("response should be sent after the write fails")
+	}
+}
+
+// gatedPersister is a Persister that blocks saving raft states until the gate releases it with the given error
+type gatedPersister struct {
+	*persister
+
+	gate chan error
+}
+
+func (p *gatedPersister) SaveRaftState(raftState []byte) error {
+	if err := <-p.gate; err != nil {
+		return err
+	}
+
+	return p.persister.SaveRaftState(raftState)
+}
+
+func TestAsyncPersistReturnsContextError(t *testing.T) {
+	// the background writer is not running, so the state is never flushed
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{AsyncPersist: true}, zap.NewNop())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.persist(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect %v while waiting for the flush, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the queue is full, so the state cannot be queued
+	for len(r.persistCh) != cap(r.persistCh) {
+		r.persistCh <- &persistRequest{done: make(chan error, 1)}
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := r.persist(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect %v while queueing the state, got %v", context.Canceled, err)
+	}
+}
+
+func TestPersistInEncodedOrder(t *testing.T) {
+	p := &gatedPersister{persister: newPersister(), gate: make(chan error)}
+	r := NewRaft(2, map[uint32]Peer{1: &peer{}, 3: &peer{}}, p, &Config{}, zap.NewNop())
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+
+	ctx := context.Background()
+	persist := func() <-chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- r.persist(ctx)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return errCh
+	}
+
+	// the first RPC goroutine is stuck saving the state, while the leader of a newer term appends a log
+	errCh1 := persist()
+	if _, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 3, LeaderId: 1, PrevLogId: 1, PrevLogTerm: 1,
+		Entries: []*pb.Entry{{Id: 2, Term: 3}}}); err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	errCh2 := persist()
+
+	p.gate <- nil
+	p.gate <- nil
+	for _, errCh := range []<-chan error{errCh1, errCh2} {
+		if err := <-errCh; err != nil {
+			t.Fatal("fail to persist:", err)
+		}
+	}
+
+	restarted := NewRaft(2, map[uint32]Peer{1: &peer{}, 3: &peer{}}, p.persister, &Config{}, zap.NewNop())
+	if err := restarted.loadRaftState(p.persister); err != nil {
+		t.Fatal("fail to load raft state:", err)
+	}
+	if lastLogId, _ := restarted.getLastLog(); restarted.currentTerm != 3 || lastLogId != 2 {
+		t.Fatalf("the newest state should be persisted, got term %d, last log %d", restarted.currentTerm, lastLogId)
+	}
+}
+
+// recordingPersister records every saved raft state, so a crash after any save can be simulated
+type recordingPersister struct {
+	*persister
+
+	states [][]byte
+}
+
+func (p *recordingPersister) SaveRaftState(raftState []byte) error {
+	p.states = append(p.states, append([]byte(nil), raftState...))
+
+	return p.persister.SaveRaftState(raftState)
+}
+
+func TestRecoverTermWithLogs(t *testing.T) {
+	p := &recordingPersister{persister: newPersister()}
+	peers := map[uint32]Peer{1: &peer{}, 3: &peer{}}
+	r := NewRaft(2, peers, p, &Config{}, zap.NewNop())
+	ctx := context.Background()
+
+	r.toFollower(1)
+	r.voteFor(3, false)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+	if err := r.persist(ctx); err != nil {
+		t.Fatal("fail to persist:", err)
+	}
+
+	// the leader of a newer term bumps the term and appends logs by the same request
+	if _, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 3, LeaderId: 1, PrevLogId: 1, PrevLogTerm: 1,
+		Entries: []*pb.Entry{{Id: 2, Term: 3}}}); err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	if err := r.persist(ctx); err != nil {
+		t.Fatal("fail to persist:", err)
+	}
+
+	// the server recovers a consistent state wherever it crashes
+	for i, state := range p.states {
+		crashed := newPersister()
+		crashed.SaveRaftState(state)
+
+		restarted := NewRaft(2, peers, crashed, &Config{}, zap.NewNop())
+		if err := restarted.loadRaftState(crashed); err != nil {
+			t.Fatal("fail to load raft state:", err)
+		}
+
+		lastLogId, lastLogTerm := restarted.getLastLog()
+		if lastLogTerm > restarted.currentTerm {
+			t.Fatalf("crash after save %d: log %d of term %d is ahead of the persisted term %d", i, lastLogId, lastLogTerm, restarted.currentTerm)
+		}
+		if restarted.currentTerm == 3 && (restarted.votedFor != 0 || lastLogId != 2) {
+			t.Fatalf("crash after save %d: the new term should be persisted without the stale vote and with the new log, got vote %d, last log %d",
+				i, restarted.votedFor, lastLogId)
+		}
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	errCh := make(chan error, 2)
+	config := &Config{RPCTimeout: 100 * time.Millisecond}
+	r := NewRaft(1, map[uint32]Peer{2: stallRPCs(errCh)}, nil, config, zap.NewNop())
+	r.nextIndex[2] = 1
+
+	voteCh := make(chan *voteResult, 1)
+	r.broadcastRequestVote(context.Background(), voteCh)
+	appendEntriesResultCh := make(chan *appendEntriesResult, 1)
+	r.broadcastAppendEntries(context.Background(), appendEntriesResultCh, nil)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("RPC should be cancelled by deadline, got error: %v", err)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("RPC is not cancelled after the timeout")
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("RPC should be cancelled right after the timeout, elapsed %v", elapsed)
+	}
+
+	// cancelled RequestVote RPCs produce no results, while the failure of AppendEntries RPCs is reported, so the
+	// logs can be sent again
+	time.Sleep(100 * time.Millisecond)
+	if len(voteCh) != 0 {
+		t.Fatal("cancelled RequestVote RPCs should not produce results")
+	}
+	if len(appendEntriesResultCh) != 1 {
+		t.Fatalf("expect the result of the cancelled AppendEntries RPC, got %d results", len(appendEntriesResultCh))
+	}
+	if result := <-appendEntriesResultCh; !errors.Is(result.err, context.DeadlineExceeded) {
+		t.Fatalf("the result should report the deadline, got error: %v", result.err)
+	}
+}
+
+func TestRPCRetryOnTransientError(t *testing.T) {
+	// failFirst returns a peer failing the first AppendEntries RPC with the error, then acknowledging them
+	failFirst := func(err error, calls *int32) Peer {
+		return &mockPeer{
+			appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+				if atomic.AddInt32(calls, 1) == 1 {
+					return nil, err
+				}
+
+				return ackAppendEntries(ctx, in)
+			},
+		}
+	}
+
+	var transientCalls, permanentCalls int32
+	transient := failFirst(status.Error(codes.Unavailable, "connection reset"), &transientCalls)
+	permanent := failFirst(status.Error(codes.InvalidArgument, "bad request"), &permanentCalls)
+	config := &Config{HeartbeatInterval: 1 * time.Second, RPCRetries: 3}
+	r := NewRaft(1, map[uint32]Peer{2: transient, 3: permanent}, nil, config, zap.NewNop())
+	r.nextIndex[2] = 1
+	r.nextIndex[3] = 1
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, 2)
+	r.broadcastAppendEntries(context.Background(), appendEntriesResultCh, nil)
+
+	// the retried RPC succeeds without waiting for the next heartbeat, the permanent failure is reported as is
+	timeoutCh := time.After(config.HeartbeatInterval / 2)
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-appendEntriesResultCh:
+			if failed := result.err != nil; failed != (result.peerId == 3) {
+				t.Fatalf("only the peer failed with permanent error should fail, got peer %d with error %v", result.peerId, result.err)
+			}
+		case <-timeoutCh:
+			t.Fatal("RPC failed with transient error should be retried immediately")
+		}
+	}
+
+	if calls := atomic.LoadInt32(&transientCalls); calls != 2 {
+		t.Fatalf("RPC failed with transient error should be retried once, got %d calls", calls)
+	}
+	if calls := atomic.LoadInt32(&permanentCalls); calls != 1 {
+		t.Fatalf("RPC failed with permanent error should not be retried, got %d calls", calls)
+	}
+}
+
+func randomPeerId(serverId uint32, numNodes int) uint32 {
+	peerId := serverId
+
+	for peerId == serverId {
+		peerId = rand.Uint32()%uint32(numNodes) + 1
+	}
+
+	return peerId
+}
+
+func TestForceElection(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	if err := c.rafts[leaderId].ForceElection(); !errors.Is(err, errAlreadyLeader) {
+		t.Fatal("force election on the leader should be rejected, got:", err)
+	}
+
+	followerId := leaderId%uint32(numNodes) + 1
+	if err := c.rafts[followerId].ForceElection(); err != nil {
+		t.Fatal("fail to force election:", err)
+	}
+
+	// the election starts without waiting for the heartbeat timeout
+	time.Sleep(20 * time.Millisecond)
+
+	follower := c.rafts[followerId]
+	follower.mu.Lock()
+	term, votedFor := follower.currentTerm, follower.votedFor
+	follower.mu.Unlock()
+
+	if term <= leaderTerm || votedFor != followerId {
+		t.Fatalf("server %d should start an election at a new term, got term %d", followerId, term)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	if _, newTerm := c.checkSingleLeader(); newTerm <= leaderTerm {
+		t.Fatal("a new leader should be elected at a newer term")
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	numNodes := 3
+
+	var mu sync.Mutex
+	committed := make(map[uint32][]uint64)
+
+	c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		config.OnCommit = func(log *pb.Entry) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			committed[id] = append(committed[id], log.GetId())
+		}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	numLogs := 5
+	var lastLogId uint64
+	for i := 1; i <= numLogs; i++ {
+		lastLogId = c.applyCommand(leaderId, leaderTerm, []byte("command "+strconv.Itoa(i)))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for id := range c.rafts {
+		logIds := committed[id]
+		if uint64(len(logIds)) != lastLogId {
+			t.Fatalf("server %d should commit %d logs, got %v", id, lastLogId, logIds)
+		}
+
+		// every log is committed exactly once in order
+		for i, logId := range logIds {
+			if logId != uint64(i+1) {
+				t.Fatalf("server %d commits logs out of order: %v", id, logIds)
+			}
+		}
+	}
+}
+
+func TestLearnerCatchUpWithSnapshot(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	numLogs := 5
+	var snapshotId uint64
+	for i := 1; i <= numLogs; i++ {
+		snapshotId = c.applyCommand(leaderId, leaderTerm, []byte("command "+strconv.Itoa(i)))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// compact all logs of the leader, so the learner can only catch up through the snapshot
+	if err := c.rafts[leaderId].Snapshot(context.Background(), snapshotId, []byte("snapshot")); err != nil {
+		t.Fatal("fail to snapshot:", err)
+	}
+
+	data := []byte("command after snapshot")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	learnerId := uint32(numNodes + 1)
+	c.joinAsLearner(learnerId, leaderId)
+
+	time.Sleep(1 * time.Second)
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("the learner should not disrupt the current leader")
+	}
+
+	snapshot := c.consumers[learnerId].getSnapshot()
+	if snapshot == nil || snapshot.GetId() != snapshotId || string(snapshot.GetData()) != "snapshot" {
+		t.Fatal("the learner should install the snapshot from the leader")
+	}
+	for _, id := range c.consumers[learnerId].getLogIds() {
+		if id <= snapshotId {
+			t.Fatalf("log %d in the snapshot should not be applied to the learner", id)
+		}
+	}
+	c.checkLog(learnerId, logId, leaderTerm, data)
+
+	resp, err := c.rafts[leaderId].PromoteLearner(context.Background(), &pb.PromoteLearnerRequest{ServerId: learnerId})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to promote the caught up learner:", err)
+	}
+
+	data = []byte("command after promotion")
+	logId = c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for id, raft := range c.rafts {
+		c.checkLog(id, logId, leaderTerm, data)
+
+		raft.mu.Lock()
+		if len(raft.configuration) != numNodes+1 || raft.learners[learnerId] {
+			t.Fatalf("server %d should have the promoted learner as a voter", id)
+		}
+		raft.mu.Unlock()
+	}
+}
+
+func TestAutoPromoteLearner(t *testing.T) {
+	numNodes := 3
+
+	c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		config.PromotionThreshold = 1
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, leaderTerm := c.checkSingleLeader()
+	for i := 0; i < 5; i++ {
+		c.applyCommand(leaderId, leaderTerm, []byte("command "+strconv.Itoa(i)))
+	}
+
+	learnerId := uint32(numNodes + 1)
+	c.joinAsLearner(learnerId, leaderId)
+
+	// the learner is promoted once it has caught up for an election timeout, without calling PromoteLearner
+	time.Sleep(2 * time.Second)
+
+	data := []byte("command after promotion")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for id, raft := range c.rafts {
+		c.checkLog(id, logId, leaderTerm, data)
+
+		raft.mu.Lock()
+		if _, ok := raft.configuration[learnerId]; !ok || raft.learners[learnerId] {
+			t.Fatalf("server %d should have the caught up learner as a voter", id)
+		}
+		raft.mu.Unlock()
+	}
+}
+
+func TestResetAndRejoinAsLearner(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	data := []byte("command before reset")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	resetId := leaderId%uint32(numNodes) + 1
+	r := c.rafts[resetId]
+	if err := r.Reset(); !errors.Is(err, ErrRunning) {
+		t.Fatalf("expect ErrRunning when resetting a running node, got %v", err)
+	}
+
+	c.stop(resetId)
+	if _, err := c.removeServer(leaderId, resetId); err != nil {
+		t.Fatal("fail to remove the server:", err)
+	}
+
+	// the leader rejects the rejoin until the removal is committed, since servers are changed one at a time
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.rafts[leaderId].Configuration()[resetId]; !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the removal of the server is not committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Run returns asynchronously after the server is stopped
+	deadline = time.Now().Add(time.Second)
+	for {
+		err := r.Reset()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrRunning) || time.Now().After(deadline) {
+			t.Fatal("fail to reset the stopped node:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if lastLogId, _ := r.getLastLog(); lastLogId != 0 || r.currentTerm != 0 || r.votedFor != 0 || r.commitIndex != 0 ||
+		r.lastApplied != 0 || r.state != Follower {
+		t.Fatalf("expect a fresh follower, got last log %d, term %d, voted for %d, commit index %d, last applied %d, %v",
+			lastLogId, r.currentTerm, r.votedFor, r.commitIndex, r.lastApplied, r.state)
+	}
+	if raftState, err := c.persisters[resetId].LoadRaftState(); err != nil || len(raftState) != 0 {
+		t.Fatal("the persisted raft state should be cleared:", err)
+	}
+
+	// the node rejoins with the cleared persister and catches up from scratch
+	c.joinAsLearner(resetId, leaderId)
+
+	time.Sleep(1 * time.Second)
+
+	c.checkLog(resetId, logId, leaderTerm, data)
+
+	leader := c.rafts[leaderId]
+	leader.mu.Lock()
+	if !leader.learners[resetId] {
+		t.Fatal("the reset node should rejoin as a learner")
+	}
+	leader.mu.Unlock()
+}
+
+func TestPromoteLearnerNotCaughtUp(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}}, nil, &Config{}, zap.NewNop())
+	r.setConfiguration(0, map[uint32]string{1: "", 2: ""}, map[uint32]bool{2: true}, nil)
+	newLeader(t, r, 1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+
+	if r.numVoters() != 1 {
+		t.Fatalf("learners should not be counted as voters, got %d voters", r.numVoters())
+	}
+
+	if _, err := r.promoteLearner(&pb.PromoteLearnerRequest{ServerId: 2}); !errors.Is(err, errLearnerNotCaughtUp) {
+		t.Fatal("the learner behind the leader should not be promoted, got:", err)
+	}
+
+	r.setNextAndMatchIndex(2, 2, 1)
+	resp, err := r.promoteLearner(&pb.PromoteLearnerRequest{ServerId: 2})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to promote the caught up learner:", err)
+	}
+	if r.learners[2] || r.numVoters() != 2 {
+		t.Fatal("the promoted learner should be a voter")
+	}
+}
+
+func TestPromotedLearnerVotesAfterCommit(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	configuration := map[uint32]string{1: "", 2: "", 3: ""}
+	if err := r.appendConfiguration(configuration, map[uint32]bool{3: true}, nil); err != nil {
+		t.Fatal("fail to append configuration:", err)
+	}
+	r.commit(1)
+
+	r.setNextAndMatchIndex(3, 2, 1)
+	if resp, err := r.promoteLearner(&pb.PromoteLearnerRequest{ServerId: 3}); err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to promote the learner:", err)
+	}
+
+	elect := func(voters ...uint32) {
+		r.toFollower(r.currentTerm + 1)
+		r.toCandidate()
+
+		grantedVotes := 0
+		votesNeeded := r.numVoters() / 2
+		r.voteForSelf(&grantedVotes)
+		for _, id := range voters {
+			r.handleVoteResult(context.Background(), &voteResult{RequestVoteResponse: &pb.RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, peerId: id}, &grantedVotes, votesNeeded)
+		}
+	}
+
+	// the promotion is not committed, the vote of the promoted learner does not count
+	elect(3)
+	if r.state != Candidate {
+		t.Fatal("vote of the promoted learner should not count before the promotion is committed")
+	}
+
+	elect(2)
+	if r.state != Leader {
+		t.Fatal("candidate should win with votes from a majority of the committed configuration")
+	}
+
+	r.commit(2)
+
+	elect(3)
+	if r.state != Leader {
+		t.Fatal("vote of the promoted learner should count after the promotion is committed")
+	}
+
+	// the promoted learner starts elections only after the promotion is committed
+	learner := NewRaft(3, map[uint32]Peer{1: &peer{}, 2: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+	logs, _ := r.dumpLogs()
+
+	resp, err := learner.appendEntries(&pb.AppendEntriesRequest{Term: r.currentTerm, LeaderId: 1, Entries: logs, LeaderCommitId: 1})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	learner.handleFollowerHeartbeatTimeout()
+	if learner.state != Follower {
+		t.Fatal("the promoted learner should not start an election before the promotion is committed")
+	}
+
+	resp, err = learner.appendEntries(&pb.AppendEntriesRequest{Term: r.currentTerm, LeaderId: 1, PrevLogId: 2, PrevLogTerm: logs[1].GetTerm(), LeaderCommitId: 2})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	learner.handleFollowerHeartbeatTimeout()
+	if learner.state != Candidate {
+		t.Fatal("the promoted learner should start an election after the promotion is committed")
+	}
+}
+
+func TestCommittedConfiguration(t *testing.T) {
+	dialPeer := func(addr string) (Peer, error) {
+		return &peer{}, nil
+	}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{DialPeer: dialPeer}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	checkConfiguration := func(ids ...uint32) {
+		members := r.Configuration()
+		if len(members) != len(ids) {
+			t.Fatalf("expect members %v, got %v", ids, members)
+		}
+		for _, id := range ids {
+			if _, ok := members[id]; !ok {
+				t.Fatalf("expect members %v, got %v", ids, members)
+			}
+		}
+	}
+
+	checkConfiguration(1, 2, 3)
+
+	if err := r.appendConfiguration(map[uint32]string{1: "", 2: "", 3: "", 4: ""}, nil, nil); err != nil {
+		t.Fatal("fail to append configuration:", err)
+	}
+	checkConfiguration(1, 2, 3)
+
+	r.commit(1)
+	checkConfiguration(1, 2, 3, 4)
+
+	if err := r.appendConfiguration(map[uint32]string{1: "", 2: "", 4: ""}, nil, nil); err != nil {
+		t.Fatal("fail to append configuration:", err)
+	}
+	checkConfiguration(1, 2, 3, 4)
+
+	r.commit(2)
+	checkConfiguration(1, 2, 4)
+}
+
+func TestOnlyCommandsApplied(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	// the configuration log of the new server is handled by raft itself
+	c.join(uint32(numNodes+1), leaderId)
+
+	data := []byte("command after join")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for id := range c.rafts {
+		c.checkLog(id, logId, leaderTerm, data)
+
+		consumer := c.consumers[id]
+		consumer.mu.RLock()
+		for _, log := range consumer.logs {
+			if log.GetType() != pb.EntryType_COMMAND {
+				t.Fatalf("log %d of type %s should not be applied to server %d", log.GetId(), log.GetType(), id)
+			}
+		}
+		consumer.mu.RUnlock()
+	}
+}
+
+func TestObserver(t *testing.T) {
+	numNodes := 3
+
+	c := newCluster(t, numNodes)
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+	leaderId, leaderTerm := c.checkSingleLeader()
+
+	observerId := uint32(numNodes + 1)
+	c.joinAsObserver(observerId, leaderId)
+
+	data := []byte("command to observer")
+	logId := c.applyCommand(leaderId, leaderTerm, data)
+
+	time.Sleep(1 * time.Second)
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("the observer should not disrupt the current leader")
+	}
+	c.checkLog(observerId, logId, leaderTerm, data)
+
+	if err := c.rafts[observerId].ForceElection(); !errors.Is(err, errNotVoter) {
+		t.Fatal("the observer should not start an election, got:", err)
+	}
+	if _, err := c.rafts[leaderId].PromoteLearner(context.Background(), &pb.PromoteLearnerRequest{ServerId: observerId}); !errors.Is(err, errObserver) {
+		t.Fatal("the observer should not be promoted, got:", err)
+	}
+
+	// the observer is never elected, and keeps replicating from the new leader
+	c.stop(leaderId)
+
+	time.Sleep(1 * time.Second)
+
+	newLeaderId, newLeaderTerm := c.checkSingleLeader()
+	if newLeaderId == observerId {
+		t.Fatal("the observer should never become leader")
+	}
+
+	data = []byte("command after failover")
+	logId = c.applyCommand(newLeaderId, newLeaderTerm, data)
+
+	time.Sleep(500 * time.Millisecond)
+
+	c.checkLog(observerId, logId, newLeaderTerm, data)
+
+	for id, raft := range c.rafts {
+		raft.mu.Lock()
+		if raft.isVoter(observerId) || !raft.observers[observerId] {
+			t.Fatalf("server %d should have server %d as an observer", id, observerId)
+		}
+		raft.mu.Unlock()
+	}
+}
+
+// testMetrics records emitted metrics
+type testMetrics struct {
+	counters     map[string]int64
+	observations map[string][]float64
+	mu           sync.Mutex
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters:     make(map[string]int64),
+		observations: make(map[string][]float64),
+	}
+}
+
+func (m *testMetrics) IncrCounter(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name] += delta
+}
+
+func (m *testMetrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.observations[name] = append(m.observations[name], value)
+}
+
+func (m *testMetrics) counter(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[name]
+}
+
+func TestSplitVoteMetrics(t *testing.T) {
+	var split int32 = 1
+	grant := func() bool { return atomic.LoadInt32(&split) == 0 }
+
+	// with server 2 granting and others rejecting, the votes are tied 2 to 2
+	peers := map[uint32]Peer{
+		2: &mockPeer{requestVoteFunc: grantVote},
+		3: voteBy(grant),
+		4: voteBy(grant),
+	}
+	metrics := newTestMetrics()
+	config := &Config{ElectionTimeout: 50 * time.Millisecond, Metrics: metrics}
+	r := NewRaft(1, peers, newPersister(), config, zap.NewNop())
+
+	r.toCandidate()
+	r.runCandidate(context.Background())
+
+	if r.state != Candidate {
+		t.Fatal("candidate should not win the election with tied votes")
+	}
+	if metrics.counter(MetricElectionSplitVote) != 1 || metrics.counter(MetricElectionTimeout) != 0 {
+		t.Fatalf("expect a split vote event, got %v", metrics.counters)
+	}
+
+	atomic.StoreInt32(&split, 0)
+	r.runCandidate(context.Background())
+
+	if r.state != Leader {
+		t.Fatal("candidate should win the election with majority votes")
+	}
+	if rounds := metrics.observations[MetricElectionRounds]; len(rounds) != 1 || rounds[0] != 2 {
+		t.Fatalf("expect the leader elected in 2 rounds, got %v", rounds)
+	}
+}
+
+func TestElectionTimeoutMetrics(t *testing.T) {
+	peers := map[uint32]Peer{
+		2: stallRPCs(make(chan error, 1)),
+		3: stallRPCs(make(chan error, 1)),
+	}
+	metrics := newTestMetrics()
+	config := &Config{ElectionTimeout: 50 * time.Millisecond, RPCTimeout: 100 * time.Millisecond, Metrics: metrics}
+	r := NewRaft(1, peers, newPersister(), config, zap.NewNop())
+
+	r.toCandidate()
+	r.runCandidate(context.Background())
+
+	if metrics.counter(MetricElectionTimeout) != 1 || metrics.counter(MetricElectionSplitVote) != 0 {
+		t.Fatalf("expect an election timeout event, got %v", metrics.counters)
+	}
+}
+
+func TestCommitOnlyHeartbeat(t *testing.T) {
+	caughtUpCh := make(chan *pb.AppendEntriesRequest, 1)
+	laggingCh := make(chan *pb.AppendEntriesRequest, 1)
+	config := &Config{CommitOnlyHeartbeat: true}
+	r := NewRaft(1, map[uint32]Peer{2: recordAppendEntries(caughtUpCh), 3: recordAppendEntries(laggingCh)}, nil, config, zap.NewNop())
+
+	logs := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}}
+	r.appendLogs(logs)
+	newLeader(t, r, 1)
+	r.setNextAndMatchIndex(2, 4, 3)
+	r.setNextAndMatchIndex(3, 2, 1)
+	r.commit(3)
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, 2)
+	r.broadcastAppendEntries(context.Background(), appendEntriesResultCh, nil)
+
+	req := <-caughtUpCh
+	if len(req.GetEntries()) != 0 || req.GetPrevLogId() != 3 || req.GetPrevLogTerm() != 1 || req.GetLeaderCommitId() != 3 {
+		t.Fatalf("caught up peer should receive a heartbeat carrying only the commit index, got %v", req)
+	}
+	if lagged := <-laggingCh; len(lagged.GetEntries()) != 2 || lagged.GetPrevLogId() != 1 {
+		t.Fatalf("lagging peer should receive missing logs, got %v", lagged)
+	}
+
+	// the follower advances its commit index by the heartbeat
+	follower := NewRaft(2, map[uint32]Peer{1: &peer{}, 3: &peer{}}, nil, &Config{}, zap.NewNop())
+	follower.toFollower(1)
+	follower.appendLogs(logs)
+
+	go func() {
+		for range follower.ApplyCh() {
+		}
+	}()
+
+	resp, err := follower.appendEntries(req)
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	if follower.commitIndex != 3 {
+		t.Fatalf("follower should advance commit index to 3, got %d", follower.commitIndex)
+	}
+}
+
+func TestLeaderCommitBeyondFollowerLog(t *testing.T) {
+	var applied []uint64
+	r := NewRaft(2, map[uint32]Peer{1: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(log *pb.Entry) error {
+		applied = append(applied, log.GetId())
+		return nil
+	}}, zap.NewNop())
+	r.toFollower(1)
+
+	check := func(req *pb.AppendEntriesRequest, success bool, commitIndex uint64) {
+		t.Helper()
+
+		resp, err := r.appendEntries(req)
+		if err != nil || resp.GetSuccess() != success {
+			t.Fatalf("expect success %v, got %v, err %v", success, resp.GetSuccess(), err)
+		}
+		if r.commitIndex != commitIndex || r.lastApplied != commitIndex || uint64(len(applied)) != commitIndex {
+			t.Fatalf("expect commit index %d, got commit index %d, last applied %d, applied logs %v",
+				commitIndex, r.commitIndex, r.lastApplied, applied)
+		}
+	}
+
+	// the follower has no logs to commit
+	check(&pb.AppendEntriesRequest{Term: 1, LeaderId: 1, LeaderCommitId: 100}, true, 0)
+
+	// only the received logs are committed
+	entries := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}}
+	check(&pb.AppendEntriesRequest{Term: 1, LeaderId: 1, Entries: entries, LeaderCommitId: 100}, true, 2)
+	check(&pb.AppendEntriesRequest{Term: 1, LeaderId: 1, PrevLogId: 2, PrevLogTerm: 1, LeaderCommitId: 100}, true, 2)
+
+	// the missing previous log is rejected without committing
+	check(&pb.AppendEntriesRequest{Term: 1, LeaderId: 1, PrevLogId: 50, PrevLogTerm: 1, LeaderCommitId: 100}, false, 2)
+}
+
+func TestFollowerReportedLastLog(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.New(core))
+
+	entries := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}, {Id: 4, Term: 1}}
+	r.appendLogs(entries)
+	newLeader(t, r, 1)
+
+	result := func(success bool, lastLogId uint64, req *pb.AppendEntriesRequest) *appendEntriesResult {
+		return &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: success, LastLogId: lastLogId},
+			req:                   req,
+			peerId:                2,
+		}
+	}
+
+	// the follower acknowledges all logs but reports a shorter log
+	r.handleAppendEntriesResult(context.Background(), result(true, 2, &pb.AppendEntriesRequest{Term: 1, Entries: entries}))
+	if r.nextIndex[2] != 3 || r.matchIndex[2] != 0 {
+		t.Fatalf("leader should replicate again from the reported last log, got next index %d, match index %d", r.nextIndex[2], r.matchIndex[2])
+	}
+	if logs.FilterMessage("follower reports last log before the replicated logs").Len() != 1 {
+		t.Fatal("leader should log the unexpected last log")
+	}
+
+	// the leader recovers once the follower acknowledges the missing logs
+	r.handleAppendEntriesResult(context.Background(), result(true, 4, &pb.AppendEntriesRequest{Term: 1, PrevLogId: 2, PrevLogTerm: 1, Entries: entries[2:]}))
+	if r.nextIndex[2] != 5 || r.matchIndex[2] != 4 {
+		t.Fatalf("expect next index 5, match index 4, got next index %d, match index %d", r.nextIndex[2], r.matchIndex[2])
+	}
+
+	// the follower loses its logs, the leader retries from the reported last log instead of one log at a time
+	r.handleAppendEntriesResult(context.Background(), result(false, 1, &pb.AppendEntriesRequest{Term: 1, PrevLogId: 4, PrevLogTerm: 1}))
+	if r.nextIndex[2] != 2 || r.matchIndex[2] != 1 {
+		t.Fatalf("expect next index 2, match index 1, got next index %d, match index %d", r.nextIndex[2], r.matchIndex[2])
+	}
+	if logs.FilterMessage("follower reports last log before the match index").Len() != 1 {
+		t.Fatal("leader should log the match index beyond the follower log")
+	}
+}
+
+func TestCommitAfterPartitionHeals(t *testing.T) {
+	numNodes := 3
+	leaderId := uint32(1)
+
+	// followers never time out, so the leader keeps its leadership through the partition
+	c := newClusterWithConfig(t, numNodes, func(id uint32, config *Config) {
+		config.randomTimeout = func(minVal time.Duration) <-chan time.Time {
+			if id == leaderId {
+				return time.After(minVal)
+			}
+
+			return time.After(time.Minute)
+		}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	nowId, leaderTerm := c.checkSingleLeader()
+	if nowId != leaderId {
+		t.Fatalf("server %d should be the leader, got server %d", leaderId, nowId)
+	}
+
+	for id := uint32(1); id <= uint32(numNodes); id++ {
+		if id != leaderId {
+			c.disconnect(leaderId, id)
+		}
+	}
+
+	logId := c.applyCommand(leaderId, leaderTerm, []byte("command 1"))
+
+	time.Sleep(500 * time.Millisecond)
+
+	if c.rafts[leaderId].IsCommitted(logId) {
+		t.Fatal("log should not be committed without a majority")
+	}
+
+	for id := uint32(1); id <= uint32(numNodes); id++ {
+		if id != leaderId {
+			c.connect(leaderId, id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := c.rafts[leaderId].WaitForCommit(ctx, logId); err != nil {
+		t.Fatal("log should be committed once the partition heals:", err)
+	}
+
+	if nowId, nowTerm := c.checkSingleLeader(); nowId != leaderId || nowTerm != leaderTerm {
+		t.Fatal("should remains the same leader and the same term")
+	}
+}
+
+func TestStaleAppendEntriesResultNotCounted(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	newLeader(t, r, 1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+	r.setNextAndMatchIndex(2, 2, 1)
+
+	// the server is elected again in a new term, the match index of the previous term is reset
+	newLeader(t, r, 2)
+	if r.matchIndex[2] != 0 {
+		t.Fatalf("match index should be reset on becoming leader, got %d", r.matchIndex[2])
+	}
+
+	entry := &pb.Entry{Id: 2, Term: 2}
+	r.appendLogs([]*pb.Entry{entry})
+
+	result := func(term uint64) *appendEntriesResult {
+		return &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: term, Success: true, LastLogId: 2},
+			req:                   &pb.AppendEntriesRequest{Term: term, PrevLogId: 1, PrevLogTerm: 1, Entries: []*pb.Entry{entry}},
+			peerId:                2,
+		}
+	}
+
+	// a response to the request sent in the previous term is ignored
+	r.handleAppendEntriesResult(context.Background(), result(1))
+	if r.matchIndex[2] != 0 || r.commitIndex != 0 {
+		t.Fatalf("stale response should not be counted, got match index %d, commit index %d", r.matchIndex[2], r.commitIndex)
+	}
+
+	r.handleAppendEntriesResult(context.Background(), result(2))
+	if r.matchIndex[2] != 2 || r.commitIndex != 2 {
+		t.Fatalf("expect match index 2, commit index 2, got match index %d, commit index %d", r.matchIndex[2], r.commitIndex)
+	}
+}
+
+func TestCommitAdvancedOnMajorityResponse(t *testing.T) {
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}, 5: &peer{}}
+	r := NewRaft(1, peers, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	newLeader(t, r, 2)
+
+	entries := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 2}}
+	r.appendLogs(entries)
+
+	result := func(peerId uint32, numEntries int) *appendEntriesResult {
+		return &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 2, Success: true, LastLogId: uint64(numEntries)},
+			req:                   &pb.AppendEntriesRequest{Term: 2, Entries: entries[:numEntries]},
+			peerId:                peerId,
+		}
+	}
+
+	// the log of a previous term is never committed by counting replicas
+	r.handleAppendEntriesResult(context.Background(), result(2, 1))
+	r.handleAppendEntriesResult(context.Background(), result(3, 1))
+	if r.commitIndex != 0 {
+		t.Fatalf("log of a previous term should not be committed by replicas, got commit index %d", r.commitIndex)
+	}
+
+	r.handleAppendEntriesResult(context.Background(), result(2, 2))
+	if r.commitIndex != 0 {
+		t.Fatalf("log should not be committed without a majority, got commit index %d", r.commitIndex)
+	}
+
+	// the response completing the majority commits without waiting for the next heartbeat
+	r.handleAppendEntriesResult(context.Background(), result(3, 2))
+	if r.commitIndex != 2 {
+		t.Fatalf("expect commit index 2 right after the majority responds, got %d", r.commitIndex)
+	}
+}
+
+func TestCommitWaitersReleasedOnMajority(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	// applying logs blocks, waiters of the commit should not wait for it
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error {
+		<-block
+		return nil
+	}}, zap.NewNop())
+
+	newLeader(t, r, 1)
+
+	entry := &pb.Entry{Id: 1, Term: 1}
+	r.appendLogs([]*pb.Entry{entry})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.WaitForCommit(ctx, entry.GetId())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	go r.handleAppendEntriesResult(context.Background(), &appendEntriesResult{
+		AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: true, LastLogId: 1},
+		req:                   &pb.AppendEntriesRequest{Term: 1, Entries: []*pb.Entry{entry}},
+		peerId:                2,
+	})
+
+	// the majority response releases the waiter without another iteration of the main loop, which is not running
+	if err := <-errCh; err != nil {
+		t.Fatal("fail to wait for commit:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("waiter should be released on the majority response, released after %v", elapsed)
+	}
+}
+
+func TestOutOfOrderAppendEntriesResults(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	newLeader(t, r, 1)
+
+	entries := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}}
+	r.appendLogs(entries)
+
+	result := func(numEntries int) *appendEntriesResult {
+		return &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: true, LastLogId: 3},
+			req:                   &pb.AppendEntriesRequest{Term: 1, Entries: entries[:numEntries]},
+			peerId:                2,
+		}
+	}
+
+	// the response of the newer request arrives before the responses of older ones
+	for _, numEntries := range []int{3, 1, 2} {
+		r.handleAppendEntriesResult(context.Background(), result(numEntries))
+		if r.matchIndex[2] != 3 || r.nextIndex[2] != 4 {
+			t.Fatalf("expect match index 3, next index 4, got match index %d, next index %d", r.matchIndex[2], r.nextIndex[2])
+		}
+	}
+	if r.commitIndex != 3 {
+		t.Fatalf("expect commit index 3, got %d", r.commitIndex)
+	}
+}
+
+func TestMinAppliedIndex(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	if _, ok := r.MinAppliedIndex(); ok {
+		t.Fatal("a follower should not report the minimum applied index")
+	}
+
+	newLeader(t, r, 1)
+
+	entries := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}}
+	r.appendLogs(entries)
+
+	if minApplied, ok := r.MinAppliedIndex(); !ok || minApplied != 0 {
+		t.Fatalf("expect minimum applied index 0 before peers report, got %d", minApplied)
+	}
+
+	result := func(peerId uint32, lastApplied uint64) *appendEntriesResult {
+		return &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: true, LastLogId: 3, LastApplied: lastApplied},
+			req:                   &pb.AppendEntriesRequest{Term: 1, Entries: entries},
+			peerId:                peerId,
+		}
+	}
+
+	r.handleAppendEntriesResult(context.Background(), result(2, 2))
+	r.handleAppendEntriesResult(context.Background(), result(3, 1))
+	if r.lastApplied != 3 {
+		t.Fatalf("expect the leader to apply up to log 3, got %d", r.lastApplied)
+	}
+	if minApplied, _ := r.MinAppliedIndex(); minApplied != 1 {
+		t.Fatalf("expect minimum applied index 1, got %d", minApplied)
+	}
+
+	r.handleAppendEntriesResult(context.Background(), result(3, 3))
+	if minApplied, _ := r.MinAppliedIndex(); minApplied != 2 {
+		t.Fatalf("expect minimum applied index 2, got %d", minApplied)
+	}
+}
+
+func TestSnapshotRequestedByThreshold(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+		SnapshotThreshold: 3,
+	}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	apply := func(numLogs int) {
+		for i := 0; i < numLogs; i++ {
+			if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+				t.Fatal("fail to apply command:", err)
+			}
+		}
+	}
+
+	checkNoRequest := func() {
+		select {
+		case id := <-r.SnapshotRequestCh():
+			t.Fatalf("snapshot should not be requested, got request up to log %d", id)
+		default:
+		}
+	}
+
+	checkRequest := func(expectId uint64) {
+		select {
+		case id := <-r.SnapshotRequestCh():
+			if id != expectId {
+				t.Fatalf("snapshot should be requested up to log %d, got %d", expectId, id)
+			}
+		default:
+			t.Fatalf("snapshot should be requested up to log %d", expectId)
+		}
+	}
+
+	apply(3)
+	checkNoRequest()
+
+	apply(1)
+	checkRequest(4)
+
+	// the requested logs are not requested again before they are compacted
+	apply(1)
+	checkNoRequest()
+
+	if _, err := r.snapshot(&snapshotRequest{id: 4, data: []byte("snapshot")}); err != nil {
+		t.Fatal("fail to take snapshot:", err)
+	}
+
+	apply(2)
+	checkNoRequest()
+
+	apply(1)
+	checkRequest(8)
+}
+
+func TestRetainLogEntriesForFollowers(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+		SnapshotThreshold: 3,
+		RetainLogEntries:  5,
+	}, zap.NewNop())
+	newLeader(t, r, 2)
+
+	var entries []*pb.Entry
+	for i := 0; i < 10; i++ {
+		resp, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")})
+		if err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+		entries = append(entries, resp.GetEntry())
+	}
+
+	replicate := func(peerId uint32, lastLogId uint64) {
+		r.handleAppendEntriesResult(context.Background(), &appendEntriesResult{
+			AppendEntriesResponse: &pb.AppendEntriesResponse{Term: r.currentTerm, Success: true, LastLogId: lastLogId, LastApplied: lastLogId},
+			req:                   &pb.AppendEntriesRequest{Term: r.currentTerm, Entries: entries[:lastLogId]},
+			peerId:                peerId,
+		})
+	}
+
+	checkRequest := func(expectId uint64) {
+		select {
+		case id := <-r.SnapshotRequestCh():
+			if id != expectId {
+				t.Fatalf("snapshot should be requested up to log %d, got %d", expectId, id)
+			}
+		default:
+			t.Fatalf("snapshot should be requested up to log %d", expectId)
+		}
+
+		if _, err := r.snapshot(&snapshotRequest{id: expectId, data: []byte("snapshot")}); err != nil {
+			t.Fatal("fail to take snapshot:", err)
+		}
+	}
+
+	// server 2 has not reported yet, it lags too far behind, so only the retained logs are kept for it
+	replicate(3, 7)
+	checkRequest(2)
+
+	// server 3 is slightly behind, logs it still needs are kept
+	replicate(2, 10)
+	if r.lastApplied != 10 {
+		t.Fatalf("expect the leader to apply up to log 10, got %d", r.lastApplied)
+	}
+	checkRequest(7)
+
+	if nextIndex := r.nextIndex[3]; nextIndex <= r.snapshotMeta.LastIncludedId || r.getLog(nextIndex) == nil {
+		t.Fatalf("server 3 should catch up from log %d without a snapshot, logs are compacted up to log %d",
+			nextIndex, r.snapshotMeta.LastIncludedId)
+	}
+}
+
+// bytesPersister hides `SnapshotStore` of the persister, so snapshots are saved and loaded as bytes
+type bytesPersister struct {
+	Persister
+}
+
+func TestSnapshotStream(t *testing.T) {
+	// a large state written in chunks
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	numChunks := 128
+	write := func(w io.Writer) error {
+		for i := 0; i < numChunks; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for name, p := range map[string]Persister{"store": newPersister(), "bytes": &bytesPersister{newPersister()}} {
+		t.Run(name, func(t *testing.T) {
+			r := NewRaft(1, map[uint32]Peer{}, p, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+			r.toFollower(1)
+			r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}})
+			r.commit(3)
+			r.applyCommittedLogs()
+
+			// the snapshot is discarded if it fails to be written
+			failWrite := func(w io.Writer) error {
+				w.Write(chunk)
+				return errors.New("state machine failure")
+			}
+			if _, err := r.snapshot(&snapshotRequest{id: 2, write: failWrite}); err == nil {
+				t.Fatal("snapshot should fail")
+			}
+			if meta, _, _ := p.LoadSnapshot(); meta.LastIncludedId != 0 || r.snapshotMeta.LastIncludedId != 0 {
+				t.Fatalf("failed snapshot should not be saved, got snapshot up to log %d", meta.LastIncludedId)
+			}
+
+			if _, err := r.snapshot(&snapshotRequest{id: 3, write: write}); err != nil {
+				t.Fatal("fail to take snapshot:", err)
+			}
+
+			meta, reader, err := r.SnapshotReader()
+			if err != nil {
+				t.Fatal("fail to open snapshot:", err)
+			}
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal("fail to read snapshot:", err)
+			}
+			if meta.LastIncludedId != 3 || meta.LastIncludedTerm != 1 {
+				t.Fatalf("expect snapshot up to log 3 in term 1, got log %d in term %d", meta.LastIncludedId, meta.LastIncludedTerm)
+			}
+			if !bytes.Equal(data, bytes.Repeat(chunk, numChunks)) {
+				t.Fatalf("restored snapshot of %d bytes does not match the written state", len(data))
+			}
+		})
+	}
+}
+
+func TestSnapshotNow(t *testing.T) {
+	p := newPersister()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	r := NewRaft(1, map[uint32]Peer{}, p, &Config{
+		// the follower never times out while the snapshot is taken
+		HeartbeatTimeout:  10 * time.Second,
+		ElectionTimeout:   10 * time.Second,
+		HeartbeatInterval: 1 * time.Second,
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+		TakeSnapshot: func(id uint64, w io.Writer) error {
+			started <- struct{}{}
+			<-release
+			_, err := fmt.Fprintf(w, "state up to %d", id)
+			return err
+		},
+	}, zap.NewNop())
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}})
+	r.commit(3)
+	r.applyCommittedLogs()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+
+	type result struct {
+		id  uint64
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		id, err := r.SnapshotNow(context.Background())
+		resultCh <- result{id, err}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("snapshot is not taken")
+	}
+
+	// only one snapshot is taken at a time
+	if _, err := r.SnapshotNow(context.Background()); !errors.Is(err, ErrSnapshotInProgress) {
+		t.Fatalf("expect %v while a snapshot is in progress, got %v", ErrSnapshotInProgress, err)
+	}
+
+	close(release)
+	res := <-resultCh
+	if res.err != nil {
+		t.Fatal("fail to take snapshot:", res.err)
+	}
+	if res.id != 3 {
+		t.Fatalf("expect snapshot up to log 3, got log %d", res.id)
+	}
+
+	cancel()
+	<-done
+
+	// the snapshot and the compacted logs are durable
+	meta, data, err := p.LoadSnapshot()
+	if err != nil {
+		t.Fatal("fail to load snapshot:", err)
+	}
+	if meta.LastIncludedId != 3 || string(data) != "state up to 3" {
+		t.Fatalf("expect snapshot of state up to log 3, got %q up to log %d", data, meta.LastIncludedId)
+	}
+
+	restarted := NewRaft(1, map[uint32]Peer{}, p, &Config{}, zap.NewNop())
+	if err := restarted.loadRaftState(p); err != nil {
+		t.Fatal("fail to load raft state:", err)
+	}
+	if len(restarted.logs) != 0 || restarted.snapshotMeta.LastIncludedId != 3 {
+		t.Fatalf("expect logs compacted up to log 3, got %d logs after log %d", len(restarted.logs), restarted.snapshotMeta.LastIncludedId)
+	}
+}
+
+func TestApplyOnShutdown(t *testing.T) {
+	drain, stop := true, false
+
+	for name, tc := range map[string]struct {
+		drain      *bool
+		numApplied int
+	}{
+		"default": {nil, 3},
+		"drain":   {&drain, 3},
+		"stop":    {&stop, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPersister()
+			r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, p, &Config{DrainApplyOnShutdown: tc.drain}, zap.NewNop())
+
+			// logs are committed but not applied yet when the server shuts down
+			r.toFollower(1)
+			r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}})
+			if err := r.saveRaftState(p); err != nil {
+				t.Fatal("fail to save raft state:", err)
+			}
+			r.setCommitIndex(3)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r.Run(ctx)
+
+			if n := len(r.ApplyCh()); n != tc.numApplied || int(r.lastApplied) != tc.numApplied {
+				t.Fatalf("expect %d logs applied on shutdown, got %d logs in the ApplyCh, last applied %d", tc.numApplied, n, r.lastApplied)
+			}
+		})
+	}
+}
+
+func TestRPCWithCancelledContext(t *testing.T) {
+	// the main loop is not running, so any RPC sent to it would block forever
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := map[string]func() error{
+		"ApplyCommand": func() error {
+			_, err := r.ApplyCommand(ctx, &pb.ApplyCommandRequest{})
+			return err
+		},
+		"AppendEntries": func() error {
+			_, err := r.AppendEntries(ctx, &pb.AppendEntriesRequest{})
+			return err
+		},
+		"RequestVote": func() error {
+			_, err := r.RequestVote(ctx, &pb.RequestVoteRequest{})
+			return err
+		},
+		"TimeoutNow": func() error {
+			_, err := r.TimeoutNow(ctx, &pb.TimeoutNowRequest{})
+			return err
+		},
+		"InstallSnapshot": func() error {
+			_, err := r.InstallSnapshot(ctx, &pb.InstallSnapshotRequest{})
+			return err
+		},
+		"AddServer": func() error {
+			_, err := r.AddServer(ctx, &pb.AddServerRequest{})
+			return err
+		},
+		"RemoveServer": func() error {
+			_, err := r.RemoveServer(ctx, &pb.RemoveServerRequest{})
+			return err
+		},
+		"PromoteLearner": func() error {
+			_, err := r.PromoteLearner(ctx, &pb.PromoteLearnerRequest{})
+			return err
+		},
+		"Snapshot": func() error {
+			return r.Snapshot(ctx, 1, nil)
+		},
+	}
+
+	for name, call := range calls {
+		call := call
+
+		t.Run(name, func(t *testing.T) {
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- call()
+			}()
+
+			select {
+			case err := <-errCh:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("expect error %v, got %v", context.Canceled, err)
+				}
+			case <-time.After(1 * time.Second):
+				t.Fatal("RPC should return immediately")
+			}
+		})
+	}
+}
+
+func TestReadyAfterNoopCommitted(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{
+		ApplyFunc:  func(*pb.Entry) error { return nil },
+		LeaderNoop: true,
+	}, zap.NewNop())
+
+	// a log committed in the previous term
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}})
+	r.commit(1)
+
+	newLeader(t, r, 2)
+	if r.Ready() {
+		t.Fatal("leader should not be ready right after election")
+	}
+
+	r.appendNoop(context.Background())
+	if r.Ready() {
+		t.Fatal("leader should not be ready before the no-op log is committed")
+	}
+
+	noop := r.getLog(2)
+	if noop.GetType() != pb.EntryType_NOOP || noop.GetTerm() != r.currentTerm {
+		t.Fatalf("expect no-op log in term %d, got %v", r.currentTerm, noop)
+	}
+
+	r.handleAppendEntriesResult(context.Background(), &appendEntriesResult{
+		AppendEntriesResponse: &pb.AppendEntriesResponse{Term: r.currentTerm, Success: true, LastLogId: 2},
+		req:                   &pb.AppendEntriesRequest{Term: r.currentTerm, PrevLogId: 1, PrevLogTerm: 1, Entries: []*pb.Entry{noop}},
+		peerId:                2,
+	})
+	if !r.Ready() {
+		t.Fatal("leader should be ready once the no-op log is committed")
+	}
+
+	r.toFollower(r.currentTerm + 1)
+	if r.Ready() {
+		t.Fatal("follower should not be ready")
+	}
+}
+
+func TestMaxConcurrentSnapshots(t *testing.T) {
+	numPeers := 4
+	startedCh := make(chan struct{}, numPeers)
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+
+	// InstallSnapshot RPCs are blocked until released
+	peers := make(map[uint32]Peer)
+	for i := 2; i <= numPeers+1; i++ {
+		peers[uint32(i)] = &mockPeer{
+			appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+				return &pb.AppendEntriesResponse{Term: in.GetTerm(), Success: true}, nil
+			},
+			installSnapshotFunc: func(ctx context.Context, in *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+				startedCh <- struct{}{}
+
+				select {
+				case <-releaseCh:
+					return &pb.InstallSnapshotResponse{Term: in.GetTerm()}, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			},
+		}
+	}
+
+	r := NewRaft(1, peers, newPersister(), &Config{
+		ApplyFunc:              func(*pb.Entry) error { return nil },
+		MaxConcurrentSnapshots: 2,
+	}, zap.NewNop())
+
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+	r.commit(2)
+	r.applyCommittedLogs()
+	if _, err := r.snapshot(&snapshotRequest{id: 2}); err != nil {
+		t.Fatal("fail to take snapshot:", err)
+	}
+
+	newLeader(t, r, 2)
+
+	// all followers are far behind and need the snapshot
+	for peerId := range peers {
+		r.setNextAndMatchIndex(peerId, 1, 0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, numPeers)
+	installSnapshotResultCh := make(chan *installSnapshotResult, numPeers)
+
+	checkStarted := func(expect int) {
+		for i := 0; i < expect; i++ {
+			select {
+			case <-startedCh:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("expect %d snapshot transfers to start, got %d", expect, i)
+			}
+		}
+
+		select {
+		case <-startedCh:
+			t.Fatalf("expect %d snapshot transfers to start, got more", expect)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if len(r.snapshotting) != 2 {
+			t.Fatalf("expect 2 snapshot transfers in progress, got %d", len(r.snapshotting))
+		}
+	}
+
+	r.broadcastAppendEntries(ctx, appendEntriesResultCh, installSnapshotResultCh)
+	checkStarted(2)
+
+	// throttled followers are still waiting on the next heartbeat
+	r.broadcastAppendEntries(ctx, appendEntriesResultCh, installSnapshotResultCh)
+	checkStarted(0)
+
+	// a throttled follower takes over once a transfer is done
+	releaseCh <- struct{}{}
+	r.handleInstallSnapshotResult(ctx, <-installSnapshotResultCh)
+	r.broadcastAppendEntries(ctx, appendEntriesResultCh, installSnapshotResultCh)
+	checkStarted(1)
+}
+
+func TestInterleavedAppendEntriesAndRequestVote(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}}, nil, &Config{}, zap.NewNop())
+
+	// checkTimerReset calls the RPC handler and checks whether it resets the election timer
+	checkTimerReset := func(name string, expectReset bool, handle func() error) {
+		before := r.lastHeartbeat
+		time.Sleep(1 * time.Millisecond)
+
+		if err := handle(); err != nil {
+			t.Fatalf("fail to handle %s: %v", name, err)
+		}
+
+		if reset := r.lastHeartbeat.After(before); reset != expectReset {
+			t.Fatalf("%s should reset the election timer: %v, got %v", name, expectReset, reset)
+		}
+	}
+
+	appendEntries := func(term uint64, leaderId uint32, expectSuccess bool) func() error {
+		return func() error {
+			resp, err := r.appendEntries(&pb.AppendEntriesRequest{Term: term, LeaderId: leaderId})
+			if err == nil && resp.GetSuccess() != expectSuccess {
+				return fmt.Errorf("expect success %v, got %v", expectSuccess, resp.GetSuccess())
+			}
+			return err
+		}
+	}
+
+	requestVote := func(term uint64, candidateId uint32, expectGranted bool) func() error {
+		return func() error {
+			resp, err := r.requestVote(&pb.RequestVoteRequest{Term: term, CandidateId: candidateId})
+			if err == nil && resp.GetVoteGranted() != expectGranted {
+				return fmt.Errorf("expect vote granted %v, got %v", expectGranted, resp.GetVoteGranted())
+			}
+			return err
+		}
+	}
+
+	checkVote := func(term uint64, votedFor uint32) {
+		if r.currentTerm != term || r.votedFor != votedFor {
+			t.Fatalf("expect term %d and vote %d, got term %d and vote %d", term, votedFor, r.currentTerm, r.votedFor)
+		}
+	}
+
+	checkTimerReset("heartbeat of term 1", true, appendEntries(1, 2, true))
+	checkVote(1, 0)
+
+	// granting a vote resets the timer exactly as a heartbeat does
+	checkTimerReset("vote request of term 2", true, requestVote(2, 3, true))
+	checkVote(2, 3)
+
+	// the stale leader neither resets the timer nor clears the vote
+	checkTimerReset("heartbeat of term 1", false, appendEntries(1, 2, false))
+	checkVote(2, 3)
+
+	// the retried vote request is granted again
+	checkTimerReset("retried vote request of term 2", true, requestVote(2, 3, true))
+	checkVote(2, 3)
+
+	// a rejected vote request does not reset the timer
+	checkTimerReset("vote request of another candidate", false, requestVote(2, 4, false))
+	checkVote(2, 3)
+
+	// the elected candidate sends heartbeats, the vote is kept in the same term
+	checkTimerReset("heartbeat of term 2", true, appendEntries(2, 3, true))
+	checkVote(2, 3)
+	if r.getLeader() != 3 {
+		t.Fatalf("expect leader 3, got %d", r.getLeader())
+	}
+
+	checkTimerReset("vote request of term 2 after heartbeat", false, requestVote(2, 4, false))
+	checkVote(2, 3)
+}
+
+func TestCompactedCandidateWinElection(t *testing.T) {
+	logs := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}}
+
+	follower := NewRaft(2, map[uint32]Peer{1: &peer{}}, nil, &Config{}, zap.NewNop())
+	follower.toFollower(1)
+	follower.appendLogs(logs)
+
+	// RequestVote RPCs are sent to the handler of the follower directly
+	toFollower := &mockPeer{
+		requestVoteFunc: func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+			return follower.requestVote(in)
+		},
+	}
+	candidate := NewRaft(1, map[uint32]Peer{2: toFollower}, newPersister(), &Config{
+		ApplyFunc: func(*pb.Entry) error { return nil },
+	}, zap.NewNop())
+	candidate.toFollower(1)
+	candidate.appendLogs(logs)
+	candidate.commit(2)
+	candidate.applyCommittedLogs()
+	if _, err := candidate.snapshot(&snapshotRequest{id: 2}); err != nil {
+		t.Fatal("fail to take snapshot:", err)
+	}
+	if len(candidate.logs) != 0 {
+		t.Fatalf("all logs should be compacted, got %d logs", len(candidate.logs))
+	}
+
+	candidate.toCandidate()
+	grantedVotes := 0
+	candidate.voteForSelf(&grantedVotes)
+
+	voteCh := make(chan *voteResult, 1)
+	candidate.broadcastRequestVote(context.Background(), voteCh)
+
+	select {
+	case vote := <-voteCh:
+		if !vote.GetVoteGranted() {
+			t.Fatal("follower with the same logs should grant the vote to the compacted candidate")
+		}
+		candidate.handleVoteResult(context.Background(), vote, &grantedVotes, candidate.numVoters()/2)
+	case <-time.After(1 * time.Second):
+		t.Fatal("vote result should be received")
+	}
+
+	if candidate.state != Leader {
+		t.Fatal("compacted candidate should win the election")
+	}
+}
+
+func TestElectionBackoff(t *testing.T) {
+	voteTimeCh := make(chan time.Time, 100)
+	reject := func() bool { return false }
+	record := func() bool {
+		voteTimeCh <- time.Now()
+		return false
+	}
+
+	r := NewRaft(1, map[uint32]Peer{2: voteBy(record), 3: voteBy(reject)}, newPersister(), &Config{
+		HeartbeatTimeout:  20 * time.Millisecond,
+		ElectionTimeout:   20 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionBackoff:   true,
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Run(ctx)
+
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+
+	var voteTimes []time.Time
+	for len(voteTimeCh) != 0 {
+		voteTimes = append(voteTimes, <-voteTimeCh)
+	}
+
+	// without backoff, the candidate would start an election every 20~40ms
+	if len(voteTimes) < 4 || len(voteTimes) > 12 {
+		t.Fatalf("expect 4 to 12 elections with backoff, got %d", len(voteTimes))
+	}
+
+	firstInterval := voteTimes[1].Sub(voteTimes[0])
+	lastInterval := voteTimes[len(voteTimes)-1].Sub(voteTimes[len(voteTimes)-2])
+	if lastInterval <= firstInterval {
+		t.Fatalf("elections should be less frequent over time, first interval %v, last interval %v", firstInterval, lastInterval)
+	}
+
+	// the backoff is bounded by 8x the election timeout with the random extra
+	if lastInterval > 8*2*20*time.Millisecond+50*time.Millisecond {
+		t.Fatalf("backoff should be bounded, got interval %v", lastInterval)
+	}
+}
+
+func TestApplyChannelBuffer(t *testing.T) {
+	if r := NewRaft(1, map[uint32]Peer{}, nil, &Config{}, zap.NewNop()); cap(r.ApplyCh()) != defaultApplyChannelBuffer {
+		t.Fatalf("expect default apply channel buffer %d, got %d", defaultApplyChannelBuffer, cap(r.ApplyCh()))
+	}
+
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		HeartbeatTimeout:   150 * time.Millisecond,
+		ElectionTimeout:    150 * time.Millisecond,
+		HeartbeatInterval:  50 * time.Millisecond,
+		ApplyChannelBuffer: 1,
+	}, zap.NewNop())
+	if cap(r.ApplyCh()) != 1 {
+		t.Fatalf("expect apply channel buffer 1, got %d", cap(r.ApplyCh()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	time.Sleep(500 * time.Millisecond)
+
+	// the slow consumer falls behind the small buffer while commands keep being applied
+	numLogs := 20
+	appliedCh := make(chan uint64, numLogs)
+	go func() {
+		for i := 0; i < numLogs; i++ {
+			select {
+			case e := <-r.ApplyCh():
+				appliedCh <- e.GetId()
+				time.Sleep(5 * time.Millisecond)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 1; i <= numLogs; i++ {
+		reqCtx, reqCancel := context.WithTimeout(ctx, 1*time.Second)
+		_, err := r.ApplyCommand(reqCtx, &pb.ApplyCommandRequest{Data: []byte("command " + strconv.Itoa(i))})
+		reqCancel()
+		if err != nil {
+			t.Fatalf("fail to apply command %d: %v", i, err)
+		}
+	}
+
+	for i := 1; i <= numLogs; i++ {
+		select {
+		case id := <-appliedCh:
+			if id != uint64(i) {
+				t.Fatalf("expect log %d to be applied, got %d", i, id)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("log %d should be applied", i)
+		}
+	}
+}
+
+func TestFollowerAdoptsNewLeaderTail(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	checkLogs := func(expect []*pb.Entry) {
+		if err := r.verifyInvariants(); err != nil {
+			t.Fatal("invariants should hold:", err)
+		}
+
+		logs, _ := r.DumpLog()
+		if len(logs) != len(expect) {
+			t.Fatalf("expect %d logs, got %d", len(expect), len(logs))
+		}
+		for i, log := range logs {
+			if log.GetId() != expect[i].GetId() || log.GetTerm() != expect[i].GetTerm() || !bytes.Equal(log.GetData(), expect[i].GetData()) {
+				t.Fatalf("expect log %v, got %v", expect[i], log)
+			}
+		}
+	}
+
+	// the leader of term 1 replicates logs 2 and 3, but only log 1 is committed
+	oldTail := []*pb.Entry{{Id: 1, Term: 1, Data: []byte("a")}, {Id: 2, Term: 1, Data: []byte("b")}, {Id: 3, Term: 1, Data: []byte("c")}}
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2, Entries: oldTail})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2, PrevLogId: 3, PrevLogTerm: 1, LeaderCommitId: 1})
+	if err != nil || !resp.GetSuccess() || r.commitIndex != 1 {
+		t.Fatal("fail to commit log 1:", err)
+	}
+	checkLogs(oldTail)
+
+	// the leader of term 2 never received logs 2 and 3, and numbers its own logs from log 2
+	newTail := []*pb.Entry{{Id: 2, Term: 2, Data: []byte("x")}, {Id: 3, Term: 2, Data: []byte("y")}, {Id: 4, Term: 2, Data: []byte("z")}}
+
+	// the new leader probes from its last log, which conflicts with the divergent tail
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 3, PrevLogId: 3, PrevLogTerm: 2, Entries: newTail[2:]})
+	if err != nil || resp.GetSuccess() {
+		t.Fatal("append entries after the conflicting log should be rejected:", err)
+	}
+	checkLogs(oldTail)
+
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 3, PrevLogId: 1, PrevLogTerm: 1, Entries: newTail, LeaderCommitId: 4})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries of the new leader:", err)
+	}
+	checkLogs(append([]*pb.Entry{oldTail[0]}, newTail...))
+
+	if r.commitIndex != 4 {
+		t.Fatalf("expect commit index 4, got %d", r.commitIndex)
+	}
+}
+
+func TestConfigChangeInProgress(t *testing.T) {
+	dialPeer := func(addr string) (Peer, error) {
+		return &peer{}, nil
+	}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, newPersister(), &Config{DialPeer: dialPeer}, zap.NewNop())
+	newLeader(t, r, 1)
+
+	if _, err := r.addServer(&pb.AddServerRequest{ServerId: 4, Address: "server-4"}); err != nil {
+		t.Fatal("fail to add server 4:", err)
+	}
+
+	// the second change is rejected until the first one commits
+	if _, err := r.addServer(&pb.AddServerRequest{ServerId: 5, Address: "server-5"}); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Fatalf("adding server 5 should be rejected, got error: %v", err)
+	}
+	if _, err := r.removeServer(&pb.RemoveServerRequest{ServerId: 3}); !errors.Is(err, ErrConfigChangeInProgress) {
+		t.Fatalf("removing server 3 should be rejected, got error: %v", err)
+	}
+	if _, ok := r.configuration[5]; ok {
+		t.Fatal("server 5 should not be added")
+	}
+
+	r.commit(1)
+
+	if _, err := r.addServer(&pb.AddServerRequest{ServerId: 5, Address: "server-5"}); err != nil {
+		t.Fatal("fail to add server 5 after the previous change commits:", err)
+	}
+	if _, ok := r.configuration[5]; !ok || len(r.configuration) != 5 {
+		t.Fatalf("server 5 should be added, got configuration %v", r.configuration)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	reqCh := make(chan *pb.AppendEntriesRequest, 2)
+	r := NewRaft(1, map[uint32]Peer{2: recordAppendEntries(reqCh)}, nil, &Config{MaxBatchSize: 2}, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(t, r, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+		r.replicateLogs(ctx, appendEntriesResultCh, nil)
+	}
+
+	// logs appended while the first RPC is in flight are coalesced into the next one
+	checkRequest := func(prevLogId uint64, numEntries int) {
+		select {
+		case req := <-reqCh:
+			if req.GetPrevLogId() != prevLogId || len(req.GetEntries()) != numEntries {
+				t.Fatalf("expect %d entries after log %d, got %d entries after log %d",
+					numEntries, prevLogId, len(req.GetEntries()), req.GetPrevLogId())
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("AppendEntries RPC is not sent")
+		}
+	}
+	checkRequest(0, 1)
+	select {
+	case req := <-reqCh:
+		t.Fatalf("no RPC should be sent while an RPC is in flight, got %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// batches are bounded by the max batch size
+	for i := 3; i < 5; i++ {
+		if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+	}
+	r.handleAppendEntriesResult(ctx, <-appendEntriesResultCh)
+	r.replicateLogs(ctx, appendEntriesResultCh, nil)
+	checkRequest(1, 2)
+
+	r.handleAppendEntriesResult(ctx, <-appendEntriesResultCh)
+	r.replicateLogs(ctx, appendEntriesResultCh, nil)
+	checkRequest(3, 2)
+
+	r.handleAppendEntriesResult(ctx, <-appendEntriesResultCh)
+	r.replicateLogs(ctx, appendEntriesResultCh, nil)
+	select {
+	case req := <-reqCh:
+		t.Fatalf("no RPC should be sent once the peer has all logs, got %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if r.commitIndex != 5 {
+		t.Fatalf("expect commit index 5, got %d", r.commitIndex)
+	}
+}
+
+func TestFailedAppendEntriesClearsReplicating(t *testing.T) {
+	var calls int64
+	reqCh := make(chan *pb.AppendEntriesRequest, 2)
+	failFirst := &mockPeer{
+		appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+			reqCh <- in
+			if atomic.AddInt64(&calls, 1) == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return ackAppendEntries(ctx, in)
+		},
+	}
+	r := NewRaft(1, map[uint32]Peer{2: failFirst}, nil, &Config{MaxBatchSize: 2}, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(t, r, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, 1)
+	if _, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")}); err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	r.replicateLogs(ctx, appendEntriesResultCh, nil)
+
+	// the failed RPC is reported, so the peer is no longer considered replicating
+	select {
+	case result := <-appendEntriesResultCh:
+		if result.err == nil {
+			t.Fatalf("expect the result of the failed RPC, got %v", result)
+		}
+		r.handleAppendEntriesResult(ctx, result)
+	case <-time.After(1 * time.Second):
+		t.Fatal("the result of the failed RPC is not sent")
+	}
+	if r.replicating[2] {
+		t.Fatal("the peer should not be replicating after the RPC fails")
+	}
+
+	// the logs are sent again
+	r.replicateLogs(ctx, appendEntriesResultCh, nil)
+	r.handleAppendEntriesResult(ctx, <-appendEntriesResultCh)
+	if len(reqCh) != 2 || r.matchIndex[2] != 1 {
+		t.Fatalf("expect the log to be sent again and matched, got %d RPCs and match index %d", len(reqCh), r.matchIndex[2])
+	}
+}
+
+// BenchmarkBurstyReplication applies bursts of commands and waits for the last one to be committed,
+// the RPC count and the commit latency of each burst are compared between batch sizes
+func BenchmarkBurstyReplication(b *testing.B) {
+	burstSize := 100
+
+	for _, maxBatchSize := range []int{0, 1, 64} {
+		maxBatchSize := maxBatchSize
+
+		b.Run(fmt.Sprintf("MaxBatchSize=%d", maxBatchSize), func(b *testing.B) {
+			counts := map[uint32]*rpcCounts{2: {}, 3: {}}
+			peers := map[uint32]Peer{2: countRPCs(counts[2], time.Millisecond), 3: countRPCs(counts[3], time.Millisecond)}
+			r := NewRaft(1, peers, newPersister(), &Config{
+				HeartbeatTimeout:  100 * time.Millisecond,
+				ElectionTimeout:   100 * time.Millisecond,
+				HeartbeatInterval: 50 * time.Millisecond,
+				ApplyFunc:         func(*pb.Entry) error { return nil },
+				LeaderNoop:        true,
+				MaxBatchSize:      maxBatchSize,
+			}, zap.NewNop())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go r.Run(ctx)
+
+			for !r.Ready() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, p := range counts {
+				atomic.StoreInt64(&p.appendEntries, 0)
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var lastLogId uint64
+				for j := 0; j < burstSize; j++ {
+					resp, err := r.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte(strconv.Itoa(j))})
+					if err != nil {
+						b.Fatal("fail to apply command:", err)
+					}
+					lastLogId = resp.GetEntry().GetId()
+				}
+
+				if err := r.WaitForCommit(ctx, lastLogId); err != nil {
+					b.Fatal("fail to wait for commit:", err)
+				}
+			}
+
+			b.StopTimer()
+
+			rpcs := int64(0)
+			for _, p := range counts {
+				rpcs += atomic.LoadInt64(&p.appendEntries)
+			}
+			b.ReportMetric(float64(rpcs)/float64(b.N), "rpcs/op")
+		})
+	}
+}
+
+// failSnapshotPersister is a Persister that fails saving snapshots for the given number of times
+type failSnapshotPersister struct {
+	*persister
+
+	failures int
+}
+
+func (p *failSnapshotPersister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("disk failure")
+	}
+
+	return p.persister.SaveSnapshot(meta, snapshot)
+}
+
+func TestAppendEntriesDuringSnapshotInstall(t *testing.T) {
+	p := &failSnapshotPersister{persister: newPersister(), failures: 1}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}}, p, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+
+	configuration := toConfigurationProto(map[uint32]string{1: "", 2: ""}, nil, nil)
+	installReq := &pb.InstallSnapshotRequest{Term: 1, LeaderId: 2, LastIncludedId: 5, LastIncludedTerm: 1, Configuration: configuration}
+	appendReq := &pb.AppendEntriesRequest{
+		Term:           1,
+		LeaderId:       2,
+		PrevLogId:      5,
+		PrevLogTerm:    1,
+		Entries:        []*pb.Entry{{Id: 6, Term: 1}},
+		LeaderCommitId: 6,
+	}
+
+	if _, err := r.installSnapshot(installReq); err == nil {
+		t.Fatal("snapshot install should fail")
+	}
+
+	// logs are not appended on top of the partially installed snapshot
+	resp, err := r.appendEntries(appendReq)
+	if err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	if resp.GetSuccess() || resp.GetLastLogId() != 4 {
+		t.Fatalf("expect rejection hinting to retry from log 5, got %v", resp)
+	}
+	if lastLogId, _ := r.getLastLog(); lastLogId != 2 || r.commitIndex != 0 || r.snapshotMeta.LastIncludedId != 0 {
+		t.Fatalf("follower state should not change, got last log %d, commit index %d, snapshot %d",
+			lastLogId, r.commitIndex, r.snapshotMeta.LastIncludedId)
+	}
+
+	// the retried snapshot completes the install
+	if _, err := r.installSnapshot(installReq); err != nil {
+		t.Fatal("fail to install snapshot:", err)
+	}
+	if r.snapshotMeta.LastIncludedId != 5 || r.commitIndex != 5 || len(r.logs) != 0 {
+		t.Fatalf("expect snapshot installed up to log 5, got snapshot %d, commit index %d, %d logs",
+			r.snapshotMeta.LastIncludedId, r.commitIndex, len(r.logs))
+	}
+
+	resp, err = r.appendEntries(appendReq)
+	if err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	if !resp.GetSuccess() || resp.GetLastLogId() != 6 || r.commitIndex != 6 {
+		t.Fatalf("expect logs appended after the snapshot, got %v with commit index %d", resp, r.commitIndex)
+	}
+
+	// an install interrupted by a leader change is abandoned by the new leader
+	p.failures = 1
+	installReq = &pb.InstallSnapshotRequest{Term: 1, LeaderId: 2, LastIncludedId: 10, LastIncludedTerm: 1, Configuration: configuration}
+	if _, err := r.installSnapshot(installReq); err == nil {
+		t.Fatal("snapshot install should fail")
+	}
+	resp, err = r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 3, PrevLogId: 6, PrevLogTerm: 1, Entries: []*pb.Entry{{Id: 7, Term: 2}}})
+	if err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	if !resp.GetSuccess() || resp.GetLastLogId() != 7 {
+		t.Fatalf("expect logs of the new leader appended, got %v", resp)
+	}
+}
+
+func TestRequestVoteDuringSnapshotInstall(t *testing.T) {
+	p := &failSnapshotPersister{persister: newPersister(), failures: 1}
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}, 4: &peer{}}
+	r := NewRaft(1, peers, p, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	r.toFollower(2)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+
+	configuration := toConfigurationProto(map[uint32]string{1: "", 2: "", 3: "", 4: ""}, nil, nil)
+	installReq := &pb.InstallSnapshotRequest{Term: 2, LeaderId: 2, LastIncludedId: 5, LastIncludedTerm: 2, Configuration: configuration}
+	if _, err := r.installSnapshot(installReq); err == nil {
+		t.Fatal("snapshot install should fail")
+	}
+
+	// the candidate is more up-to-date than the local log but behind the snapshot
+	resp, err := r.requestVote(&pb.RequestVoteRequest{Term: 3, CandidateId: 3, LastLogId: 3, LastLogTerm: 1})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if resp.GetVoteGranted() {
+		t.Fatal("candidate behind the snapshot being installed should be rejected")
+	}
+
+	resp, err = r.requestVote(&pb.RequestVoteRequest{Term: 3, CandidateId: 4, LastLogId: 5, LastLogTerm: 2})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if !resp.GetVoteGranted() {
+		t.Fatal("candidate up to the snapshot being installed should be granted")
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestRoleTimeMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	metrics := newTestMetrics()
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}}, nil, &Config{Clock: clock, Metrics: metrics}, zap.NewNop())
+
+	clock.advance(3 * time.Second)
+	r.toCandidate()
+	clock.advance(1 * time.Second)
+	r.toCandidate()
+	clock.advance(2 * time.Second)
+	r.toLeader(r.peers)
+	clock.advance(5 * time.Second)
+	r.toFollower(2)
+	clock.advance(4 * time.Second)
+	r.toFollower(3)
+
+	expect := map[string]time.Duration{
+		MetricFollowerTime:  7 * time.Second,
+		MetricCandidateTime: 3 * time.Second,
+		MetricLeaderTime:    5 * time.Second,
+	}
+	for name, d := range expect {
+		if got := time.Duration(metrics.counter(name)); got != d {
+			t.Fatalf("expect %v counted to %s, got %v", d, name, got)
+		}
+	}
+}
+
+func TestCommitLatencyMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	metrics := newTestMetrics()
+	config := &Config{Clock: clock, Metrics: metrics, ApplyFunc: func(*pb.Entry) error { return nil }}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, config, zap.NewNop())
+
+	newLeader(t, r, 1)
+
+	var entries []*pb.Entry
+	for i := 0; i < 2; i++ {
+		resp, err := r.applyCommand(&pb.ApplyCommandRequest{Data: []byte("command")})
+		if err != nil {
+			t.Fatal("fail to apply command:", err)
+		}
+		entries = append(entries, resp.GetEntry())
+		clock.advance(100 * time.Millisecond)
+	}
+
+	// server 3 is partitioned, so the logs are committed once the slow server 2 responds
+	clock.advance(200 * time.Millisecond)
+	r.handleAppendEntriesResult(context.Background(), &appendEntriesResult{
+		AppendEntriesResponse: &pb.AppendEntriesResponse{Term: 1, Success: true, LastLogId: 2},
+		req:                   &pb.AppendEntriesRequest{Term: 1, Entries: entries},
+		peerId:                2,
+	})
+	if r.commitIndex != 2 {
+		t.Fatalf("expect commit index 2, got %d", r.commitIndex)
+	}
+
+	metrics.mu.Lock()
+	latencies := metrics.observations[MetricCommitLatency]
+	metrics.mu.Unlock()
+
+	expect := map[time.Duration]bool{400 * time.Millisecond: true, 300 * time.Millisecond: true}
+	if len(latencies) != len(expect) {
+		t.Fatalf("expect %d commit latencies, got %v", len(expect), latencies)
+	}
+	for _, latency := range latencies {
+		if !expect[time.Duration(latency)] {
+			t.Fatalf("commit latency should include the replication delay, got %v", time.Duration(latency))
+		}
+	}
+	if len(r.appendedAt) != 0 {
+		t.Fatalf("committed logs should not be tracked, got %d logs", len(r.appendedAt))
+	}
+}
+
+// slowPersister advances the clock by delay on each save, as a slow disk does
+type slowPersister struct {
+	Persister
+
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (p *slowPersister) SaveRaftState(raftState []byte) error {
+	p.clock.advance(p.delay)
+	return p.Persister.SaveRaftState(raftState)
+}
+
+func (p *slowPersister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) error {
+	p.clock.advance(2 * p.delay)
+	return p.Persister.SaveSnapshot(meta, snapshot)
+}
+
+func TestPersistLatencyMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	metrics := newTestMetrics()
+	p := &slowPersister{Persister: newPersister(), clock: clock, delay: 50 * time.Millisecond}
+	config := &Config{Clock: clock, Metrics: metrics, ApplyFunc: func(*pb.Entry) error { return nil }}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, p, config, zap.NewNop())
+
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+	r.commit(2)
+	r.applyCommittedLogs()
+
+	if err := r.persist(context.Background()); err != nil {
+		t.Fatal("fail to save raft state:", err)
+	}
+	if _, err := r.snapshot(&snapshotRequest{id: 2, data: []byte("state")}); err != nil {
+		t.Fatal("fail to take snapshot:", err)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	expect := map[string]time.Duration{
+		MetricPersistRaftStateLatency: 50 * time.Millisecond,
+		MetricPersistSnapshotLatency:  100 * time.Millisecond,
+	}
+	for name, d := range expect {
+		if latencies := metrics.observations[name]; len(latencies) != 1 || time.Duration(latencies[0]) != d {
+			t.Fatalf("expect latency %v observed to %s, got %v", d, name, latencies)
+		}
+	}
+}
+
+func TestRejectMalformedAppendEntries(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}}, nil, &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+
+	logs := []*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}}
+	resp, err := r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2, Entries: logs, LeaderCommitId: 1})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatal("fail to append entries:", err)
+	}
+
+	for name, req := range map[string]*pb.AppendEntriesRequest{
+		"entries before the previous log": {Term: 1, LeaderId: 2, PrevLogId: 3, PrevLogTerm: 1,
+			Entries: []*pb.Entry{{Id: 2, Term: 1}, {Id: 3, Term: 1}, {Id: 4, Term: 1}}},
+		"entries after a gap": {Term: 1, LeaderId: 2, PrevLogId: 3, PrevLogTerm: 1,
+			Entries: []*pb.Entry{{Id: 5, Term: 1}}},
+		"non-contiguous entries": {Term: 1, LeaderId: 2, PrevLogId: 1, PrevLogTerm: 1,
+			Entries: []*pb.Entry{{Id: 2, Term: 1}, {Id: 4, Term: 1}}},
+		"conflicting non-contiguous entries": {Term: 1, LeaderId: 2, PrevLogId: 1, PrevLogTerm: 1,
+			Entries: []*pb.Entry{{Id: 2, Term: 1}, {Id: 2, Term: 2}}, LeaderCommitId: 3},
+	} {
+		resp, err := r.appendEntries(req)
+		if err != nil {
+			t.Fatal("fail to append entries:", err)
+		}
+		if resp.GetSuccess() {
+			t.Fatalf("append entries with %s should be rejected", name)
+		}
+
+		// the log and the commit index are not changed
+		got, _ := r.dumpLogs()
+		if len(got) != len(logs) || r.commitIndex != 1 {
+			t.Fatalf("log should not change after %s, got %d logs and commit index %d", name, len(got), r.commitIndex)
+		}
+		for i, log := range got {
+			if log.GetId() != logs[i].GetId() || log.GetTerm() != logs[i].GetTerm() {
+				t.Fatalf("log should not change after %s, expect %v, got %v", name, logs[i], log)
+			}
+		}
+	}
+}
+
+func TestRestartWithPersistedTerm(t *testing.T) {
+	p := newPersister()
+	config := &Config{
+		HeartbeatTimeout:  10 * time.Second,
+		ElectionTimeout:   10 * time.Second,
+		HeartbeatInterval: 1 * time.Second,
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+	}
+
+	// the server crashes after it voted in term 5
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, p, config, zap.NewNop())
+	r.toFollower(5)
+	r.voteFor(2, false)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 3}, {Id: 2, Term: 5}})
+	if err := r.saveRaftState(p); err != nil {
+		t.Fatal("fail to save raft state:", err)
+	}
+
+	r = NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, p, config, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	// stale leaders and candidates are rejected with the persisted term
+	aeResp, err := r.AppendEntries(ctx, &pb.AppendEntriesRequest{Term: 3, LeaderId: 2, PrevLogId: 2, PrevLogTerm: 5})
+	if err != nil {
+		t.Fatal("fail to append entries:", err)
+	}
+	if aeResp.GetSuccess() || aeResp.GetTerm() != 5 {
+		t.Fatalf("append entries of a lower term should be rejected with term 5, got %v", aeResp)
+	}
+
+	rvResp, err := r.RequestVote(ctx, &pb.RequestVoteRequest{Term: 4, CandidateId: 3, LastLogId: 10, LastLogTerm: 4})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if rvResp.GetVoteGranted() || rvResp.GetTerm() != 5 {
+		t.Fatalf("request vote of a lower term should be rejected with term 5, got %v", rvResp)
+	}
+
+	// the persisted vote is kept, so the server does not vote twice in the term
+	rvResp, err = r.RequestVote(ctx, &pb.RequestVoteRequest{Term: 5, CandidateId: 3, LastLogId: 10, LastLogTerm: 5})
+	if err != nil {
+		t.Fatal("fail to request vote:", err)
+	}
+	if rvResp.GetVoteGranted() {
+		t.Fatal("vote should not be granted twice in the persisted term")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.currentTerm != 5 || r.votedFor != 2 {
+		t.Fatalf("expect term 5 voted for 2, got term %d voted for %d", r.currentTerm, r.votedFor)
+	}
+	if lastLogId, lastLogTerm := r.getLastLog(); lastLogId != 2 || lastLogTerm != 5 {
+		t.Fatalf("expect last log 2 of term 5, got log %d of term %d", lastLogId, lastLogTerm)
+	}
+}
+
+func TestLoadCorruptedRaftState(t *testing.T) {
+	p := newPersister()
+	p.SaveRaftState([]byte("corrupted"))
+
+	rs := &raftState{}
+	if err := rs.loadRaftState(p); err == nil {
+		t.Fatal("loading corrupted raft state should fail")
+	}
+}
+
+func TestStartWithTruncatedLogs(t *testing.T) {
+	p := newPersister()
+	peers := map[uint32]Peer{2: &peer{}, 3: &peer{}}
+	r := NewRaft(1, peers, p, &Config{}, zap.NewNop())
+
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}, {Id: 4, Term: 1}, {Id: 5, Term: 1}})
+	r.setCommitIndex(5)
+	if err := r.persist(context.Background()); err != nil {
+		t.Fatal("fail to persist:", err)
+	}
+	if err := NewRaft(1, peers, p, &Config{}, zap.NewNop()).loadRaftState(p); err != nil {
+		t.Fatal("fail to load raft state:", err)
+	}
+
+	// the log file loses committed logs, but the commit index survives
+	r.logs = r.logs[:3]
+	if err := r.persist(context.Background()); err != nil {
+		t.Fatal("fail to persist:", err)
+	}
+
+	restarted := NewRaft(1, peers, p, &Config{}, zap.NewNop())
+	if err := restarted.loadRaftState(p); !errors.Is(err, errCorruptedLogs) {
+		t.Fatalf("expect errCorruptedLogs, got %v", err)
+	}
+
+	// the server refuses to start instead of serving the stale state
+	restarted = NewRaft(1, peers, p, &Config{}, zap.NewNop())
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		restarted.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the server should refuse to start with truncated logs")
+	}
+	if restarted.IsLeader() || restarted.commitIndex != 0 {
+		t.Fatal("the server should not serve the truncated logs")
+	}
+
+	// a truncated raft state fails to decode
+	state, _ := p.LoadRaftState()
+	p.SaveRaftState(state[:len(state)/2])
+	if err := NewRaft(1, peers, p, &Config{}, zap.NewNop()).loadRaftState(p); err == nil {
+		t.Fatal("loading truncated raft state should fail")
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sampling *LogSampling
+		numLogs  int
+	}{
+		{name: "all", sampling: nil, numLogs: 10},
+		{name: "sampled", sampling: &LogSampling{Tick: time.Minute, First: 2, Thereafter: 4}, numLogs: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			r := NewRaft(1, map[uint32]Peer{2: &peer{}}, nil, &Config{LogSampling: tc.sampling}, zap.New(core))
+			r.toFollower(2)
+
+			// heartbeats of a stale leader are rejected with the same log
+			for i := 0; i < 10; i++ {
+				r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2})
+			}
+
+			if n := logs.FilterMessage("reject append entries since current term is older").Len(); n != tc.numLogs {
+				t.Fatalf("expect %d logs, got %d", tc.numLogs, n)
+			}
+		})
+	}
+}
+
+func TestDuplicateLeaderAlarm(t *testing.T) {
+	var violations []error
+	core, logs := observer.New(zap.InfoLevel)
+	config := &Config{OnSafetyViolation: func(err error) { violations = append(violations, err) }}
+	r := NewRaft(1, map[uint32]Peer{2: &peer{}, 3: &peer{}}, nil, config, zap.New(core))
+
+	r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2})
+	r.appendEntries(&pb.AppendEntriesRequest{Term: 1, LeaderId: 2})
+	if len(violations) != 0 {
+		t.Fatal("heartbeats of the same leader should not raise the alarm:", violations)
+	}
+
+	// a new leader of a newer term is expected
+	r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 3})
+	if len(violations) != 0 {
+		t.Fatal("the leader of a newer term should not raise the alarm:", violations)
+	}
+
+	r.appendEntries(&pb.AppendEntriesRequest{Term: 2, LeaderId: 2})
+	if len(violations) != 1 || !errors.Is(violations[0], ErrSafetyViolation) {
+		t.Fatalf("expect an alarm of two leaders in term 2, got %v", violations)
+	}
+	if logs.FilterMessage("safety violation").FilterLevelExact(zap.DPanicLevel).Len() != 1 {
+		t.Fatal("the violation should be logged at DPanic level")
+	}
+}
+
+func TestPausePeer(t *testing.T) {
+	var paused, active rpcCounts
+	r := NewRaft(1, map[uint32]Peer{2: countRPCs(&paused, 0), 3: countRPCs(&active, 0)}, nil, &Config{}, zap.NewNop())
+	defer r.workers.stop()
+
+	if _, err := r.pausePeer(&pausePeerRequest{id: 4, paused: true}); !errors.Is(err, errUnknownPeer) {
+		t.Fatal("pausing an unknown peer should fail, got error:", err)
+	}
+	if _, err := r.pausePeer(&pausePeerRequest{id: 2, paused: true}); err != nil {
+		t.Fatal("fail to pause peer:", err)
+	}
+
+	ctx := context.Background()
+
+	// checkRPCs broadcasts RequestVote and AppendEntries RPCs and checks the number of RPCs each peer received
+	checkRPCs := func(expectPaused, expectActive int64) {
+		r.toCandidate()
+		r.voteFor(r.id, true)
+		voteCh := make(chan *voteResult, 2)
+		r.broadcastRequestVote(ctx, voteCh)
+
+		r.toLeader(r.peers)
+		appendEntriesResultCh := make(chan *appendEntriesResult, 2)
+		r.broadcastAppendEntries(ctx, appendEntriesResultCh, nil)
+
+		// RPCs to the active peer are done after its results arrive
+		<-voteCh
+		<-appendEntriesResultCh
+		time.Sleep(100 * time.Millisecond)
+
+		if votes, rpcs := atomic.LoadInt64(&paused.requestVote), atomic.LoadInt64(&paused.appendEntries); votes != expectPaused || rpcs != expectPaused {
+			t.Fatalf("expect %d RPCs of each type to the paused peer, got %d RequestVote and %d AppendEntries", expectPaused, votes, rpcs)
+		}
+		if votes, rpcs := atomic.LoadInt64(&active.requestVote), atomic.LoadInt64(&active.appendEntries); votes != expectActive || rpcs != expectActive {
+			t.Fatalf("expect %d RPCs of each type to the active peer, got %d RequestVote and %d AppendEntries", expectActive, votes, rpcs)
+		}
+
+		r.toFollower(r.currentTerm)
+	}
+
+	checkRPCs(0, 1)
+
+	if _, err := r.pausePeer(&pausePeerRequest{id: 2, paused: false}); err != nil {
+		t.Fatal("fail to resume peer:", err)
+	}
+	checkRPCs(1, 2)
+}
+
+func TestLastContactOfStalledPeer(t *testing.T) {
+	stalled := stallRPCs(make(chan error, 1000))
+	r := NewRaft(1, map[uint32]Peer{2: countRPCs(&rpcCounts{}, 0), 3: stalled}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		RPCTimeout:        20 * time.Millisecond,
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	before, err := r.ReplicationStatus(ctx)
+	if err != nil {
+		t.Fatal("fail to get replication status:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	after, err := r.ReplicationStatus(ctx)
+	if err != nil {
+		t.Fatal("fail to get replication status:", err)
+	}
+
+	// the quorum holds with the responsive peer, while the stalled peer is never heard from
+	if r.LeaderId() != r.id {
+		t.Fatal("server should be the leader with the responsive peer")
+	}
+	if !after[2].LastContact.After(before[2].LastContact) {
+		t.Fatalf("last contact of the responsive peer should advance, got %v and then %v", before[2].LastContact, after[2].LastContact)
+	}
+	if !before[3].LastContact.IsZero() || !after[3].LastContact.IsZero() {
+		t.Fatalf("last contact of the stalled peer should not advance, got %v and then %v", before[3].LastContact, after[3].LastContact)
+	}
 }
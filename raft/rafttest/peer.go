@@ -0,0 +1,107 @@
+// Package rafttest provides fakes for testing applications built on raft without a network.
+package rafttest
+
+import (
+	"context"
+
+	"github.com/justin0u0/raft/pb"
+	"github.com/justin0u0/raft/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PeerMock is a raft.Peer whose RPCs are handled by the func field of the same name, RPCs whose func field is nil
+// fail with codes.Unimplemented, so a test sets only the RPCs it expects.
+//
+// Note that RPCs are sent concurrently, the func fields must be safe for concurrent use.
+type PeerMock struct {
+	ApplyCommandFunc       func(ctx context.Context, in *pb.ApplyCommandRequest) (*pb.ApplyCommandResponse, error)
+	ApplyCommandStreamFunc func(ctx context.Context, in *pb.ApplyCommandRequest) (pb.Raft_ApplyCommandStreamClient, error)
+	AppendEntriesFunc      func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error)
+	RequestVoteFunc        func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error)
+	TimeoutNowFunc         func(ctx context.Context, in *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error)
+	InstallSnapshotFunc    func(ctx context.Context, in *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error)
+	AddServerFunc          func(ctx context.Context, in *pb.AddServerRequest) (*pb.AddServerResponse, error)
+	RemoveServerFunc       func(ctx context.Context, in *pb.RemoveServerRequest) (*pb.RemoveServerResponse, error)
+	PromoteLearnerFunc     func(ctx context.Context, in *pb.PromoteLearnerRequest) (*pb.PromoteLearnerResponse, error)
+}
+
+var _ raft.Peer = (*PeerMock)(nil)
+
+// unimplemented returns the error of an RPC whose func field is not set
+func unimplemented(method string) error {
+	return status.Errorf(codes.Unimplemented, "rafttest: %s is not mocked", method)
+}
+
+func (p *PeerMock) ApplyCommand(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (*pb.ApplyCommandResponse, error) {
+	if p.ApplyCommandFunc == nil {
+		return nil, unimplemented("ApplyCommand")
+	}
+
+	return p.ApplyCommandFunc(ctx, in)
+}
+
+func (p *PeerMock) ApplyCommandStream(ctx context.Context, in *pb.ApplyCommandRequest, opts ...grpc.CallOption) (pb.Raft_ApplyCommandStreamClient, error) {
+	if p.ApplyCommandStreamFunc == nil {
+		return nil, unimplemented("ApplyCommandStream")
+	}
+
+	return p.ApplyCommandStreamFunc(ctx, in)
+}
+
+func (p *PeerMock) AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest, opts ...grpc.CallOption) (*pb.AppendEntriesResponse, error) {
+	if p.AppendEntriesFunc == nil {
+		return nil, unimplemented("AppendEntries")
+	}
+
+	return p.AppendEntriesFunc(ctx, in)
+}
+
+func (p *PeerMock) RequestVote(ctx context.Context, in *pb.RequestVoteRequest, opts ...grpc.CallOption) (*pb.RequestVoteResponse, error) {
+	if p.RequestVoteFunc == nil {
+		return nil, unimplemented("RequestVote")
+	}
+
+	return p.RequestVoteFunc(ctx, in)
+}
+
+func (p *PeerMock) TimeoutNow(ctx context.Context, in *pb.TimeoutNowRequest, opts ...grpc.CallOption) (*pb.TimeoutNowResponse, error) {
+	if p.TimeoutNowFunc == nil {
+		return nil, unimplemented("TimeoutNow")
+	}
+
+	return p.TimeoutNowFunc(ctx, in)
+}
+
+func (p *PeerMock) InstallSnapshot(ctx context.Context, in *pb.InstallSnapshotRequest, opts ...grpc.CallOption) (*pb.InstallSnapshotResponse, error) {
+	if p.InstallSnapshotFunc == nil {
+		return nil, unimplemented("InstallSnapshot")
+	}
+
+	return p.InstallSnapshotFunc(ctx, in)
+}
+
+func (p *PeerMock) AddServer(ctx context.Context, in *pb.AddServerRequest, opts ...grpc.CallOption) (*pb.AddServerResponse, error) {
+	if p.AddServerFunc == nil {
+		return nil, unimplemented("AddServer")
+	}
+
+	return p.AddServerFunc(ctx, in)
+}
+
+func (p *PeerMock) RemoveServer(ctx context.Context, in *pb.RemoveServerRequest, opts ...grpc.CallOption) (*pb.RemoveServerResponse, error) {
+	if p.RemoveServerFunc == nil {
+		return nil, unimplemented("RemoveServer")
+	}
+
+	return p.RemoveServerFunc(ctx, in)
+}
+
+func (p *PeerMock) PromoteLearner(ctx context.Context, in *pb.PromoteLearnerRequest, opts ...grpc.CallOption) (*pb.PromoteLearnerResponse, error) {
+	if p.PromoteLearnerFunc == nil {
+		return nil, unimplemented("PromoteLearner")
+	}
+
+	return p.PromoteLearnerFunc(ctx, in)
+}
@@ -0,0 +1,85 @@
+package rafttest_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"github.com/justin0u0/raft/raft"
+	"github.com/justin0u0/raft/raft/rafttest"
+	"go.uber.org/zap"
+)
+
+func newConfig() *raft.Config {
+	return &raft.Config{
+		HeartbeatTimeout:  50 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+}
+
+// run runs the server for the given duration
+func run(r *raft.Raft, d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	r.Run(ctx)
+}
+
+func TestPeerMockRejectVotes(t *testing.T) {
+	var votes int64
+	rejectVote := func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+		atomic.AddInt64(&votes, 1)
+		return &pb.RequestVoteResponse{Term: in.GetTerm(), VoteGranted: false}, nil
+	}
+
+	peers := map[uint32]raft.Peer{
+		2: &rafttest.PeerMock{RequestVoteFunc: rejectVote},
+		3: &rafttest.PeerMock{RequestVoteFunc: rejectVote},
+	}
+	r := raft.NewRaft(1, peers, &rafttest.Persister{}, newConfig(), zap.NewNop())
+
+	run(r, 500*time.Millisecond)
+
+	if atomic.LoadInt64(&votes) == 0 {
+		t.Fatal("the server should request votes from peers")
+	}
+	if r.IsLeader() {
+		t.Fatal("the server should not become the leader without votes")
+	}
+}
+
+func TestPeerMockDelayHeartbeats(t *testing.T) {
+	var heartbeats int64
+	grantVote := func(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+		return &pb.RequestVoteResponse{Term: in.GetTerm(), VoteGranted: true}, nil
+	}
+	delayHeartbeat := func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		atomic.AddInt64(&heartbeats, 1)
+		lastLogId := in.GetPrevLogId() + uint64(len(in.GetEntries()))
+		return &pb.AppendEntriesResponse{Term: in.GetTerm(), Success: true, LastLogId: lastLogId}, nil
+	}
+
+	peers := map[uint32]raft.Peer{
+		2: &rafttest.PeerMock{RequestVoteFunc: grantVote, AppendEntriesFunc: delayHeartbeat},
+		3: &rafttest.PeerMock{RequestVoteFunc: grantVote, AppendEntriesFunc: delayHeartbeat},
+	}
+	r := raft.NewRaft(1, peers, &rafttest.Persister{}, newConfig(), zap.NewNop())
+
+	run(r, 500*time.Millisecond)
+
+	if !r.IsLeader() {
+		t.Fatal("the server should stay the leader while heartbeats are delayed")
+	}
+	if atomic.LoadInt64(&heartbeats) == 0 {
+		t.Fatal("delayed heartbeats should be acknowledged")
+	}
+}
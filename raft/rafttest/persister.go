@@ -0,0 +1,66 @@
+package rafttest
+
+import (
+	"sync"
+
+	"github.com/justin0u0/raft/raft"
+)
+
+// Persister is an in-memory raft.Persister for tests, its zero value is ready to use
+type Persister struct {
+	raftState    []byte
+	snapshotMeta raft.SnapshotMeta
+	snapshot     []byte
+	mu           sync.Mutex
+}
+
+var _ raft.Persister = (*Persister)(nil)
+
+func (p *Persister) SaveRaftState(raftState []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.raftState = append([]byte(nil), raftState...)
+
+	return nil
+}
+
+func (p *Persister) LoadRaftState() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.raftState, nil
+}
+
+func (p *Persister) SaveSnapshot(meta raft.SnapshotMeta, snapshot []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshotMeta = meta
+	p.snapshotMeta.Configuration = make(map[uint32]string, len(meta.Configuration))
+	for id, addr := range meta.Configuration {
+		p.snapshotMeta.Configuration[id] = addr
+	}
+	p.snapshotMeta.Learners = copyServers(meta.Learners)
+	p.snapshotMeta.Observers = copyServers(meta.Observers)
+
+	p.snapshot = append([]byte(nil), snapshot...)
+
+	return nil
+}
+
+func (p *Persister) LoadSnapshot() (raft.SnapshotMeta, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snapshotMeta, p.snapshot, nil
+}
+
+func copyServers(servers map[uint32]bool) map[uint32]bool {
+	copied := make(map[uint32]bool, len(servers))
+	for id, ok := range servers {
+		copied[id] = ok
+	}
+
+	return copied
+}
@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+)
+
+type readIndexRequest struct{}
+
+type readIndexResponse struct {
+	index uint64
+}
+
+// readIndex returns the commit index if the leader has committed a log in its term and a majority of voters
+// responded to it within the heartbeat timeout, so no other leader could have committed logs after the index
+func (r *Raft) readIndex(req *readIndexRequest) (*readIndexResponse, error) {
+	if r.state != Leader {
+		return nil, errNotLeader
+	}
+
+	// the commit index includes logs committed by previous leaders only after a log of the current term is committed
+	if r.commitIndex == 0 || r.getLogTerm(r.commitIndex) != r.currentTerm {
+		return nil, errLeaderNotReady
+	}
+
+	active, voters := 0, r.numVoters()
+	if r.isVoter(r.id) {
+		active++
+	}
+	for peerId := range r.peers {
+		if peerId != r.id && r.isVoter(peerId) && r.isActive(peerId) {
+			active++
+		}
+	}
+	if active <= voters/2 {
+		return nil, fmt.Errorf("%w: only %d of %d voters are active", errLeaseExpired, active, voters)
+	}
+
+	return &readIndexResponse{index: r.commitIndex}, nil
+}
+
+// ReadIndex returns the index that reads must wait to be applied before they are served, reads served after logs
+// up to the index are applied, on the leader or through `FollowerRead` on any other server, observe all writes
+// committed before ReadIndex is called, it is rejected if the server is not a ready leader holding a lease
+func (r *Raft) ReadIndex(ctx context.Context) (uint64, error) {
+	rpcResp, err := r.dispatchRPCRequest(ctx, &readIndexRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, ok := rpcResp.(*readIndexResponse)
+	if !ok {
+		return 0, errResponseTypeMismatch
+	}
+
+	return resp.index, nil
+}
+
+// FollowerRead blocks until logs up to the read index obtained from the leader by `ReadIndex` are applied to the
+// state machine, or returns the error of the context, so followers serve reads and the leader is not the only one,
+// logs sent to the ApplyCh are applied once the state machine acknowledges them by Applied
+func (r *Raft) FollowerRead(ctx context.Context, readIndex uint64) error {
+	return r.waitForApply(ctx, readIndex)
+}
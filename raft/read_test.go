@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+func TestFollowerRead(t *testing.T) {
+	var mu sync.Mutex
+	values := make(map[uint32]map[uint64]string)
+
+	c := newClusterWithConfig(t, 3, func(id uint32, config *Config) {
+		values[id] = make(map[uint64]string)
+		config.ApplyFunc = func(log *pb.Entry) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			values[id][log.GetId()] = string(log.GetData())
+			return nil
+		}
+	})
+	defer c.stopAll()
+
+	time.Sleep(1 * time.Second)
+
+	leaderId, term := c.checkSingleLeader()
+	leader := c.rafts[leaderId]
+	followerId := leaderId%3 + 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// the leader does not know logs committed by previous leaders until it commits a log in its term
+	if _, err := leader.ReadIndex(ctx); !errors.Is(err, errLeaderNotReady) {
+		t.Fatal("read index should be rejected before the leader commits a log, got error:", err)
+	}
+
+	logId := c.applyCommand(leaderId, term, []byte("value"))
+	if err := leader.WaitForCommit(ctx, logId); err != nil {
+		t.Fatal("fail to wait for commit:", err)
+	}
+
+	readIndex, err := leader.ReadIndex(ctx)
+	if err != nil {
+		t.Fatal("fail to get read index:", err)
+	}
+	if readIndex < logId {
+		t.Fatalf("read index %d should include the committed log %d", readIndex, logId)
+	}
+
+	if _, err := c.rafts[followerId].ReadIndex(ctx); !errors.Is(err, errNotLeader) {
+		t.Fatal("read index should be rejected by followers, got error:", err)
+	}
+
+	if err := c.rafts[followerId].FollowerRead(ctx, readIndex); err != nil {
+		t.Fatal("fail to read from the follower:", err)
+	}
+
+	mu.Lock()
+	value := values[followerId][logId]
+	mu.Unlock()
+	if value != "value" {
+		t.Fatalf("the follower should serve the committed value, got %q", value)
+	}
+
+	// the leader cut off from the majority cannot grant read indexes once its lease expires
+	c.disconnectAll(leaderId)
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := leader.ReadIndex(context.Background()); !errors.Is(err, errLeaseExpired) && !errors.Is(err, errNotLeader) {
+		t.Fatal("read index should be rejected after the lease expires, got error:", err)
+	}
+}
+
+func TestFollowerReadWaitsForApplyChAck(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	resp, err := r.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte("value")})
+	if err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	logId := resp.GetEntry().GetId()
+
+	readCtx, readCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer readCancel()
+
+	// the log is sent to the ApplyCh, but the state machine has not taken it yet
+	if err := r.FollowerRead(readCtx, logId); err != context.DeadlineExceeded {
+		t.Fatal("read should wait for the state machine, got error:", err)
+	}
+
+	for e := range r.ApplyCh() {
+		r.Applied(e.GetId())
+		if e.GetId() >= logId {
+			break
+		}
+	}
+
+	readCtx, readCancel = context.WithTimeout(ctx, 1*time.Second)
+	defer readCancel()
+
+	if err := r.FollowerRead(readCtx, logId); err != nil {
+		t.Fatal("fail to read once the state machine acknowledges the log:", err)
+	}
+}
@@ -23,13 +23,81 @@ func (r *rpc) respond(resp interface{}, err error) {
 }
 
 var (
-	errRPCTimeout           = errors.New("rpc timeout")
 	errResponseTypeMismatch = errors.New("response type mismatch")
 	errInvalidRPCType       = errors.New("invalid rpc type")
 	errNotLeader            = errors.New("not leader")
+	errNonContiguousLogs    = errors.New("non-contiguous logs")
+	errNoAddress            = errors.New("address is not configured")
+	errUnsafeRemoval        = errors.New("unsafe server removal")
+	errNoTransferTarget     = errors.New("no server is caught up to take over leadership")
+	errInvalidSnapshot      = errors.New("invalid snapshot")
+	errAlreadyLeader        = errors.New("already leader")
+	errNotVoter             = errors.New("not a voter")
+	errLearnerNotCaughtUp   = errors.New("learner is not caught up")
+	errObserver             = errors.New("observer cannot be promoted")
+	errLeaderNotReady       = errors.New("leader has not committed a log in its term")
+	errLeaseExpired         = errors.New("leader lease expired")
+	errUnknownPeer          = errors.New("unknown peer")
+	errShutdown             = errors.New("raft is shut down")
+	errUnknownGroup         = errors.New("unknown raft group")
+	errInvalidPeerId        = errors.New("invalid peer ID")
+	errCorruptedLogs        = errors.New("corrupted logs")
+	errNoTakeSnapshot       = errors.New("TakeSnapshot is not configured")
+	errClusterMismatch      = errors.New("request from another cluster")
 )
 
+// ErrLeadershipLost is returned to callers waiting for logs to be committed when the leader steps down,
+// the logs may or may not be committed by the new leader, it is also returned by ApplyCommand for commands submitted
+// against a stale `LeadershipEpoch`
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// ErrLeadershipTransferInProgress is returned by ApplyCommand while the leader hands over its leadership,
+// the returned error is a `*LeadershipTransferError` with the target of the transfer
+var ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
+
+// LeadershipTransferError hints the server taking over the leadership, so clients can redirect commands to it
+type LeadershipTransferError struct {
+	TargetId      uint32
+	TargetAddress string
+}
+
+func (e *LeadershipTransferError) Error() string {
+	return fmt.Sprintf("%v: target %d", ErrLeadershipTransferInProgress, e.TargetId)
+}
+
+func (e *LeadershipTransferError) Unwrap() error {
+	return ErrLeadershipTransferInProgress
+}
+
+// ErrSafetyViolation is reported to `OnSafetyViolation` if the server observes a violation of raft safety, such as
+// two leaders in the same term
+var ErrSafetyViolation = errors.New("safety violation")
+
+// ErrTooManyRequests is returned by ApplyCommand if `MaxInflight` logs are not committed yet, the command can be
+// retried once replication catches up
+var ErrTooManyRequests = errors.New("too many requests")
+
+// ErrCommandTooLarge is returned by ApplyCommand if the command log is larger than `MaxCommandSize`
+var ErrCommandTooLarge = errors.New("command too large")
+
+// ErrRunning is returned by Reset if Run is in progress, since the state of a running node must not be wiped
+var ErrRunning = errors.New("raft is running")
+
+// ErrSnapshotInProgress is returned by SnapshotNow if the previous SnapshotNow is not done yet
+var ErrSnapshotInProgress = errors.New("snapshot in progress")
+
+// ErrConfigChangeInProgress is returned by membership changes while the previous configuration log is not committed,
+// since servers are added or removed one at a time
+var ErrConfigChangeInProgress = errors.New("configuration change in progress")
+
+// ApplyCommand appends the command to the leader's logs, the returned entry carries both the index and the term of the
+// log, so callers can tell if it is overwritten by a new leader with `Committed`
 func (r *Raft) ApplyCommand(ctx context.Context, req *pb.ApplyCommandRequest) (*pb.ApplyCommandResponse, error) {
+	// a stale leadership is fenced off right away, without waiting for the main loop
+	if err := r.checkLeadershipEpoch(req.GetLeadershipEpoch()); err != nil {
+		return nil, err
+	}
+
 	rpcResp, err := r.dispatchRPCRequest(ctx, req)
 	if err != nil {
 		return nil, err
@@ -40,14 +108,48 @@ func (r *Raft) ApplyCommand(ctx context.Context, req *pb.ApplyCommandRequest) (*
 		return nil, errResponseTypeMismatch
 	}
 
-	if err := r.saveRaftState(r.persister); err != nil {
+	if err := r.persist(ctx); err != nil {
 		return nil, fmt.Errorf("fail to save raft state: %w", err)
 	}
 
 	return resp, nil
 }
 
+// ApplyCommandStream applies the command and streams its stages, the stream ends once the command is applied by the
+// state machine, which acknowledges logs sent to the ApplyCh by Applied, or with the error if the command cannot be
+// appended or the leader steps down before the command is committed
+func (r *Raft) ApplyCommandStream(req *pb.ApplyCommandRequest, stream pb.Raft_ApplyCommandStreamServer) error {
+	ctx := stream.Context()
+
+	resp, err := r.ApplyCommand(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	entry := resp.GetEntry()
+	if err := stream.Send(&pb.ApplyCommandStatus{Stage: pb.ApplyCommandStage_APPENDED, Entry: entry}); err != nil {
+		return err
+	}
+
+	if err := r.WaitForCommit(ctx, entry.GetId()); err != nil {
+		return err
+	}
+	if err := stream.Send(&pb.ApplyCommandStatus{Stage: pb.ApplyCommandStage_COMMITTED, Entry: entry}); err != nil {
+		return err
+	}
+
+	if err := r.waitForApply(ctx, entry.GetId()); err != nil {
+		return err
+	}
+
+	return stream.Send(&pb.ApplyCommandStatus{Stage: pb.ApplyCommandStage_APPLIED, Entry: entry})
+}
+
 func (r *Raft) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
 	rpcResp, err := r.dispatchRPCRequest(ctx, req)
 	if err != nil {
 		return nil, err
@@ -58,7 +160,7 @@ func (r *Raft) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest)
 		return nil, errResponseTypeMismatch
 	}
 
-	if err := r.saveRaftState(r.persister); err != nil {
+	if err := r.persist(ctx); err != nil {
 		return nil, fmt.Errorf("fail to save raft state: %w", err)
 	}
 
@@ -66,6 +168,10 @@ func (r *Raft) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest)
 }
 
 func (r *Raft) RequestVote(ctx context.Context, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
 	rpcResp, err := r.dispatchRPCRequest(ctx, req)
 	if err != nil {
 		return nil, err
@@ -76,20 +182,140 @@ func (r *Raft) RequestVote(ctx context.Context, req *pb.RequestVoteRequest) (*pb
 		return nil, errResponseTypeMismatch
 	}
 
-	if err := r.saveRaftState(r.persister); err != nil {
+	if err := r.persist(ctx); err != nil {
+		return nil, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (r *Raft) TimeoutNow(ctx context.Context, req *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*pb.TimeoutNowResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
 		return nil, fmt.Errorf("fail to save raft state: %w", err)
 	}
 
 	return resp, nil
 }
 
+func (r *Raft) InstallSnapshot(ctx context.Context, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*pb.InstallSnapshotResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return nil, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (r *Raft) AddServer(ctx context.Context, req *pb.AddServerRequest) (*pb.AddServerResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*pb.AddServerResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return nil, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (r *Raft) RemoveServer(ctx context.Context, req *pb.RemoveServerRequest) (*pb.RemoveServerResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*pb.RemoveServerResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return nil, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (r *Raft) PromoteLearner(ctx context.Context, req *pb.PromoteLearnerRequest) (*pb.PromoteLearnerResponse, error) {
+	if err := r.checkCluster(req.GetClusterId()); err != nil {
+		return nil, err
+	}
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*pb.PromoteLearnerResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return nil, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp, nil
+}
+
+// dispatchRPCRequest sends the request to the main loop and waits for the response, the request is not sent if the
+// context is already done, and the error of the context is returned once it is done
 func (r *Raft) dispatchRPCRequest(ctx context.Context, req interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	respCh := make(chan *rpcResponse, 1)
-	r.rpcCh <- &rpc{req: req, respCh: respCh}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r.rpcCh <- &rpc{req: req, respCh: respCh}:
+	}
 
 	select {
 	case <-ctx.Done():
-		return nil, errRPCTimeout
+		return nil, ctx.Err()
 	case rpcResp := <-respCh:
 		if err := rpcResp.err; err != nil {
 			return nil, err
@@ -99,6 +325,16 @@ func (r *Raft) dispatchRPCRequest(ctx context.Context, req interface{}) (interfa
 	}
 }
 
+// checkCluster rejects RPCs between servers, from joining servers and membership changes of another cluster
+// if `ClusterId` is configured, so clusters sharing a network are never merged by a misdirected request
+func (r *Raft) checkCluster(clusterId string) error {
+	if r.config.ClusterId != "" && clusterId != r.config.ClusterId {
+		return fmt.Errorf("%w: expect cluster %q, got %q", errClusterMismatch, r.config.ClusterId, clusterId)
+	}
+
+	return nil
+}
+
 func (r *Raft) handleRPCRequest(rpc *rpc) {
 	switch req := rpc.req.(type) {
 	case *pb.ApplyCommandRequest:
@@ -107,7 +343,35 @@ func (r *Raft) handleRPCRequest(rpc *rpc) {
 		rpc.respond(r.appendEntries(req))
 	case *pb.RequestVoteRequest:
 		rpc.respond(r.requestVote(req))
+	case *pb.TimeoutNowRequest:
+		rpc.respond(r.timeoutNow(req))
+	case *pb.InstallSnapshotRequest:
+		rpc.respond(r.installSnapshot(req))
+	case *pb.AddServerRequest:
+		rpc.respond(r.addServer(req))
+	case *pb.RemoveServerRequest:
+		rpc.respond(r.removeServer(req))
+	case *pb.PromoteLearnerRequest:
+		rpc.respond(r.promoteLearner(req))
+	case *snapshotRequest:
+		rpc.respond(r.snapshot(req))
+	case *snapshotNowRequest:
+		rpc.respond(r.snapshotNow(req))
+	case *forceElectionRequest:
+		rpc.respond(r.forceElection(req))
+	case *readIndexRequest:
+		rpc.respond(r.readIndex(req))
+	case *pausePeerRequest:
+		rpc.respond(r.pausePeer(req))
+	case *transferLeadershipRequest:
+		rpc.respond(r.handleTransferLeadership(req))
+	case *abortLeadershipTransferRequest:
+		rpc.respond(r.abortLeadershipTransfer(req))
+	case *replicationStatusRequest:
+		rpc.respond(r.replicationStatus(req))
 	default:
 		rpc.respond(nil, errInvalidRPCType)
 	}
+
+	r.checkInvariants()
 }
@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rttSmoothingFactor is the weight of a new sample in the smoothed round-trip time
+	rttSmoothingFactor = 0.125
+	// rttTimeoutMultiplier is the multiple of the smoothed round-trip time used as the adaptive timeout
+	rttTimeoutMultiplier = 10
+)
+
+// rttEstimator estimates the round-trip time by the exponentially weighted moving average of observed samples
+type rttEstimator struct {
+	srtt time.Duration
+	mu   sync.Mutex
+}
+
+// observe updates the smoothed round-trip time with a new sample
+func (e *rttEstimator) observe(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.srtt == 0 {
+		e.srtt = rtt
+		return
+	}
+
+	e.srtt += time.Duration(rttSmoothingFactor * float64(rtt-e.srtt))
+}
+
+// timeout returns the multiple of the smoothed round-trip time bounded by [minVal, maxVal],
+// and returns minVal if no sample is observed
+func (e *rttEstimator) timeout(minVal, maxVal time.Duration) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	timeout := e.srtt * rttTimeoutMultiplier
+	if timeout < minVal {
+		return minVal
+	}
+	if maxVal > 0 && timeout > maxVal {
+		return maxVal
+	}
+
+	return timeout
+}
+
+// heartbeatTimeout returns the timeout for a follower to wait for the leader
+func (r *Raft) heartbeatTimeout() time.Duration {
+	if !r.config.AdaptiveElectionTimeout {
+		return r.config.HeartbeatTimeout
+	}
+
+	return r.rtt.timeout(r.config.HeartbeatTimeout, r.config.MaxElectionTimeout)
+}
+
+// electionTimeout returns the timeout for a candidate to wait for votes
+func (r *Raft) electionTimeout() time.Duration {
+	if !r.config.AdaptiveElectionTimeout {
+		return r.config.ElectionTimeout
+	}
+
+	return r.rtt.timeout(r.config.ElectionTimeout, r.config.MaxElectionTimeout)
+}
+
+// maxElectionBackoff is the maximum multiple of the election timeout a candidate backs off to,
+// if `ElectionBackoff` is enabled without `MaxElectionTimeout`
+const maxElectionBackoff = 8
+
+// backoffElectionTimeout returns the election timeout doubled for each failed election since the server last
+// followed a leader if `ElectionBackoff` is enabled, bounded by `MaxElectionTimeout` or `maxElectionBackoff`
+// times the election timeout
+func (r *Raft) backoffElectionTimeout() time.Duration {
+	timeout := r.electionTimeout()
+	if !r.config.ElectionBackoff {
+		return timeout
+	}
+
+	maxTimeout := r.config.MaxElectionTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = maxElectionBackoff * timeout
+	}
+
+	for i := 0; i < r.electionRounds && timeout < maxTimeout; i++ {
+		timeout *= 2
+	}
+
+	if timeout > maxTimeout {
+		return maxTimeout
+	}
+
+	return timeout
+}
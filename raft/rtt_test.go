@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimatorTimeout(t *testing.T) {
+	minTimeout, maxTimeout := 150*time.Millisecond, time.Second
+
+	e := &rttEstimator{}
+	if timeout := e.timeout(minTimeout, maxTimeout); timeout != minTimeout {
+		t.Fatalf("expect timeout %v without samples, got %v", minTimeout, timeout)
+	}
+
+	// small round-trip time is bounded by the min timeout
+	e.observe(time.Millisecond)
+	if timeout := e.timeout(minTimeout, maxTimeout); timeout != minTimeout {
+		t.Fatalf("expect timeout %v, got %v", minTimeout, timeout)
+	}
+
+	// timeout adapts to the increasing round-trip time
+	for i := 0; i < 100; i++ {
+		e.observe(50 * time.Millisecond)
+	}
+	timeout := e.timeout(minTimeout, maxTimeout)
+	if timeout <= minTimeout || timeout >= maxTimeout {
+		t.Fatalf("expect timeout between %v and %v, got %v", minTimeout, maxTimeout, timeout)
+	}
+	if expect := 50 * time.Millisecond * rttTimeoutMultiplier; timeout < expect*9/10 || timeout > expect*11/10 {
+		t.Fatalf("expect timeout around %v, got %v", expect, timeout)
+	}
+
+	// large round-trip time is bounded by the max timeout
+	for i := 0; i < 100; i++ {
+		e.observe(500 * time.Millisecond)
+	}
+	if timeout := e.timeout(minTimeout, maxTimeout); timeout != maxTimeout {
+		t.Fatalf("expect timeout %v, got %v", maxTimeout, timeout)
+	}
+}
+
+func TestAdaptiveElectionTimeout(t *testing.T) {
+	config := &Config{
+		HeartbeatTimeout:   150 * time.Millisecond,
+		ElectionTimeout:    200 * time.Millisecond,
+		MaxElectionTimeout: time.Second,
+	}
+	r := &Raft{config: config}
+
+	for i := 0; i < 100; i++ {
+		r.rtt.observe(50 * time.Millisecond)
+	}
+
+	// configured timeouts are used if adaptive timeout is disabled
+	if timeout := r.heartbeatTimeout(); timeout != config.HeartbeatTimeout {
+		t.Fatalf("expect heartbeat timeout %v, got %v", config.HeartbeatTimeout, timeout)
+	}
+	if timeout := r.electionTimeout(); timeout != config.ElectionTimeout {
+		t.Fatalf("expect election timeout %v, got %v", config.ElectionTimeout, timeout)
+	}
+
+	config.AdaptiveElectionTimeout = true
+
+	if timeout := r.heartbeatTimeout(); timeout <= config.HeartbeatTimeout || timeout > config.MaxElectionTimeout {
+		t.Fatalf("expect adaptive heartbeat timeout in (%v, %v], got %v", config.HeartbeatTimeout, config.MaxElectionTimeout, timeout)
+	}
+	if timeout := r.electionTimeout(); timeout <= config.ElectionTimeout || timeout > config.MaxElectionTimeout {
+		t.Fatalf("expect adaptive election timeout in (%v, %v], got %v", config.ElectionTimeout, config.MaxElectionTimeout, timeout)
+	}
+}
@@ -0,0 +1,16 @@
+package raft
+
+import (
+	"github.com/justin0u0/raft/pb"
+	"google.golang.org/grpc"
+)
+
+// NewGRPCServer creates a gRPC server with the given options and registers the Raft service on it,
+// options such as `grpc.Creds` or `grpc.UnaryInterceptor` can be used to secure the Raft RPCs,
+// ApplyCommandStream is a streaming RPC and is secured by `grpc.StreamInterceptor` instead
+func NewGRPCServer(r *Raft, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	pb.RegisterRaftServer(s, r)
+
+	return s
+}
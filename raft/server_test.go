@@ -0,0 +1,297 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type tokenCredentials string
+
+func (c tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": string(c)}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func tokenInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if tokens := md.Get("authorization"); len(tokens) != 1 || tokens[0] != token {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func TestGRPCServerWithInterceptor(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("fail to listen:", err)
+	}
+
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	s := NewGRPCServer(r, grpc.UnaryInterceptor(tokenInterceptor("secret")))
+	defer s.Stop()
+	go s.Serve(lis)
+
+	req := &pb.RequestVoteRequest{Term: 1, CandidateId: 2}
+
+	unauthenticated, err := NewGRPCPeer(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+	if _, err := unauthenticated.RequestVote(ctx, req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("unauthenticated RPC should be rejected, got error: %v", err)
+	}
+
+	authenticated, err := NewGRPCPeer(lis.Addr().String(), grpc.WithInsecure(), grpc.WithPerRPCCredentials(tokenCredentials("secret")))
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+	if _, err := authenticated.RequestVote(ctx, req); err != nil {
+		t.Fatal("authenticated RPC should succeed:", err)
+	}
+}
+
+func TestApplyCommandStream(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("fail to listen:", err)
+	}
+
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	s := NewGRPCServer(r)
+	defer s.Stop()
+	go s.Serve(lis)
+
+	time.Sleep(1 * time.Second)
+
+	client, err := NewGRPCPeer(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+
+	streamCtx, streamCancel := context.WithTimeout(ctx, 1*time.Second)
+	defer streamCancel()
+
+	stream, err := client.ApplyCommandStream(streamCtx, &pb.ApplyCommandRequest{Data: []byte("value")})
+	if err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+
+	var logId uint64
+	for _, stage := range []pb.ApplyCommandStage{pb.ApplyCommandStage_APPENDED, pb.ApplyCommandStage_COMMITTED, pb.ApplyCommandStage_APPLIED} {
+		update, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("fail to receive stage %v: %v", stage, err)
+		}
+		if update.GetStage() != stage {
+			t.Fatalf("expect stage %v, got %v", stage, update.GetStage())
+		}
+		if string(update.GetEntry().GetData()) != "value" {
+			t.Fatalf("stage %v should carry the submitted entry, got %v", stage, update.GetEntry())
+		}
+
+		if logId == 0 {
+			logId = update.GetEntry().GetId()
+		} else if update.GetEntry().GetId() != logId {
+			t.Fatalf("expect entry %d at stage %v, got entry %d", logId, stage, update.GetEntry().GetId())
+		}
+	}
+
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatal("stream should end after the command is applied, got error:", err)
+	}
+}
+
+func TestApplyCommandStreamWaitsForApplyChAck(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("fail to listen:", err)
+	}
+
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	s := NewGRPCServer(r)
+	defer s.Stop()
+	go s.Serve(lis)
+
+	time.Sleep(1 * time.Second)
+
+	client, err := NewGRPCPeer(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+
+	streamCtx, streamCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer streamCancel()
+
+	stream, err := client.ApplyCommandStream(streamCtx, &pb.ApplyCommandRequest{Data: []byte("value")})
+	if err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+
+	for _, stage := range []pb.ApplyCommandStage{pb.ApplyCommandStage_APPENDED, pb.ApplyCommandStage_COMMITTED} {
+		update, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("fail to receive stage %v: %v", stage, err)
+		}
+		if update.GetStage() != stage {
+			t.Fatalf("expect stage %v, got %v", stage, update.GetStage())
+		}
+	}
+
+	updateCh := make(chan *pb.ApplyCommandStatus, 1)
+	go func() {
+		update, _ := stream.Recv()
+		updateCh <- update
+	}()
+
+	// the entry is buffered in the ApplyCh, but the state machine has not applied it yet
+	select {
+	case update := <-updateCh:
+		t.Fatal("command should not be applied before the state machine acknowledges it, got:", update)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	e := <-r.ApplyCh()
+	if string(e.GetData()) != "value" {
+		t.Fatal("expect the submitted command from the ApplyCh, got:", e)
+	}
+	r.Applied(e.GetId())
+
+	select {
+	case update := <-updateCh:
+		if update.GetStage() != pb.ApplyCommandStage_APPLIED || update.GetEntry().GetId() != e.GetId() {
+			t.Fatal("expect the command to be applied, got:", update)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("command should be applied once the state machine acknowledges it")
+	}
+}
+
+func TestMultiRaft(t *testing.T) {
+	numNodes := 3
+	groupIds := []uint64{1, 2}
+
+	listeners := make(map[uint32]net.Listener, numNodes)
+	for i := 1; i <= numNodes; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("fail to listen:", err)
+		}
+		listeners[uint32(i)] = lis
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each node runs a server of every group behind a single gRPC server
+	rafts := make(map[uint64]map[uint32]*Raft, len(groupIds))
+	for _, groupId := range groupIds {
+		rafts[groupId] = make(map[uint32]*Raft, numNodes)
+	}
+	for id, lis := range listeners {
+		groups := make(map[uint64]*Raft, len(groupIds))
+		for _, groupId := range groupIds {
+			peers := make(map[uint32]Peer, numNodes-1)
+			for peerId, peerLis := range listeners {
+				if peerId == id {
+					continue
+				}
+				p, err := NewGRPCPeer(peerLis.Addr().String(), grpc.WithInsecure())
+				if err != nil {
+					t.Fatal("fail to connect to peer:", err)
+				}
+				peers[peerId] = p
+			}
+
+			config := &Config{
+				HeartbeatTimeout:  150 * time.Millisecond,
+				ElectionTimeout:   150 * time.Millisecond,
+				HeartbeatInterval: 50 * time.Millisecond,
+				ApplyFunc:         func(*pb.Entry) error { return nil },
+				GroupId:           groupId,
+			}
+			// the server with the same ID as the group times out first, so each group elects a different leader
+			timeoutFirst(uint32(groupId))(id, config)
+
+			r := NewRaft(id, peers, newPersister(), config, zap.NewNop())
+			groups[groupId] = r
+			rafts[groupId][id] = r
+		}
+
+		s := grpc.NewServer()
+		RegisterMultiRaft(s, groups)
+		defer s.Stop()
+		go s.Serve(lis)
+	}
+
+	for _, group := range rafts {
+		for _, r := range group {
+			go r.Run(ctx)
+		}
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, groupId := range groupIds {
+		for id, r := range rafts[groupId] {
+			if expectLeader := id == uint32(groupId); r.IsLeader() != expectLeader {
+				t.Fatalf("group %d: server %d should be the leader %v, got %v", groupId, id, expectLeader, r.IsLeader())
+			}
+			if leaderId := r.LeaderId(); leaderId != uint32(groupId) {
+				t.Fatalf("group %d: server %d should follow leader %d, got %d", groupId, id, groupId, leaderId)
+			}
+		}
+	}
+
+	// requests of an unknown group are rejected
+	client, err := NewGRPCPeer(listeners[1].Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("fail to connect to peer:", err)
+	}
+	if _, err := client.RequestVote(ctx, &pb.RequestVoteRequest{Term: 100, CandidateId: 2, GroupId: 3}); err == nil {
+		t.Fatal("request of an unknown group should be rejected")
+	}
+}
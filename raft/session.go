@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"context"
+	"sync"
+
+	"github.com/justin0u0/raft/pb"
+)
+
+// Session tracks the highest log index written by a client, so the client can read its own writes
+// from any server once the server has applied up to that index, without a linearizable read
+type Session struct {
+	index uint64
+	mu    sync.Mutex
+}
+
+// NewSession creates an empty session
+func NewSession() *Session {
+	return &Session{}
+}
+
+// Observe records the log written by the ApplyCommand RPC
+func (s *Session) Observe(resp *pb.ApplyCommandResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id := resp.GetEntry().GetId(); id > s.index {
+		s.index = id
+	}
+}
+
+// Index returns the highest log index written in the session
+func (s *Session) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.index
+}
+
+// ReadAtLeast blocks until logs up to the given index are applied to the state machine, or returns the error
+// of the context, reads served after it observe all writes up to the index. Logs sent to the ApplyCh are applied
+// once the state machine acknowledges them by Applied, so the read waits for the ack instead of the delivery
+func (r *Raft) ReadAtLeast(ctx context.Context, index uint64) error {
+	return r.waitForApply(ctx, index)
+}
@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		applyFunc bool
+	}{
+		{name: "apply func", applyFunc: true},
+		{name: "apply channel", applyFunc: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			values := make(map[uint64]string)
+
+			apply := func(log *pb.Entry) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				values[log.GetId()] = string(log.GetData())
+				return nil
+			}
+
+			config := &Config{
+				HeartbeatTimeout:  150 * time.Millisecond,
+				ElectionTimeout:   150 * time.Millisecond,
+				HeartbeatInterval: 50 * time.Millisecond,
+			}
+			if tc.applyFunc {
+				config.ApplyFunc = apply
+			}
+			r := NewRaft(1, map[uint32]Peer{}, newPersister(), config, zap.NewNop())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go r.Run(ctx)
+
+			if !tc.applyFunc {
+				go func() {
+					for e := range r.ApplyCh() {
+						if e.GetType() == pb.EntryType_COMMAND {
+							apply(e)
+						}
+						r.Applied(e.GetId())
+					}
+				}()
+			}
+
+			time.Sleep(1 * time.Second)
+
+			session := NewSession()
+
+			resp, err := r.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte("value")})
+			if err != nil {
+				t.Fatal("fail to apply command:", err)
+			}
+			session.Observe(resp)
+
+			if session.Index() != resp.GetEntry().GetId() {
+				t.Fatal("session should track the written log")
+			}
+
+			readCtx, readCancel := context.WithTimeout(ctx, time.Second)
+			defer readCancel()
+
+			if err := r.ReadAtLeast(readCtx, session.Index()); err != nil {
+				t.Fatal("fail to read at least the written log:", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if values[session.Index()] != "value" {
+				t.Fatal("the written value should be visible to the session")
+			}
+		})
+	}
+}
+
+func TestReadAtLeastWaitsForApplyChAck(t *testing.T) {
+	config := &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}
+	r := NewRaft(1, map[uint32]Peer{}, newPersister(), config, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	resp, err := r.ApplyCommand(ctx, &pb.ApplyCommandRequest{Data: []byte("value")})
+	if err != nil {
+		t.Fatal("fail to apply command:", err)
+	}
+	index := resp.GetEntry().GetId()
+
+	// the log sits in the buffer of the ApplyCh until the slow consumer takes it
+	readCtx, readCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer readCancel()
+
+	if err := r.ReadAtLeast(readCtx, index); err != context.DeadlineExceeded {
+		t.Fatalf("expect read to wait for the state machine, got %v", err)
+	}
+
+	var mu sync.Mutex
+	var value string
+
+	go func() {
+		for e := range r.ApplyCh() {
+			// the state machine takes a while to apply the log after receiving it
+			time.Sleep(300 * time.Millisecond)
+
+			mu.Lock()
+			if e.GetType() == pb.EntryType_COMMAND {
+				value = string(e.GetData())
+			}
+			mu.Unlock()
+			r.Applied(e.GetId())
+		}
+	}()
+
+	readCtx, readCancel = context.WithTimeout(ctx, time.Second)
+	defer readCancel()
+
+	if err := r.ReadAtLeast(readCtx, index); err != nil {
+		t.Fatal("fail to read at least the written log:", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if value != "value" {
+		t.Fatal("the written value should be visible once the read returns")
+	}
+}
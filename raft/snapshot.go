@@ -0,0 +1,495 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+// SnapshotMeta is the metadata persisted along with the snapshot data
+type SnapshotMeta struct {
+	// LastIncludedId is the ID of the last log compacted into the snapshot
+	LastIncludedId uint64
+	// LastIncludedTerm is the term of the last log compacted into the snapshot
+	LastIncludedTerm uint64
+
+	// Configuration is the latest configuration at the last included log
+	Configuration map[uint32]string
+	// Learners are members in the configuration that do not vote
+	Learners map[uint32]bool
+	// Observers are learners in the configuration that can never be promoted
+	Observers map[uint32]bool
+	// ConfigurationId is the ID of the configuration log, 0 if it is the initial configuration
+	ConfigurationId uint64
+}
+
+type snapshotRequest struct {
+	id   uint64
+	data []byte
+	// write writes the snapshot data instead of data if set
+	write func(w io.Writer) error
+}
+
+type snapshotResponse struct{}
+
+type snapshotNowRequest struct{}
+
+type snapshotNowResponse struct {
+	id uint64
+}
+
+// Snapshot compacts logs up to and including the given log ID into the snapshot data taken from the state machine.
+//
+// Note that the log must already be applied, and the snapshot data is delivered through `RestoreSnapshot` on restart,
+// or should be restored from the persister by the state machine if it is not configured, logs after the snapshot
+// are applied through the ApplyCh.
+func (r *Raft) Snapshot(ctx context.Context, id uint64, data []byte) error {
+	return r.takeSnapshot(ctx, &snapshotRequest{id: id, data: data})
+}
+
+// SnapshotStream is like `Snapshot` but streams the snapshot data written by write into the persister if it is a
+// `SnapshotStore`, so large state machines are not buffered in memory, write must not call other methods of Raft.
+func (r *Raft) SnapshotStream(ctx context.Context, id uint64, write func(w io.Writer) error) error {
+	return r.takeSnapshot(ctx, &snapshotRequest{id: id, write: write})
+}
+
+// SnapshotNow takes a snapshot up to the last applied log through `TakeSnapshot`, compacts logs into it, and returns
+// the last log ID included in the snapshot once it is durable, `ErrSnapshotInProgress` is returned if the previous
+// SnapshotNow is not done yet.
+func (r *Raft) SnapshotNow(ctx context.Context) (uint64, error) {
+	if r.config.TakeSnapshot == nil {
+		return 0, errNoTakeSnapshot
+	}
+
+	r.mu.Lock()
+	if r.snapshotInProgress {
+		r.mu.Unlock()
+		return 0, ErrSnapshotInProgress
+	}
+	r.snapshotInProgress = true
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.snapshotInProgress = false
+		r.mu.Unlock()
+	}()
+
+	rpcResp, err := r.dispatchRPCRequest(ctx, &snapshotNowRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, ok := rpcResp.(*snapshotNowResponse)
+	if !ok {
+		return 0, errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return 0, fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return resp.id, nil
+}
+
+// SnapshotReader opens the latest snapshot for reading, e.g. to restore the state machine, the reader must be closed.
+// The snapshot is streamed if the persister is a `SnapshotStore`.
+func (r *Raft) SnapshotReader() (SnapshotMeta, io.ReadCloser, error) {
+	if store, ok := r.persister.(SnapshotStore); ok {
+		return store.OpenSnapshot()
+	}
+
+	meta, data, err := r.persister.LoadSnapshot()
+	if err != nil {
+		return SnapshotMeta{}, nil, err
+	}
+
+	return meta, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *Raft) takeSnapshot(ctx context.Context, req *snapshotRequest) error {
+	rpcResp, err := r.dispatchRPCRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rpcResp.(*snapshotResponse); !ok {
+		return errResponseTypeMismatch
+	}
+
+	if err := r.persist(ctx); err != nil {
+		return fmt.Errorf("fail to save raft state: %w", err)
+	}
+
+	return nil
+}
+
+// SnapshotRequestCh receives log IDs up to which the application should take a snapshot and then call `Snapshot`,
+// a request is sent once more than `SnapshotThreshold` logs are not compacted
+func (r *Raft) SnapshotRequestCh() <-chan uint64 {
+	return r.snapshotRequestCh
+}
+
+// requestSnapshot requests a snapshot up to the `compactionIndex` if more than `SnapshotThreshold` logs are neither
+// compacted nor requested to be compacted, the request is dropped if the previous one is not received yet
+func (r *Raft) requestSnapshot() {
+	threshold := r.config.SnapshotThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	compactedId := r.snapshotMeta.LastIncludedId
+	if r.snapshotRequested > compactedId {
+		compactedId = r.snapshotRequested
+	}
+
+	id := r.compactionIndex()
+	if lastLogId, _ := r.getLastLog(); lastLogId-compactedId <= uint64(threshold) || id <= compactedId {
+		return
+	}
+
+	select {
+	case r.snapshotRequestCh <- id:
+		r.snapshotRequested = id
+		r.logger.Info("request snapshot", zap.Uint64("id", id))
+	default:
+	}
+}
+
+// compactionIndex returns the log ID up to which logs are requested to be compacted, which is the last applied log,
+// or on the leader with `RetainLogEntries`, the minimum applied index of followers, so logs they still need are kept,
+// unless they lag more than `RetainLogEntries` logs behind, then they need a snapshot anyway
+func (r *Raft) compactionIndex() uint64 {
+	if r.config.RetainLogEntries <= 0 || r.state != Leader {
+		return r.lastApplied
+	}
+	retain := uint64(r.config.RetainLogEntries)
+
+	id := r.minAppliedIndex()
+	if r.lastApplied > retain && id < r.lastApplied-retain {
+		id = r.lastApplied - retain
+	}
+
+	return id
+}
+
+// follower: compact logs
+// candidate: compact logs
+// leader: compact logs
+func (r *Raft) snapshot(req *snapshotRequest) (*snapshotResponse, error) {
+	if req.id <= r.snapshotMeta.LastIncludedId {
+		r.logger.Info("ignore snapshot since logs are already compacted", zap.Uint64("id", req.id))
+		return &snapshotResponse{}, nil
+	}
+
+	if req.id > r.lastApplied {
+		return nil, fmt.Errorf("%w: log %d is not applied yet", errInvalidSnapshot, req.id)
+	}
+
+	configurationId, configuration, learners, observers, err := r.configurationAt(req.id)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := SnapshotMeta{
+		LastIncludedId:   req.id,
+		LastIncludedTerm: r.getLogTerm(req.id),
+		Configuration:    configuration,
+		Learners:         learners,
+		Observers:        observers,
+		ConfigurationId:  configurationId,
+	}
+
+	write := req.write
+	if write == nil {
+		write = func(w io.Writer) error {
+			_, err := w.Write(req.data)
+			return err
+		}
+	}
+
+	if err := r.saveSnapshot(meta, write); err != nil {
+		return nil, fmt.Errorf("fail to save snapshot: %w", err)
+	}
+
+	r.compactLogs(meta)
+	r.logger.Info("compact logs into snapshot",
+		zap.Uint64("lastIncludedId", meta.LastIncludedId),
+		zap.Uint64("lastIncludedTerm", meta.LastIncludedTerm),
+		zap.Int("logs", len(r.logs)))
+
+	return &snapshotResponse{}, nil
+}
+
+// follower: compact logs up to the last applied log
+// candidate: compact logs up to the last applied log
+// leader: compact logs up to the last applied log
+func (r *Raft) snapshotNow(req *snapshotNowRequest) (*snapshotNowResponse, error) {
+	id := r.lastApplied
+	write := func(w io.Writer) error {
+		return r.config.TakeSnapshot(id, w)
+	}
+
+	if _, err := r.snapshot(&snapshotRequest{id: id, write: write}); err != nil {
+		return nil, err
+	}
+
+	// logs may already be compacted beyond the last applied log, e.g. by a snapshot installed from the leader
+	return &snapshotNowResponse{id: r.snapshotMeta.LastIncludedId}, nil
+}
+
+// saveSnapshot saves the snapshot data written by write, through a sink if the persister is a `SnapshotStore`,
+// the snapshot is discarded if write fails
+func (r *Raft) saveSnapshot(meta SnapshotMeta, write func(w io.Writer) error) error {
+	store, ok := r.persister.(SnapshotStore)
+	if !ok {
+		var buf bytes.Buffer
+		if err := write(&buf); err != nil {
+			return err
+		}
+
+		return r.observePersist(MetricPersistSnapshotLatency, func() error {
+			return r.persister.SaveSnapshot(meta, buf.Bytes())
+		})
+	}
+
+	sink, err := store.CreateSnapshot(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := write(sink); err != nil {
+		if cancelErr := sink.Cancel(); cancelErr != nil {
+			r.logger.Warn("fail to cancel snapshot", zap.Error(cancelErr))
+		}
+		return err
+	}
+
+	return r.observePersist(MetricPersistSnapshotLatency, sink.Close)
+}
+
+// installsnapshot rpc response, server id + result + request
+type installSnapshotResult struct {
+	*pb.InstallSnapshotResponse
+	req    *pb.InstallSnapshotRequest
+	peerId uint32
+	err    error
+}
+
+// sendSnapshot sends the latest snapshot to the peer whose needed logs are compacted,
+// at most one snapshot is sent to a peer at a time, and at most `MaxConcurrentSnapshots` snapshots at a time
+func (r *Raft) sendSnapshot(ctx context.Context, peerId uint32, peer Peer, installSnapshotResultCh chan *installSnapshotResult) {
+	if r.snapshotting[peerId] {
+		return
+	}
+
+	if limit := r.config.MaxConcurrentSnapshots; limit > 0 && len(r.snapshotting) >= limit {
+		r.logger.Debug("delay snapshot since too many snapshots are being sent", zap.Uint32("peer", peerId),
+			zap.Int("snapshotting", len(r.snapshotting)))
+		return
+	}
+
+	meta, data, err := r.persister.LoadSnapshot()
+	if err != nil {
+		r.logger.Error("fail to load snapshot", zap.Error(err))
+		return
+	}
+
+	req := &pb.InstallSnapshotRequest{
+		Term:             r.currentTerm,
+		LeaderId:         r.id,
+		LastIncludedId:   meta.LastIncludedId,
+		LastIncludedTerm: meta.LastIncludedTerm,
+		Configuration:    toConfigurationProto(meta.Configuration, meta.Learners, meta.Observers),
+		ConfigurationId:  meta.ConfigurationId,
+		Data:             data,
+		GroupId:          r.config.GroupId,
+		ClusterId:        r.config.ClusterId,
+	}
+
+	// snapshots are sent by their own workers, so heartbeats to the peer are not held up
+	submitted := r.submitRPC(r.snapshotWorkers, peerId, "InstallSnapshot", func() {
+		rpcCtx, cancel := context.WithTimeout(ctx, snapshotRPCTimeoutFactor*r.rpcTimeout())
+		defer cancel()
+
+		var resp *pb.InstallSnapshotResponse
+		err := r.withRetry(rpcCtx, func() (err error) {
+			resp, err = peer.InstallSnapshot(rpcCtx, req)
+			return err
+		})
+		if err != nil {
+			r.logger.Error("fail to send InstallSnapshot RPC", zap.Error(err), zap.Uint32("peer", peerId))
+		}
+
+		// the result is always sent, so the snapshot can be sent again on failure
+		select {
+		case installSnapshotResultCh <- &installSnapshotResult{
+			InstallSnapshotResponse: resp,
+			req:                     req,
+			peerId:                  peerId,
+			err:                     err,
+		}:
+		case <-ctx.Done():
+		}
+	})
+	if !submitted {
+		return
+	}
+
+	r.snapshotting[peerId] = true
+	r.logger.Info("send snapshot", zap.Uint32("peer", peerId), zap.Uint64("lastIncludedId", meta.LastIncludedId))
+}
+
+// 1. discover higher term change into follower
+// 2. success install snapshot rpc: update nextIndex and matchIndex to the last included log
+func (r *Raft) handleInstallSnapshotResult(ctx context.Context, result *installSnapshotResult) {
+	delete(r.snapshotting, result.peerId)
+
+	// the peer is removed while the RPC is in flight, its state must not be recreated
+	if _, ok := r.peers[result.peerId]; !ok || result.err != nil {
+		return
+	}
+
+	if result.GetTerm() > r.currentTerm {
+		r.toFollower(result.GetTerm())
+		r.persistState(ctx)
+		r.logger.Info("receive new term on InstallSnapshot response, fallback to follower", zap.Uint32("peer", result.peerId))
+		return
+	}
+
+	r.lastContact[result.peerId] = time.Now()
+
+	matchIndex := result.req.GetLastIncludedId()
+	if r.matchIndex[result.peerId] > matchIndex {
+		matchIndex = r.matchIndex[result.peerId]
+	}
+	nextIndex := matchIndex + 1
+	r.setNextAndMatchIndex(result.peerId, nextIndex, matchIndex)
+	r.logger.Info("install snapshot successfully, set next index and match index", zap.Uint32("peer", result.peerId), zap.Uint64("nextIndex", nextIndex), zap.Uint64("matchIndex", matchIndex))
+
+	r.advanceCommitIndex()
+}
+
+// follower: 1, 2, 3, 4
+// candidate: fallback to follower, then 1, 2, 3, 4
+// leader: fallback to follower if the term is newer
+// 1. reject old term rpc
+// 2. ignore the snapshot if logs up to its last included log are already committed
+// 3. save the snapshot, keep following logs only if the log at the last included log matches
+// 4. commit and apply the snapshot, reload the configuration in the snapshot
+func (r *Raft) installSnapshot(req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	if req.GetTerm() < r.currentTerm {
+		r.logger.Info("reject install snapshot since current term is older")
+		return &pb.InstallSnapshotResponse{Term: r.currentTerm}, nil
+	}
+
+	r.lastHeartbeat = time.Now()
+
+	if req.GetTerm() > r.currentTerm {
+		r.toFollower(req.GetTerm())
+		r.logger.Info("increase term since receive a newer one", zap.Uint64("term", r.currentTerm))
+	}
+	if r.state != Follower {
+		r.toFollower(req.GetTerm())
+		r.logger.Info("receive request from leader, fallback to follower", zap.Uint64("term", r.currentTerm))
+	}
+	r.setLeader(req.GetLeaderId())
+
+	// a snapshot whose install is not complete is installed again, even if its logs are committed
+	if req.GetLastIncludedId() <= r.commitIndex &&
+		(r.installing == nil || req.GetLastIncludedId() < r.installing.GetLastIncludedId()) {
+		r.logger.Info("ignore snapshot since logs are already committed", zap.Uint64("lastIncludedId", req.GetLastIncludedId()))
+		return &pb.InstallSnapshotResponse{Term: r.currentTerm}, nil
+	}
+	r.installing = req
+
+	configuration, learners, observers := fromConfigurationProto(req.GetConfiguration())
+	meta := SnapshotMeta{
+		LastIncludedId:   req.GetLastIncludedId(),
+		LastIncludedTerm: req.GetLastIncludedTerm(),
+		Configuration:    configuration,
+		Learners:         learners,
+		Observers:        observers,
+		ConfigurationId:  req.GetConfigurationId(),
+	}
+
+	err := r.observePersist(MetricPersistSnapshotLatency, func() error {
+		return r.persister.SaveSnapshot(meta, req.GetData())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to save snapshot: %w", err)
+	}
+
+	// logs following the snapshot are kept only if they are in the same history
+	if r.getLogTerm(meta.LastIncludedId) != meta.LastIncludedTerm {
+		r.deleteLogs(0)
+	}
+	r.compactLogs(meta)
+	r.commit(meta.LastIncludedId)
+
+	if err := r.reloadConfiguration(); err != nil {
+		return nil, err
+	}
+	r.installing = nil
+
+	r.logger.Info("install snapshot from leader",
+		zap.Uint64("lastIncludedId", meta.LastIncludedId),
+		zap.Uint64("lastIncludedTerm", meta.LastIncludedTerm),
+		zap.Int("logs", len(r.logs)))
+
+	r.applyCommittedLogs()
+
+	return &pb.InstallSnapshotResponse{Term: r.currentTerm}, nil
+}
+
+// restoreSnapshot delivers the persisted snapshot to the state machine through `RestoreSnapshot` on startup,
+// otherwise applying logs is gated until the snapshot is delivered as a snapshot entry
+func (r *Raft) restoreSnapshot() error {
+	if r.snapshotMeta.LastIncludedId == 0 {
+		return nil
+	}
+
+	// without `RestoreSnapshot`, the snapshot is delivered as a snapshot entry, logs are not applied until then
+	if r.config.RestoreSnapshot == nil {
+		r.restoringSnapshot = true
+		return nil
+	}
+
+	meta, data, err := r.persister.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if err := r.config.RestoreSnapshot(meta, data); err != nil {
+		return err
+	}
+
+	r.logger.Info("restore snapshot", zap.Uint64("lastIncludedId", meta.LastIncludedId))
+
+	return nil
+}
+
+// applySnapshot applies the latest snapshot to the state machine as a snapshot entry, and returns false if it fails
+func (r *Raft) applySnapshot(apply func(*pb.Entry) error) bool {
+	meta, data, err := r.persister.LoadSnapshot()
+	if err != nil {
+		r.logger.Warn("fail to load snapshot, retry later", zap.Error(err))
+		return false
+	}
+
+	entry := &pb.Entry{Id: meta.LastIncludedId, Term: meta.LastIncludedTerm, Data: data, Type: pb.EntryType_SNAPSHOT}
+	if err := apply(entry); err != nil {
+		r.logger.Warn("fail to apply snapshot, retry later", zap.Error(err), zap.Uint64("lastIncludedId", meta.LastIncludedId))
+		return false
+	}
+
+	r.setLastApplied(meta.LastIncludedId, true)
+	r.restoringSnapshot = false
+
+	return true
+}
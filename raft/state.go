@@ -2,10 +2,15 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/justin0u0/raft/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 type RaftState uint32
@@ -30,6 +35,10 @@ func (s RaftState) String() string {
 }
 
 type raftState struct {
+	// leadershipEpoch is incremented on every conversion to follower or leader, it is accessed atomically so client
+	// commands are fenced without the lock, and is kept first for the alignment of 64-bit atomic operations
+	leadershipEpoch uint64
+
 	// raft state
 	state RaftState
 
@@ -39,22 +48,66 @@ type raftState struct {
 	votedFor    uint32
 	logs        []*pb.Entry
 
+	// snapshotMeta is the metadata of the latest snapshot, logs up to and including the last included log are compacted
+	snapshotMeta SnapshotMeta
+
 	// volatile state on all servers
 
 	commitIndex uint64
 	lastApplied uint64
 
+	// ackApply makes logs sent to the ApplyCh count as applied only once the state machine acknowledges them
+	// through Applied, since they may sit in the buffer of the ApplyCh
+	ackApply bool
+	// deliveredIndex is the last log sent to the ApplyCh if `ackApply`
+	deliveredIndex uint64
+	// ackedIndex is the last log acknowledged by the state machine through Applied
+	ackedIndex uint64
+
+	// commitWaiters maps channels of waiters to the log index they wait for, notified when the index is committed,
+	// or failed when the leader steps down
+	commitWaiters map[chan error]uint64
+	// applyWaiters maps channels of waiters to the log index they wait for, notified when the index is applied
+	// by the state machine
+	applyWaiters map[chan error]uint64
+
+	// leaderId is the last known leader
+	leaderId uint32
+	// configuration maps member IDs to their addresses, set by the latest configuration log
+	configuration map[uint32]string
+	// learners are members in the configuration that replicate logs but do not vote
+	learners map[uint32]bool
+	// observers are learners that can never be promoted
+	observers map[uint32]bool
+	// configurationId is the ID of the configuration log, 0 if it is the initial configuration
+	configurationId uint64
+
 	// volatile state on leader
 
 	nextIndex  map[uint32]uint64
 	matchIndex map[uint32]uint64
 
+	// strictLogChecks validates that appended logs are contiguous
+	strictLogChecks bool
+	// panicOnLogGaps panics on logs rejected by strictLogChecks instead of returning the error, set in debug mode
+	panicOnLogGaps bool
+	// roleTimer counts the time spent in each role on state transitions
+	roleTimer *roleTimer
+
 	mu sync.Mutex
 }
 
 // persistence
 
 func (rs *raftState) saveRaftState(p Persister) error {
+	if err := p.SaveRaftState(rs.encodeRaftState()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (rs *raftState) encodeRaftState() []byte {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
@@ -63,37 +116,82 @@ func (rs *raftState) saveRaftState(p Persister) error {
 	enc.Encode(rs.currentTerm)
 	enc.Encode(rs.votedFor)
 	enc.Encode(rs.logs)
+	enc.Encode(rs.commitIndex)
 
-	if err := p.SaveRaftState(buf.Bytes()); err != nil {
-		return err
-	}
-
-	return nil
+	return buf.Bytes()
 }
 
 func (rs *raftState) loadRaftState(p Persister) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	meta, _, err := p.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+
 	raftState, err := p.LoadRaftState()
 	if err != nil {
 		return err
 	}
 
-	if raftState != nil {
+	// commitIndex is the persisted commit index, which is only used to validate the persisted logs
+	var commitIndex uint64
+
+	if len(raftState) != 0 {
+		var currentTerm uint64
+		var votedFor uint32
+		var logs []*pb.Entry
+
 		dec := gob.NewDecoder(bytes.NewBuffer(raftState))
-		dec.Decode(&rs.currentTerm)
-		dec.Decode(&rs.votedFor)
-		dec.Decode(&rs.logs)
+		if err := dec.Decode(&currentTerm); err != nil {
+			return fmt.Errorf("fail to decode current term: %w", err)
+		}
+		if err := dec.Decode(&votedFor); err != nil {
+			return fmt.Errorf("fail to decode voted for: %w", err)
+		}
+		if err := dec.Decode(&logs); err != nil {
+			return fmt.Errorf("fail to decode logs: %w", err)
+		}
+		// the commit index is not persisted by older versions
+		if err := dec.Decode(&commitIndex); err != nil && err != io.EOF {
+			return fmt.Errorf("fail to decode commit index: %w", err)
+		}
+
+		// the term never goes back, the server may have seen a newer term than the persisted one
+		if currentTerm >= rs.currentTerm {
+			rs.currentTerm = currentTerm
+			rs.votedFor = votedFor
+		}
+		rs.logs = logs
+	}
+
+	// logs in the snapshot are committed and applied to the state machine
+	if meta.LastIncludedId != 0 {
+		rs.snapshotMeta = meta
+		rs.commitIndex = meta.LastIncludedId
+		rs.lastApplied = meta.LastIncludedId
+
+		// logs may be saved before they are compacted
+		rs.logs = rs.getLogs(meta.LastIncludedId + 1)
+	}
+
+	// the server refuses to start with logs lost or corrupted on disk, since committed logs may be missing
+	if err := checkLogsFollow(rs.snapshotMeta.LastIncludedId, rs.logs); err != nil {
+		return fmt.Errorf("%w: %v", errCorruptedLogs, err)
+	}
+	if lastLogId, _ := rs.getLastLog(); commitIndex > lastLogId {
+		return fmt.Errorf("%w: persisted commit index %d is beyond the last log %d", errCorruptedLogs, commitIndex, lastLogId)
 	}
 
 	return nil
 }
 
-// getLastLog gets last log id and last log term and returns zero-values if not found
+// getLastLog gets last log id and last log term, including the last log compacted into the snapshot,
+// and returns zero-values if not found
 func (rs *raftState) getLastLog() (id, term uint64) {
 	if len(rs.logs) == 0 {
-		return 0, 0
+		return rs.snapshotMeta.LastIncludedId, rs.snapshotMeta.LastIncludedTerm
 	}
 
 	log := rs.logs[len(rs.logs)-1]
@@ -101,6 +199,24 @@ func (rs *raftState) getLastLog() (id, term uint64) {
 	return log.GetId(), log.GetTerm()
 }
 
+// isLogUpToDate reports whether the log ends with the given last log is at least as up-to-date as the local log,
+// that is, the last log term is greater, or the last log terms are equal and the last log ID is not smaller
+func (rs *raftState) isLogUpToDate(lastLogId, lastLogTerm uint64) bool {
+	lastEntryId, lastEntryTerm := rs.getLastLog()
+
+	return isUpToDate(lastLogId, lastLogTerm, lastEntryId, lastEntryTerm)
+}
+
+// isUpToDate reports whether the log ends with lastLogId and lastLogTerm is at least as up-to-date as the log ends
+// with lastEntryId and lastEntryTerm
+func isUpToDate(lastLogId, lastLogTerm, lastEntryId, lastEntryTerm uint64) bool {
+	if lastLogTerm != lastEntryTerm {
+		return lastLogTerm > lastEntryTerm
+	}
+
+	return lastLogId >= lastEntryId
+}
+
 // getLog gets the log by the given log id and returns nil if not found
 func (rs *raftState) getLog(id uint64) *pb.Entry {
 	logs := rs.getLogs(id)
@@ -111,6 +227,16 @@ func (rs *raftState) getLog(id uint64) *pb.Entry {
 	return nil
 }
 
+// getLogTerm gets the term of the log by the given log id, including the last log compacted into the snapshot,
+// and returns 0 if not found
+func (rs *raftState) getLogTerm(id uint64) uint64 {
+	if id != 0 && id == rs.snapshotMeta.LastIncludedId {
+		return rs.snapshotMeta.LastIncludedTerm
+	}
+
+	return rs.getLog(id).GetTerm()
+}
+
 // getLogs gets all logs from the start id to the end and returns empty list if not found
 func (rs *raftState) getLogs(startId uint64) []*pb.Entry {
 	if len(rs.logs) == 0 {
@@ -118,6 +244,10 @@ func (rs *raftState) getLogs(startId uint64) []*pb.Entry {
 	}
 
 	lastLog := rs.logs[len(rs.logs)-1]
+	if startId > lastLog.GetId() {
+		return []*pb.Entry{}
+	}
+
 	logIdDiff := int(lastLog.GetId() - startId)
 	if len(rs.logs)-1-logIdDiff < 0 {
 		return []*pb.Entry{}
@@ -127,11 +257,43 @@ func (rs *raftState) getLogs(startId uint64) []*pb.Entry {
 }
 
 // appendLogs appends logs to the raft state
-func (rs *raftState) appendLogs(logs []*pb.Entry) {
+func (rs *raftState) appendLogs(logs []*pb.Entry) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	if rs.strictLogChecks {
+		if err := rs.checkContiguousLogs(logs); err != nil {
+			// a gap is a bug of the caller, which is surfaced where it happens in debug mode
+			if rs.panicOnLogGaps {
+				panic(err)
+			}
+			return err
+		}
+	}
+
 	rs.logs = append(rs.logs, logs...)
+
+	return nil
+}
+
+// checkContiguousLogs checks that the given logs start right after the last log and their IDs increase one by one
+func (rs *raftState) checkContiguousLogs(logs []*pb.Entry) error {
+	lastLogId, _ := rs.getLastLog()
+
+	return checkLogsFollow(lastLogId, logs)
+}
+
+// checkLogsFollow checks that the given logs start right after the given log id and their IDs increase one by one
+func checkLogsFollow(id uint64, logs []*pb.Entry) error {
+	for _, log := range logs {
+		if log.GetId() != id+1 {
+			return fmt.Errorf("%w: expect log id %d, got %d", errNonContiguousLogs, id+1, log.GetId())
+		}
+
+		id = log.GetId()
+	}
+
+	return nil
 }
 
 // deleteLogs deletes all logs after the given log id
@@ -139,47 +301,146 @@ func (rs *raftState) deleteLogs(id uint64) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
-	index := -1
+	index := len(rs.logs)
 
-	// find the smallest log index that is greater then or equal to the given log id
+	// find the smallest log index that is greater than the given log id
 	for i := len(rs.logs) - 1; i >= 0; i-- {
-		if rs.logs[i].GetId() >= id {
+		if rs.logs[i].GetId() > id {
 			index = i
 		}
 	}
 
-	// deletes all logs after that log
-	if index != -1 {
-		rs.logs = rs.logs[:index+1]
+	// deletes that log and all logs after it
+	rs.logs = rs.logs[:index]
+}
+
+// compactLogs deletes logs up to and including the last included log of the snapshot
+func (rs *raftState) compactLogs(meta SnapshotMeta) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// copy remaining logs, so compacted logs can be garbage collected
+	rs.logs = append([]*pb.Entry{}, rs.getLogs(meta.LastIncludedId+1)...)
+	rs.snapshotMeta = meta
+}
+
+// LogStats describes the logs not compacted into the snapshot
+type LogStats struct {
+	// Entries is the number of logs
+	Entries int
+	// Bytes is the total size of data of the logs
+	Bytes int
+	// FirstIndex is the ID of the first log, 0 if there is no log
+	FirstIndex uint64
+	// LastIndex is the ID of the last log, or the last log compacted into the snapshot if there is no log
+	LastIndex uint64
+	// SnapshotIndex is the ID of the last log compacted into the snapshot, 0 if there is no snapshot
+	SnapshotIndex uint64
+}
+
+func (rs *raftState) logStats() LogStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	stats := LogStats{Entries: len(rs.logs), SnapshotIndex: rs.snapshotMeta.LastIncludedId}
+	for _, log := range rs.logs {
+		stats.Bytes += len(log.GetData())
+	}
+	if len(rs.logs) != 0 {
+		stats.FirstIndex = rs.logs[0].GetId()
+	}
+	stats.LastIndex, _ = rs.getLastLog()
+
+	return stats
+}
+
+// dumpLogs returns copies of all logs and the metadata of the snapshot that logs before it are compacted into
+func (rs *raftState) dumpLogs() ([]*pb.Entry, SnapshotMeta) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	logs := make([]*pb.Entry, 0, len(rs.logs))
+	for _, log := range rs.logs {
+		logs = append(logs, proto.Clone(log).(*pb.Entry))
+	}
+
+	meta := rs.snapshotMeta
+	if meta.Configuration != nil {
+		meta.Configuration = make(map[uint32]string, len(rs.snapshotMeta.Configuration))
+		for id, addr := range rs.snapshotMeta.Configuration {
+			meta.Configuration[id] = addr
+		}
+	}
+	if meta.Learners != nil {
+		meta.Learners = copyServers(rs.snapshotMeta.Learners)
+	}
+	if meta.Observers != nil {
+		meta.Observers = copyServers(rs.snapshotMeta.Observers)
+	}
+
+	return logs, meta
+}
+
+// applyLogs applies logs between (lastApplied, min(commitIndex, last log)], it stops at the first log failed to apply,
+// so the log is applied again on the next call instead of being skipped, apply runs without the lock held, so it may
+// call methods of Raft taking the lock, and a slow state machine does not block them
+func (rs *raftState) applyLogs(apply func(*pb.Entry) error) error {
+	for _, log := range rs.committedLogs() {
+		// only command logs reach the state machine, configuration and no-op logs are handled by raft itself
+		if log.GetType() == pb.EntryType_COMMAND {
+			if err := apply(log); err != nil {
+				return fmt.Errorf("fail to apply log %d: %w", log.GetId(), err)
+			}
+		}
+
+		rs.setLastApplied(log.GetId(), log.GetType() == pb.EntryType_COMMAND)
 	}
+
+	return nil
 }
 
-// applyLogs applies logs between (lastApplied, commitIndex]
-func (rs *raftState) applyLogs(applyCh chan<- *pb.Entry) {
+// committedLogs returns logs between (lastApplied, min(commitIndex, last log)] in order without gaps
+func (rs *raftState) committedLogs() []*pb.Entry {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
-	logs := rs.getLogs(rs.lastApplied + 1)
-	for _, log := range logs {
-		if log.GetId() > rs.commitIndex {
+	lastLogId, _ := rs.getLastLog()
+	if rs.lastApplied >= lastLogId {
+		return nil
+	}
+
+	var logs []*pb.Entry
+	for _, log := range rs.getLogs(rs.lastApplied + 1) {
+		if log.GetId() > rs.commitIndex || log.GetId() > lastLogId {
 			break
 		}
 
-		applyCh <- log
+		// lastApplied only increases, logs are applied in order without gaps
+		if log.GetId() != rs.lastApplied+uint64(len(logs))+1 {
+			break
+		}
 
-		rs.lastApplied = log.GetId()
+		logs = append(logs, log)
 	}
+
+	return logs
 }
 
 func (rs *raftState) toFollower(term uint64) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	// logs appended by the leader may never be committed once it steps down
+	if rs.state == Leader {
+		failWaiters(rs.commitWaiters, ErrLeadershipLost)
+	}
+
+	rs.roleTimer.transition(rs.state)
 	rs.state = Follower
+	atomic.AddUint64(&rs.leadershipEpoch, 1)
 
 	if rs.currentTerm < term {
-		rs.currentTerm = term
-		rs.votedFor = 0
+		rs.advanceTerm(term)
 	}
 }
 
@@ -187,14 +448,32 @@ func (rs *raftState) toCandidate() {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	rs.roleTimer.transition(rs.state)
 	rs.state = Candidate
 }
 
-func (rs *raftState) toLeader() {
+// toLeader converts a candidate to leader and initializes the volatile state on leader,
+// and returns false without any change if the server is not a candidate
+func (rs *raftState) toLeader(peers map[uint32]Peer) bool {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	if rs.state != Candidate {
+		return false
+	}
+
+	rs.roleTimer.transition(rs.state)
 	rs.state = Leader
+	atomic.AddUint64(&rs.leadershipEpoch, 1)
+
+	// reset `nextIndex` and `matchIndex`
+	lastLogId, _ := rs.getLastLog()
+	for peerId := range peers {
+		rs.nextIndex[peerId] = lastLogId + 1
+		rs.matchIndex[peerId] = 0
+	}
+
+	return true
 }
 
 func (rs *raftState) voteFor(id uint32, voteForSelf bool) {
@@ -203,17 +482,198 @@ func (rs *raftState) voteFor(id uint32, voteForSelf bool) {
 
 	// if vote for self, increase current term
 	if voteForSelf {
-		rs.currentTerm++
+		rs.advanceTerm(rs.currentTerm + 1)
 	}
 
 	rs.votedFor = id
 }
 
+// advanceTerm sets currentTerm to the given newer term and clears the vote of the prior term,
+// so the server can vote in the new term, the leader of the new term is unknown until it is heard
+func (rs *raftState) advanceTerm(term uint64) {
+	// a stale term must never regress the term, or the server may vote twice in a term
+	if term <= rs.currentTerm {
+		return
+	}
+
+	rs.currentTerm = term
+	rs.votedFor = 0
+	rs.leaderId = 0
+}
+
+func (rs *raftState) setLeader(id uint32) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.leaderId = id
+}
+
+func (rs *raftState) getLeader() uint32 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.leaderId
+}
+
+// setCommitIndex advances the commitIndex, it never decreases so committed logs are applied exactly once,
+// and never exceeds the last log so logs not in the log are never considered committed
 func (rs *raftState) setCommitIndex(index uint64) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
+	if lastLogId, _ := rs.getLastLog(); index > lastLogId {
+		index = lastLogId
+	}
+
+	if index <= rs.commitIndex {
+		return
+	}
+
 	rs.commitIndex = index
+	notifyWaiters(rs.commitWaiters, index)
+}
+
+// setLastApplied advances the lastApplied, it never decreases, delivered reports whether the log is handed to the
+// state machine, which must acknowledge it before it counts as applied if `ackApply`
+func (rs *raftState) setLastApplied(index uint64, delivered bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// the persisted snapshot is delivered on startup after the lastApplied already reaches it
+	if delivered && rs.ackApply && index > rs.deliveredIndex {
+		rs.deliveredIndex = index
+	}
+	if index > rs.lastApplied {
+		rs.lastApplied = index
+	}
+	notifyWaiters(rs.applyWaiters, rs.stateMachineApplied())
+}
+
+// ackApplied records that the state machine has applied logs up to the given index received from the ApplyCh
+func (rs *raftState) ackApplied(index uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if index <= rs.ackedIndex {
+		return
+	}
+
+	rs.ackedIndex = index
+	notifyWaiters(rs.applyWaiters, rs.stateMachineApplied())
+}
+
+// stateMachineApplied returns the last log applied by the state machine, which is the lastApplied unless a log sent
+// to the ApplyCh is not acknowledged yet, logs are processed in order, so it is the last acknowledged log then
+func (rs *raftState) stateMachineApplied() uint64 {
+	if rs.ackedIndex >= rs.deliveredIndex {
+		return rs.lastApplied
+	}
+
+	return rs.ackedIndex
+}
+
+// isCommitted reports whether the commitIndex reaches the given index
+func (rs *raftState) isCommitted(index uint64) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.commitIndex >= index
+}
+
+// checkLeadershipEpoch rejects commands submitted against the given leadership epoch once it has changed,
+// zero means the command is not fenced
+func (rs *raftState) checkLeadershipEpoch(epoch uint64) error {
+	if current := atomic.LoadUint64(&rs.leadershipEpoch); epoch != 0 && epoch != current {
+		return fmt.Errorf("%w: leadership epoch %d is changed to %d", ErrLeadershipLost, epoch, current)
+	}
+
+	return nil
+}
+
+// isEntryCommitted reports whether the log with the ID and the term of the given entry is committed, the entry is
+// overwritten if the log at its ID is in another term, and is unknown once it is compacted into the snapshot
+func (rs *raftState) isEntryCommitted(entry *pb.Entry) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if entry.GetId() == 0 || entry.GetId() > rs.commitIndex {
+		return false
+	}
+
+	return rs.getLogTerm(entry.GetId()) == entry.GetTerm()
+}
+
+// waitForCommit blocks until the commitIndex reaches the given index or the context is done
+func (rs *raftState) waitForCommit(ctx context.Context, index uint64) error {
+	rs.mu.Lock()
+	if rs.commitIndex >= index {
+		rs.mu.Unlock()
+		return nil
+	}
+
+	if rs.commitWaiters == nil {
+		rs.commitWaiters = make(map[chan error]uint64)
+	}
+
+	return rs.wait(ctx, rs.commitWaiters, index)
+}
+
+// waitForApply blocks until the state machine applies logs up to the given index or the context is done
+func (rs *raftState) waitForApply(ctx context.Context, index uint64) error {
+	rs.mu.Lock()
+	if rs.stateMachineApplied() >= index {
+		rs.mu.Unlock()
+		return nil
+	}
+
+	if rs.applyWaiters == nil {
+		rs.applyWaiters = make(map[chan error]uint64)
+	}
+
+	return rs.wait(ctx, rs.applyWaiters, index)
+}
+
+// wait registers a waiter of the given index into waiters and blocks until it is notified or the context is done,
+// the lock must be held by the caller and it is released before blocking
+func (rs *raftState) wait(ctx context.Context, waiters map[chan error]uint64, index uint64) error {
+	ch := make(chan error, 1)
+	waiters[ch] = index
+	rs.mu.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+
+	case <-ctx.Done():
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+
+		// the waiter may be notified right after the context is done
+		if _, ok := waiters[ch]; !ok {
+			return <-ch
+		}
+		delete(waiters, ch)
+
+		return ctx.Err()
+	}
+}
+
+// notifyWaiters notifies and removes waiters whose index is reached by the given index
+func notifyWaiters(waiters map[chan error]uint64, index uint64) {
+	for ch, waitIndex := range waiters {
+		if waitIndex <= index {
+			ch <- nil
+			delete(waiters, ch)
+		}
+	}
+}
+
+// failWaiters notifies and removes all waiters with the given error
+func failWaiters(waiters map[chan error]uint64, err error) {
+	for ch := range waiters {
+		ch <- err
+		delete(waiters, ch)
+	}
 }
 
 func (rs *raftState) setNextAndMatchIndex(peerId uint32, nextIndex uint64, matchIndex uint64) {
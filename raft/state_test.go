@@ -0,0 +1,320 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+func TestAppendLogsRejectNonContiguousLogs(t *testing.T) {
+	rs := &raftState{strictLogChecks: true}
+
+	if err := rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}}); err != nil {
+		t.Fatal("fail to append contiguous logs:", err)
+	}
+
+	// log 3 is missing
+	err := rs.appendLogs([]*pb.Entry{{Id: 4, Term: 1}, {Id: 5, Term: 1}})
+	if !errors.Is(err, errNonContiguousLogs) {
+		t.Fatalf("gapped logs should be rejected, got error: %v", err)
+	}
+
+	// log 4 is out of order
+	err = rs.appendLogs([]*pb.Entry{{Id: 3, Term: 1}, {Id: 5, Term: 1}, {Id: 4, Term: 1}})
+	if !errors.Is(err, errNonContiguousLogs) {
+		t.Fatalf("out of order logs should be rejected, got error: %v", err)
+	}
+
+	if lastLogId, _ := rs.getLastLog(); lastLogId != 2 {
+		t.Fatalf("rejected logs should not be appended, last log id %d", lastLogId)
+	}
+
+	// without strict checks, logs are appended as is
+	rs.strictLogChecks = false
+	if err := rs.appendLogs([]*pb.Entry{{Id: 4, Term: 1}}); err != nil {
+		t.Fatal("logs should be appended without strict checks:", err)
+	}
+}
+
+func TestAppendLogsPanicOnLogGapsInDebugMode(t *testing.T) {
+	r := NewRaft(1, map[uint32]Peer{}, nil, &Config{StrictLogChecks: true, DebugInvariants: true}, zap.NewNop())
+	if err := r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}}); err != nil {
+		t.Fatal("fail to append contiguous logs:", err)
+	}
+
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, errNonContiguousLogs) {
+			t.Fatalf("gapped logs should panic in debug mode, got %v", err)
+		}
+		if lastLogId, _ := r.getLastLog(); lastLogId != 1 {
+			t.Fatalf("rejected logs should not be appended, last log id %d", lastLogId)
+		}
+	}()
+
+	// log 2 is missing
+	r.appendLogs([]*pb.Entry{{Id: 3, Term: 1}})
+	t.Fatal("gapped logs should panic in debug mode")
+}
+
+func TestDeleteLogs(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 2}})
+
+	rs.deleteLogs(2)
+	if lastLogId, _ := rs.getLastLog(); lastLogId != 2 {
+		t.Fatalf("logs after log 2 should be deleted, last log id %d", lastLogId)
+	}
+
+	rs.deleteLogs(0)
+	if len(rs.logs) != 0 {
+		t.Fatalf("all logs should be deleted, got %d logs", len(rs.logs))
+	}
+}
+
+func TestWaitForCommit(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- rs.waitForCommit(context.Background(), 2)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rs.setCommitIndex(1)
+
+	select {
+	case <-errCh:
+		t.Fatal("waiter should not be woken before the index is committed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rs.setCommitIndex(3)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal("fail to wait for commit:", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("waiter should be woken after the index is committed")
+	}
+
+	// already committed index returns immediately
+	if err := rs.waitForCommit(context.Background(), 3); err != nil {
+		t.Fatal("fail to wait for committed index:", err)
+	}
+}
+
+func TestWaitForCommitTimeout(t *testing.T) {
+	rs := &raftState{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := rs.waitForCommit(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait should fail with deadline exceeded, got error: %v", err)
+	}
+
+	if len(rs.commitWaiters) != 0 {
+		t.Fatalf("waiter should be removed after the context is done, got %d waiters", len(rs.commitWaiters))
+	}
+}
+
+func TestIsCommitted(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 1}})
+	rs.setCommitIndex(2)
+
+	if !rs.isCommitted(1) || !rs.isCommitted(2) {
+		t.Fatal("logs up to the commit index should be committed")
+	}
+	if rs.isCommitted(3) {
+		t.Fatal("log after the commit index should not be committed")
+	}
+
+	// consistent with waitForCommit, which returns immediately for committed logs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rs.waitForCommit(ctx, 2); err != nil {
+		t.Fatal("fail to wait for committed log:", err)
+	}
+	if err := rs.waitForCommit(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait for uncommitted log should fail with canceled, got error: %v", err)
+	}
+}
+
+func TestIsLogUpToDate(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 2}, {Id: 3, Term: 2}})
+
+	tests := []struct {
+		lastLogId   uint64
+		lastLogTerm uint64
+		upToDate    bool
+	}{
+		{lastLogId: 3, lastLogTerm: 2, upToDate: true},  // equal term, equal id
+		{lastLogId: 4, lastLogTerm: 2, upToDate: true},  // equal term, greater id
+		{lastLogId: 2, lastLogTerm: 2, upToDate: false}, // equal term, smaller id
+		{lastLogId: 1, lastLogTerm: 3, upToDate: true},  // greater term, smaller id
+		{lastLogId: 3, lastLogTerm: 3, upToDate: true},  // greater term, equal id
+		{lastLogId: 5, lastLogTerm: 1, upToDate: false}, // smaller term, greater id
+		{lastLogId: 3, lastLogTerm: 1, upToDate: false}, // smaller term, equal id
+		{lastLogId: 0, lastLogTerm: 0, upToDate: false}, // empty log
+	}
+
+	for _, tt := range tests {
+		if upToDate := rs.isLogUpToDate(tt.lastLogId, tt.lastLogTerm); upToDate != tt.upToDate {
+			t.Fatalf("log ends with id %d term %d: expect up-to-date %v, got %v", tt.lastLogId, tt.lastLogTerm, tt.upToDate, upToDate)
+		}
+	}
+
+	// any log is as up-to-date as an empty log
+	if !(&raftState{}).isLogUpToDate(0, 0) {
+		t.Fatal("empty log should be as up-to-date as an empty log")
+	}
+}
+
+func TestCompactLogs(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 2}})
+
+	rs.compactLogs(SnapshotMeta{LastIncludedId: 2, LastIncludedTerm: 1})
+	if len(rs.logs) != 1 || rs.getLog(3).GetTerm() != 2 {
+		t.Fatalf("only log 3 should remain, got %d logs", len(rs.logs))
+	}
+	if term := rs.getLogTerm(2); term != 1 {
+		t.Fatalf("term of the last included log should be 1, got %d", term)
+	}
+
+	rs.compactLogs(SnapshotMeta{LastIncludedId: 3, LastIncludedTerm: 2})
+	if len(rs.logs) != 0 {
+		t.Fatalf("all logs should be compacted, got %d logs", len(rs.logs))
+	}
+
+	// the last included log is the last log when all logs are compacted
+	if lastLogId, lastLogTerm := rs.getLastLog(); lastLogId != 3 || lastLogTerm != 2 {
+		t.Fatalf("last log should be the last included log, got id %d term %d", lastLogId, lastLogTerm)
+	}
+
+	// appended logs should be contiguous to the last included log
+	rs.strictLogChecks = true
+	if err := rs.appendLogs([]*pb.Entry{{Id: 4, Term: 2}}); err != nil {
+		t.Fatal("fail to append log after the snapshot:", err)
+	}
+}
+
+func TestApplyLogsRetry(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+	rs.setCommitIndex(2)
+
+	errApply := errors.New("state machine unavailable")
+	failed := false
+	applied := []uint64{}
+	apply := func(log *pb.Entry) error {
+		// the first delivery of log 1 fails
+		if log.GetId() == 1 && !failed {
+			failed = true
+			return errApply
+		}
+
+		applied = append(applied, log.GetId())
+		return nil
+	}
+
+	if err := rs.applyLogs(apply); !errors.Is(err, errApply) {
+		t.Fatalf("expect apply error, got: %v", err)
+	}
+	if rs.lastApplied != 0 || len(applied) != 0 {
+		t.Fatal("logs should not be applied after a failed log")
+	}
+
+	if err := rs.applyLogs(apply); err != nil {
+		t.Fatal("fail to apply logs:", err)
+	}
+	if rs.lastApplied != 2 || len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Fatalf("failed log should be retried without being skipped, applied %v", applied)
+	}
+}
+
+func TestApplyLogsOnlyCommands(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{
+		{Id: 1, Term: 1, Type: pb.EntryType_NOOP},
+		{Id: 2, Term: 1, Type: pb.EntryType_COMMAND},
+		{Id: 3, Term: 1, Type: pb.EntryType_CONFIGURATION},
+		{Id: 4, Term: 1, Type: pb.EntryType_COMMAND},
+	})
+	rs.setCommitIndex(4)
+
+	applied := []uint64{}
+	err := rs.applyLogs(func(log *pb.Entry) error {
+		applied = append(applied, log.GetId())
+		return nil
+	})
+	if err != nil {
+		t.Fatal("fail to apply logs:", err)
+	}
+
+	if len(applied) != 2 || applied[0] != 2 || applied[1] != 4 {
+		t.Fatalf("only command logs should be applied, applied %v", applied)
+	}
+	if rs.lastApplied != 4 {
+		t.Fatalf("non-command logs should be marked as applied, last applied %d", rs.lastApplied)
+	}
+}
+
+func TestDumpLogs(t *testing.T) {
+	rs := &raftState{}
+	rs.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}, {Id: 3, Term: 2, Data: []byte("data")}})
+	rs.compactLogs(SnapshotMeta{LastIncludedId: 1, LastIncludedTerm: 1, Configuration: map[uint32]string{1: "addr"}})
+
+	logs, meta := rs.dumpLogs()
+	if meta.LastIncludedId != 1 || meta.LastIncludedTerm != 1 || meta.Configuration[1] != "addr" {
+		t.Fatalf("unexpected snapshot boundary %+v", meta)
+	}
+	if len(logs) != 2 || logs[0].GetId() != 2 || logs[1].GetId() != 3 || string(logs[1].GetData()) != "data" {
+		t.Fatalf("unexpected dumped logs %v", logs)
+	}
+
+	// dumped logs are copies
+	logs[1].Data = []byte("modified")
+	meta.Configuration[1] = "modified"
+	if string(rs.logs[1].GetData()) != "data" || rs.snapshotMeta.Configuration[1] != "addr" {
+		t.Fatal("modifying the dump should not modify the raft state")
+	}
+}
+
+func TestLogStats(t *testing.T) {
+	rs := &raftState{}
+	if stats := rs.logStats(); stats != (LogStats{}) {
+		t.Fatalf("expect empty stats, got %+v", stats)
+	}
+
+	rs.appendLogs([]*pb.Entry{
+		{Id: 1, Term: 1, Data: make([]byte, 10)},
+		{Id: 2, Term: 1, Data: make([]byte, 20)},
+		{Id: 3, Term: 2},
+		{Id: 4, Term: 2, Data: make([]byte, 40)},
+	})
+	if stats := rs.logStats(); stats != (LogStats{Entries: 4, Bytes: 70, FirstIndex: 1, LastIndex: 4}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// compacted logs are not counted
+	rs.compactLogs(SnapshotMeta{LastIncludedId: 2, LastIncludedTerm: 1})
+	if stats := rs.logStats(); stats != (LogStats{Entries: 2, Bytes: 40, FirstIndex: 3, LastIndex: 4, SnapshotIndex: 2}) {
+		t.Fatalf("unexpected stats after compaction %+v", stats)
+	}
+
+	rs.compactLogs(SnapshotMeta{LastIncludedId: 4, LastIncludedTerm: 2})
+	if stats := rs.logStats(); stats != (LogStats{LastIndex: 4, SnapshotIndex: 4}) {
+		t.Fatalf("unexpected stats after compacting all logs %+v", stats)
+	}
+}
@@ -0,0 +1,54 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// PeerStatus is the replication status of a peer observed by the server
+type PeerStatus struct {
+	// NextIndex and MatchIndex are the replication progress of the peer, only maintained by the leader
+	NextIndex  uint64
+	MatchIndex uint64
+	// LastContact is the last time a response of AppendEntries, RequestVote or InstallSnapshot RPCs is received
+	// from the peer, zero if never
+	LastContact time.Time
+	// Paused reports whether RPCs to the peer are paused by `PausePeer`
+	Paused bool
+}
+
+type replicationStatusRequest struct{}
+
+type replicationStatusResponse struct {
+	peers map[uint32]PeerStatus
+}
+
+func (r *Raft) replicationStatus(req *replicationStatusRequest) (*replicationStatusResponse, error) {
+	peers := make(map[uint32]PeerStatus, len(r.peers))
+	for peerId := range r.peers {
+		peers[peerId] = PeerStatus{
+			NextIndex:   r.nextIndex[peerId],
+			MatchIndex:  r.matchIndex[peerId],
+			LastContact: r.lastContact[peerId],
+			Paused:      r.paused[peerId],
+		}
+	}
+
+	return &replicationStatusResponse{peers: peers}, nil
+}
+
+// ReplicationStatus returns the status of each peer, so monitoring can detect a peer that is unreachable
+// while the quorum still holds, by a last contact that stops advancing
+func (r *Raft) ReplicationStatus(ctx context.Context) (map[uint32]PeerStatus, error) {
+	rpcResp, err := r.dispatchRPCRequest(ctx, &replicationStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := rpcResp.(*replicationStatusResponse)
+	if !ok {
+		return nil, errResponseTypeMismatch
+	}
+
+	return resp.peers, nil
+}
@@ -1,17 +1,113 @@
 package raft
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// rpcRetryBackoff is the duration to wait before retrying a failed RPC
+const rpcRetryBackoff = 10 * time.Millisecond
+
+// randMu guards sources set by `Rand` of the config, which may be shared by servers
+var randMu sync.Mutex
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// randomTimeout returns a value that is between the minVal and 2x minVal.
-func randomTimeout(minVal time.Duration) <-chan time.Time {
-	extra := time.Duration(rand.Int63n(int64(minVal)))
+// int63n returns a random number in [0, n) from `Rand` of the config if set, otherwise from the default source.
+func (r *Raft) int63n(n int64) int64 {
+	if r.config.Rand == nil {
+		return rand.Int63n(n)
+	}
+
+	randMu.Lock()
+	defer randMu.Unlock()
+
+	return r.config.Rand.Int63n(n)
+}
+
+// randomTimeout returns the timeout by `randomTimeout` of the config if set, otherwise a random timeout
+// that is between the minVal and 2x minVal.
+func (r *Raft) randomTimeout(minVal time.Duration) <-chan time.Time {
+	if r.config.randomTimeout != nil {
+		return r.config.randomTimeout(minVal)
+	}
+
+	extra := time.Duration(r.int63n(int64(minVal)))
 
 	return time.After(minVal + extra)
 }
+
+// electionRandomTimeout returns the timeout of the candidate to wait for votes computed by the election strategy,
+// which is between the minVal and 2x minVal by default, and closer to the minVal by a higher `ElectionPriority`.
+func (r *Raft) electionRandomTimeout(minVal time.Duration) <-chan time.Time {
+	if r.config.randomTimeout != nil {
+		return r.config.randomTimeout(minVal)
+	}
+
+	return time.After(r.electionStrategy().ComputeTimeout(minVal))
+}
+
+// heartbeatRandomTimeout returns the random timeout of the follower to check heartbeats from the leader, which is
+// shortened by a higher `ElectionPriority` so the loss of the leader is noticed earlier, the follower still starts
+// an election only if no heartbeat is received within the heartbeat timeout.
+func (r *Raft) heartbeatRandomTimeout(minVal time.Duration) <-chan time.Time {
+	return r.randomTimeout(minVal / time.Duration(r.electionPriority()+1))
+}
+
+// electionPriority returns `ElectionPriority` of the config, negative priorities are treated as zero.
+func (r *Raft) electionPriority() int {
+	if r.config.ElectionPriority < 0 {
+		return 0
+	}
+
+	return r.config.ElectionPriority
+}
+
+// rpcContext returns the context for an outgoing RPC, which is cancelled after the RPC timeout.
+func (r *Raft) rpcContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, r.rpcTimeout())
+}
+
+// rpcTimeout returns `RPCTimeout` of the config, which defaults to defaultRPCTimeout.
+func (r *Raft) rpcTimeout() time.Duration {
+	if r.config.RPCTimeout > 0 {
+		return r.config.RPCTimeout
+	}
+
+	return defaultRPCTimeout
+}
+
+// withRetry calls the idempotent RPC and retries it on transient errors for at most `RPCRetries` times
+// or until the context is done.
+func (r *Raft) withRetry(ctx context.Context, call func() error) error {
+	err := call()
+
+	for i := 0; i < r.config.RPCRetries && isTransientError(err); i++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(rpcRetryBackoff):
+		}
+
+		err = call()
+	}
+
+	return err
+}
+
+// isTransientError reports whether the RPC error is caused by a temporary condition and can be retried
+func isTransientError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,32 @@
+package raft
+
+import (
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+// Witnesses are voters storing no logs, they break ties in elections of a cluster with an even number of full servers
+// without the cost of storing and applying logs. A witness grants its vote once per term like other voters, and since
+// it has no log, any candidate is up-to-date to it, so it never stands for election itself.
+//
+// Safety relies on the commit rule: a log is committed only once it is stored on a majority of all voters counting
+// full servers only, witnesses never count towards it. Any majority electing a leader then overlaps such a majority in
+// a full server, which only votes for a candidate having every committed log. The price is availability, a log
+// cannot be committed while more full servers are down than witnesses are up, e.g. a 2+1 cluster elects a leader
+// with one full server down, but cannot commit logs until both full servers are up.
+
+// isWitness reports whether the server is a witness in `Witnesses` of the config
+func (r *Raft) isWitness(serverId uint32) bool {
+	return r.config.Witnesses[serverId]
+}
+
+// witnessAppendEntries acknowledges an AppendEntries RPC of the leader without storing or committing logs,
+// the response is marked so the leader never counts it towards the replication of logs
+func (r *Raft) witnessAppendEntries(req *pb.AppendEntriesRequest) *pb.AppendEntriesResponse {
+	if len(req.GetEntries()) != 0 {
+		r.logger.Warn("witness drops entries from leader", zap.Uint32("leader", req.GetLeaderId()),
+			zap.Int("entries", len(req.GetEntries())))
+	}
+
+	return &pb.AppendEntriesResponse{Term: r.currentTerm, Success: true, Witness: true}
+}
@@ -0,0 +1,117 @@
+package raft
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// peerWorkerQueueSize is the maximum number of RPC tasks queued for a peer, tasks submitted beyond it are dropped,
+// which is rare since each RPC is bounded by the RPC timeout
+const peerWorkerQueueSize = 16
+
+// peerWorkers runs RPC tasks by a persistent worker goroutine per peer, instead of a goroutine per RPC,
+// tasks of the same peer run in the order they are submitted
+type peerWorkers struct {
+	workers map[uint32]*peerWorker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// peerWorker is the worker goroutine of a peer, which stops once its context is cancelled
+type peerWorker struct {
+	queue  chan func()
+	cancel context.CancelFunc
+}
+
+func newPeerWorkers() *peerWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &peerWorkers{
+		workers: make(map[uint32]*peerWorker),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// submit queues the task to the worker of the peer and starts the worker if not started,
+// and returns false if the queue is full or the workers are stopped
+func (w *peerWorkers) submit(peerId uint32, task func()) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ctx.Err() != nil {
+		return false
+	}
+
+	worker, ok := w.workers[peerId]
+	if !ok {
+		ctx, cancel := context.WithCancel(w.ctx)
+		worker = &peerWorker{queue: make(chan func(), peerWorkerQueueSize), cancel: cancel}
+		w.workers[peerId] = worker
+
+		go worker.run(ctx)
+	}
+
+	select {
+	case worker.queue <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *peerWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case task := <-w.queue:
+			// the task may be picked while the worker is being stopped
+			if ctx.Err() != nil {
+				return
+			}
+
+			task()
+		}
+	}
+}
+
+// remove stops the worker of the peer, queued tasks are discarded, while the running task is left to finish
+// and deliver its result, the queue is never closed, so a task is never sent to a closed queue
+func (w *peerWorkers) remove(peerId uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if worker, ok := w.workers[peerId]; ok {
+		worker.cancel()
+		delete(w.workers, peerId)
+	}
+}
+
+// stop stops all workers, queued tasks are discarded
+func (w *peerWorkers) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cancel()
+	w.workers = make(map[uint32]*peerWorker)
+}
+
+// submitRPC submits the task sending the RPC to the peer by the workers, RPCs dropped since the queue of the peer
+// is full are logged and counted by `MetricRPCDropped`, and returns whether the RPC is submitted
+func (r *Raft) submitRPC(workers *peerWorkers, peerId uint32, method string, task func()) bool {
+	if workers.submit(peerId, task) {
+		return true
+	}
+
+	r.metrics.IncrCounter(MetricRPCDropped, 1)
+	r.logger.Warn("drop RPC since too many RPCs are queued for the peer", zap.String("method", method),
+		zap.Uint32("peer", peerId))
+
+	return false
+}
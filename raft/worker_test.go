@@ -0,0 +1,306 @@
+package raft
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/justin0u0/raft/pb"
+	"go.uber.org/zap"
+)
+
+func TestPeerWorkers(t *testing.T) {
+	w := newPeerWorkers()
+	defer w.stop()
+
+	done := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		if !w.submit(1, func() { done <- i }) {
+			t.Fatal("fail to submit task")
+		}
+	}
+
+	// tasks of the same peer run in order
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-done:
+			if got != i {
+				t.Fatalf("expect task %d, got task %d", i, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("task is not run")
+		}
+	}
+
+	// tasks beyond the queue size are dropped while the worker is busy
+	block := make(chan struct{})
+	w.submit(2, func() { <-block })
+	dropped := false
+	for i := 0; i <= peerWorkerQueueSize; i++ {
+		if !w.submit(2, func() {}) {
+			dropped = true
+		}
+	}
+	close(block)
+	if !dropped {
+		t.Fatal("tasks beyond the queue size should be dropped")
+	}
+
+	w.stop()
+	if w.submit(1, func() {}) {
+		t.Fatal("tasks should not be submitted after workers are stopped")
+	}
+}
+
+func TestDroppedRPCMetric(t *testing.T) {
+	metrics := newTestMetrics()
+	r := NewRaft(1, map[uint32]Peer{2: &mockPeer{}}, nil, &Config{Metrics: metrics}, zap.NewNop())
+	defer r.workers.stop()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	// the worker is busy, tasks beyond the queue size are dropped
+	for i := 0; i <= peerWorkerQueueSize+1; i++ {
+		r.submitRPC(r.workers, 2, "AppendEntries", func() { <-block })
+	}
+
+	if dropped := metrics.counter(MetricRPCDropped); dropped == 0 {
+		t.Fatal("dropped RPCs should be counted")
+	}
+}
+
+func TestRunAgainWithoutReset(t *testing.T) {
+	var counts rpcCounts
+	r := NewRaft(1, map[uint32]Peer{2: countRPCs(&counts, 0)}, newPersister(), &Config{
+		HeartbeatTimeout:  150 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ApplyFunc:         func(*pb.Entry) error { return nil },
+	}, zap.NewNop())
+
+	run := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Run(ctx)
+		}()
+
+		time.Sleep(1 * time.Second)
+		cancel()
+		<-done
+	}
+
+	run()
+	if counts.total() == 0 {
+		t.Fatal("RPCs should be sent in the first run")
+	}
+
+	// workers stopped by the first run are not reused by the second one
+	sent := counts.total()
+	run()
+	if counts.total() == sent {
+		t.Fatal("RPCs should be sent in the second run")
+	}
+}
+
+func TestRemovePeerWithRPCInFlight(t *testing.T) {
+	startedCh := make(chan struct{}, 1)
+	releaseCh := make(chan struct{})
+	blocked := &mockPeer{
+		appendEntriesFunc: func(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+			startedCh <- struct{}{}
+			<-releaseCh
+
+			return ackAppendEntries(ctx, in)
+		},
+	}
+	r := NewRaft(1, map[uint32]Peer{2: blocked, 3: &mockPeer{appendEntriesFunc: ackAppendEntries}}, nil, &Config{}, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(t, r, 2)
+
+	ctx := context.Background()
+	appendEntriesResultCh := make(chan *appendEntriesResult, 2)
+	r.broadcastAppendEntries(ctx, appendEntriesResultCh, nil)
+	<-startedCh
+
+	// the task is queued behind the RPC in flight
+	ranCh := make(chan struct{}, 1)
+	if !r.workers.submit(2, func() { ranCh <- struct{}{} }) {
+		t.Fatal("fail to submit task")
+	}
+
+	r.removePeer(2)
+	close(releaseCh)
+
+	// the RPC in flight still delivers its result, which does not bring the removed peer back
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-appendEntriesResultCh:
+			r.handleAppendEntriesResult(ctx, result)
+		case <-time.After(1 * time.Second):
+			t.Fatal("results of RPCs in flight should be delivered")
+		}
+	}
+	if _, ok := r.nextIndex[2]; ok {
+		t.Fatal("next index of the removed peer should not be recreated")
+	}
+	if _, ok := r.matchIndex[2]; ok {
+		t.Fatal("match index of the removed peer should not be recreated")
+	}
+	if _, ok := r.lastContact[2]; ok {
+		t.Fatal("last contact of the removed peer should not be recreated")
+	}
+
+	select {
+	case <-ranCh:
+		t.Fatal("tasks queued for the removed peer should be discarded")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSnapshotDoesNotBlockHeartbeats(t *testing.T) {
+	startedCh := make(chan struct{}, 1)
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+
+	peer := &mockPeer{
+		appendEntriesFunc: ackAppendEntries,
+		installSnapshotFunc: func(ctx context.Context, in *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+			startedCh <- struct{}{}
+
+			select {
+			case <-releaseCh:
+				return &pb.InstallSnapshotResponse{Term: in.GetTerm()}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+	r := NewRaft(1, map[uint32]Peer{2: peer}, newPersister(), &Config{ApplyFunc: func(*pb.Entry) error { return nil }}, zap.NewNop())
+	defer r.workers.stop()
+	defer r.snapshotWorkers.stop()
+
+	r.toFollower(1)
+	r.appendLogs([]*pb.Entry{{Id: 1, Term: 1}, {Id: 2, Term: 1}})
+	r.commit(2)
+	r.applyCommittedLogs()
+	if _, err := r.snapshot(&snapshotRequest{id: 2}); err != nil {
+		t.Fatal("fail to take snapshot:", err)
+	}
+
+	newLeader(t, r, 2)
+	r.setNextAndMatchIndex(2, 1, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appendEntriesResultCh := make(chan *appendEntriesResult, 1)
+	r.broadcastAppendEntries(ctx, appendEntriesResultCh, make(chan *installSnapshotResult, 1))
+
+	select {
+	case <-startedCh:
+	case <-time.After(1 * time.Second):
+		t.Fatal("snapshot should be sent to the peer behind it")
+	}
+
+	// the heartbeat is sent while the snapshot is still being transferred
+	r.sendAppendEntries(ctx, 2, peer, appendEntriesResultCh)
+
+	select {
+	case <-appendEntriesResultCh:
+	case <-time.After(1 * time.Second):
+		t.Fatal("heartbeat should not wait for the snapshot in flight")
+	}
+}
+
+func TestDefaultRPCTimeout(t *testing.T) {
+	errCh := make(chan error, 1)
+	r := NewRaft(1, map[uint32]Peer{2: stallRPCs(errCh)}, nil, &Config{}, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(t, r, 2)
+
+	r.broadcastAppendEntries(context.Background(), make(chan *appendEntriesResult, 1), nil)
+
+	// the RPC to the peer never responding is bounded even if `RPCTimeout` is not configured
+	select {
+	case err := <-errCh:
+		if err != context.DeadlineExceeded {
+			t.Fatal("RPC should be cancelled by deadline, got error:", err)
+		}
+	case <-time.After(defaultRPCTimeout + 500*time.Millisecond):
+		t.Fatal("RPC is not cancelled after the default timeout")
+	}
+}
+
+// BenchmarkBroadcastAppendEntries compares the goroutines and allocations of broadcasting heartbeats by the peer
+// workers against spawning a goroutine per RPC
+func BenchmarkBroadcastAppendEntries(b *testing.B) {
+	numPeers := 100
+
+	peers := make(map[uint32]Peer, numPeers)
+	for i := 2; i <= numPeers+1; i++ {
+		peers[uint32(i)] = &mockPeer{appendEntriesFunc: ackAppendEntries}
+	}
+	r := NewRaft(1, peers, newPersister(), &Config{}, zap.NewNop())
+	defer r.workers.stop()
+
+	newLeader(b, r, 1)
+
+	ctx := context.Background()
+	appendEntriesResultCh := make(chan *appendEntriesResult, numPeers)
+
+	// fanOut sends the heartbeat to each peer by a goroutine per RPC
+	fanOut := func() {
+		for peerId, peer := range r.peers {
+			peerId := peerId
+			peer := peer
+			req := &pb.AppendEntriesRequest{Term: r.currentTerm, LeaderId: r.id, LeaderCommitId: r.commitIndex}
+
+			go func() {
+				resp, err := peer.AppendEntries(ctx, req)
+				if err != nil {
+					return
+				}
+
+				appendEntriesResultCh <- &appendEntriesResult{AppendEntriesResponse: resp, req: req, peerId: peerId}
+			}()
+		}
+	}
+
+	for _, bc := range []struct {
+		name      string
+		broadcast func()
+	}{
+		{name: "workers", broadcast: func() { r.broadcastAppendEntries(ctx, appendEntriesResultCh, nil) }},
+		{name: "goroutines", broadcast: fanOut},
+	} {
+		bc := bc
+
+		b.Run(bc.name, func(b *testing.B) {
+			maxGoroutines := 0
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				bc.broadcast()
+
+				if n := runtime.NumGoroutine(); n > maxGoroutines {
+					maxGoroutines = n
+				}
+
+				for j := 0; j < numPeers; j++ {
+					<-appendEntriesResultCh
+				}
+			}
+
+			b.ReportMetric(float64(maxGoroutines), "goroutines")
+		})
+	}
+}